@@ -0,0 +1,403 @@
+// alias.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// tagAlias is another name of a tag. Looking a tag up by an alias finds the
+// tag, which is called the canonical one.
+type tagAlias struct {
+	ID    int    `json:"id"`
+	Alias string `json:"alias"`
+	TagID int    `json:"tagId"`
+}
+
+// tagAliasInput is the body of a POST request adding an alias.
+type tagAliasInput struct {
+	Alias *string `json:"alias"`
+}
+
+func (in tagAliasInput) missingFields() []string {
+	missing := []string{}
+	if in.Alias == nil {
+		missing = append(missing, "alias")
+	}
+
+	return missing
+}
+
+// tagMerge reports the outcome of merging one tag into another.
+type tagMerge struct {
+	Tag          tag        `json:"tag"`
+	Moved        int        `json:"moved"`
+	Deduplicated int        `json:"deduplicated"`
+	Aliases      []tagAlias `json:"aliases"`
+}
+
+func getTagAliases(db dbtx, tagID int) ([]tagAlias, error) {
+	rows, err := db.Query("SELECT id, alias, tag_id FROM tag_alias WHERE tag_id=$1 ORDER BY id", tagID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	aliases := []tagAlias{}
+
+	for rows.Next() {
+		var ta tagAlias
+		if err := rows.Scan(&ta.ID, &ta.Alias, &ta.TagID); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, ta)
+	}
+
+	return aliases, rows.Err()
+}
+
+// createTagAlias adds the alias, which must not name an active tag or be an
+// alias already.
+func (ta *tagAlias) createTagAlias(db dbtx) error {
+	ta.Alias = strings.TrimSpace(ta.Alias)
+	if ta.Alias == "" {
+		return validationError("Alias must not be empty")
+	}
+
+	named := tag{Name: ta.Alias}
+	switch err := named.getTagByName(db); err {
+	case nil:
+		return validationError("Alias " + strconv.Quote(ta.Alias) + " already names a tag")
+	case sql.ErrNoRows:
+	default:
+		return err
+	}
+
+	err := db.QueryRow(`INSERT INTO tag_alias(alias, tag_id) VALUES($1, $2)
+		ON CONFLICT DO NOTHING RETURNING id`, ta.Alias, ta.TagID).Scan(&ta.ID)
+	if err == sql.ErrNoRows {
+		// the alias belongs to a tag in the trash
+		return validationError("Alias " + strconv.Quote(ta.Alias) + " is already in use")
+	}
+
+	return err
+}
+
+// deleteTagAlias removes the alias from tag ta.TagID and loads what it was.
+// It returns sql.ErrNoRows if the tag has no such alias.
+func (ta *tagAlias) deleteTagAlias(db dbtx) error {
+	return db.QueryRow("DELETE FROM tag_alias WHERE id=$1 AND tag_id=$2 RETURNING alias",
+		ta.ID, ta.TagID).Scan(&ta.Alias)
+}
+
+// mergeTagTx merges tag sourceID into tag targetID: the assignments of the
+// source move to the target, except where the product already has the
+// target, its children move below the target, and its name and aliases
+// become aliases of the target. The source tag is deleted for good.
+func mergeTagTx(tx *sql.Tx, cs *changeSet, sourceID, targetID int) (tagMerge, error) {
+	if sourceID == targetID {
+		return tagMerge{}, validationError("A tag cannot be merged into itself")
+	}
+
+	// lock in ID order, so two merges of the same tags cannot deadlock
+	source, target := tag{ID: sourceID}, tag{ID: targetID}
+	first, second := &source, &target
+	if targetID < sourceID {
+		first, second = second, first
+	}
+	if err := first.getTagForUpdate(tx); err != nil {
+		return tagMerge{}, err
+	}
+	if err := second.getTagForUpdate(tx); err != nil {
+		return tagMerge{}, err
+	}
+	if source.Rule != "" || target.Rule != "" {
+		return tagMerge{}, validationError("Smart tags cannot be merged, their products are selected by their rules")
+	}
+
+	// the children of the source end up below the target, which must
+	// therefore not be one of them
+	below := tag{ID: sourceID, ParentID: &targetID}
+	if err := below.checkParent(tx); err != nil {
+		if _, ok := err.(validationError); ok {
+			return tagMerge{}, validationError("A tag cannot be merged into one of its descendants")
+		}
+		return tagMerge{}, err
+	}
+
+	merge := tagMerge{Tag: target}
+
+	rows, err := tx.Query(`DELETE FROM productToTagAssignment src WHERE src.tagID=$1
+		AND EXISTS (SELECT 1 FROM productToTagAssignment dst
+			WHERE dst.tagID=$2 AND dst.productID = src.productID AND dst.deleted_at IS NULL)
+		RETURNING src.id, src.productID, src.tagID, src.deleted_at IS NULL`, sourceID, targetID)
+	if err != nil {
+		return tagMerge{}, err
+	}
+	err = scanMovedAssignments(rows, func(pta productToTagAssignment) {
+		cs.record("assignment", pta.ID, "deleted", pta, nil)
+		merge.Deduplicated++
+	})
+	if err != nil {
+		return tagMerge{}, err
+	}
+
+	// trashed assignments move too, so restoring their product restores them
+	// with the target. Their positions belonged to the source, so they come
+	// last until the lists are reordered.
+	rows, err = tx.Query(`UPDATE productToTagAssignment
+		SET tagID=$2, position_in_tag=NULL, position_in_product=NULL WHERE tagID=$1
+		RETURNING id, productID, tagID, deleted_at IS NULL`, sourceID, targetID)
+	if err != nil {
+		return tagMerge{}, err
+	}
+	err = scanMovedAssignments(rows, func(pta productToTagAssignment) {
+		before := pta
+		before.TagID = sourceID
+		cs.record("assignment", pta.ID, "updated", before, pta)
+		merge.Moved++
+	})
+	if err != nil {
+		return tagMerge{}, err
+	}
+
+	rows, err = tx.Query(`UPDATE tag SET parent_id=$2 WHERE parent_id=$1
+		RETURNING id, name, key, value, rule, deleted_at`, sourceID, targetID)
+	if err != nil {
+		return tagMerge{}, err
+	}
+	children := []tag{}
+	for rows.Next() {
+		var child tag
+		if err := rows.Scan(&child.ID, &child.Name, &child.Key, &child.Value, &child.Rule, &child.DeletedAt); err != nil {
+			rows.Close()
+			return tagMerge{}, err
+		}
+		children = append(children, child)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return tagMerge{}, err
+	}
+	for _, child := range children {
+		if child.DeletedAt != nil {
+			continue
+		}
+		before := child
+		before.ParentID = &sourceID
+		child.ParentID = &targetID
+		cs.record("tag", child.ID, "updated", before, child)
+	}
+
+	if _, err := tx.Exec("UPDATE tag_alias SET tag_id=$2 WHERE tag_id=$1", sourceID, targetID); err != nil {
+		return tagMerge{}, err
+	}
+	if !strings.EqualFold(source.Name, target.Name) {
+		_, err := tx.Exec(`INSERT INTO tag_alias(alias, tag_id) VALUES($1, $2) ON CONFLICT DO NOTHING`,
+			source.Name, targetID)
+		if err != nil {
+			return tagMerge{}, err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM tag WHERE id=$1", sourceID); err != nil {
+		return tagMerge{}, err
+	}
+	cs.record("tag", sourceID, "merged", source, target)
+
+	if merge.Aliases, err = getTagAliases(tx, targetID); err != nil {
+		return tagMerge{}, err
+	}
+
+	return merge, nil
+}
+
+// scanMovedAssignments calls record for each active assignment of rows,
+// which have an extra column telling whether the assignment is active.
+func scanMovedAssignments(rows *sql.Rows, record func(productToTagAssignment)) error {
+	defer rows.Close()
+
+	moved := []productToTagAssignment{}
+	for rows.Next() {
+		var pta productToTagAssignment
+		var active bool
+		if err := rows.Scan(&pta.ID, &pta.ProductID, &pta.TagID, &active); err != nil {
+			return err
+		}
+		if active {
+			moved = append(moved, pta)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, pta := range moved {
+		record(pta)
+	}
+
+	return nil
+}
+
+// lookupTag responds with the active tag that has the name or alias given by
+// ?name=.
+func (a *App) lookupTag(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: name")
+		return
+	}
+
+	t := tag{Name: name}
+	err := t.getTagByName(a.DB)
+	if err == nil {
+		err = t.getTag(a.DB)
+	}
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Tag not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, t)
+}
+
+func (a *App) getTagAliases(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+
+	t := tag{ID: id}
+	if err := t.getTag(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Tag not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	aliases, err := getTagAliases(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, aliases)
+}
+
+func (a *App) createTagAlias(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+
+	var in tagAliasInput
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&in); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if missing := in.missingFields(); len(missing) > 0 {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: "+strings.Join(missing, ", "))
+		return
+	}
+
+	ta := tagAlias{Alias: *in.Alias, TagID: id}
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		t := tag{ID: id}
+		if err := t.getTagForUpdate(tx); err != nil {
+			return err
+		}
+		if err := ta.createTagAlias(tx); err != nil {
+			return err
+		}
+
+		cs.record("alias", ta.ID, "created", nil, ta)
+		return nil
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Tag not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, ta)
+}
+
+// deleteTagAlias removes an alias. Removing an alias that does not exist is
+// not an error.
+func (a *App) deleteTagAlias(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, errTag := strconv.Atoi(vars["id"])
+	aliasID, errAlias := strconv.Atoi(vars["aliasID"])
+	if errTag != nil || errAlias != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag or alias ID")
+		return
+	}
+
+	err := a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		ta := tagAlias{ID: aliasID, TagID: id}
+		switch err := ta.deleteTagAlias(tx); err {
+		case nil:
+			cs.record("alias", ta.ID, "deleted", ta, nil)
+			return nil
+		case sql.ErrNoRows:
+			return nil
+		default:
+			return err
+		}
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// mergeTag merges the tag into the one given by ?into=, see mergeTagTx.
+func (a *App) mergeTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+
+	into, err := strconv.Atoi(r.FormValue("into"))
+	if err != nil || into < 1 {
+		respondWithError(w, http.StatusBadRequest, "into must be the ID of the tag to merge into")
+		return
+	}
+
+	var merge tagMerge
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		merge, err = mergeTagTx(tx, cs, id, into)
+		return err
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Tag not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, merge)
+}
@@ -0,0 +1,164 @@
+// alias_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func addTagAlias(tagID, alias string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/tag/"+tagID+"/aliases", bytes.NewBufferString(`{"alias":"`+alias+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	return executeRequest(req)
+}
+
+func TestTagAliases(t *testing.T) {
+	clearTable()
+	addTags(2)
+	addProducts(1)
+	addTagAssignment(1, 1)
+
+	response := addTagAlias("1", "tee")
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	// neither an alias nor a tag name can be taken twice
+	checkResponseCode(t, http.StatusUnprocessableEntity, addTagAlias("2", "TEE").Code)
+	checkResponseCode(t, http.StatusUnprocessableEntity, addTagAlias("2", "Tag 0").Code)
+	checkResponseCode(t, http.StatusNotFound, addTagAlias("9", "shirt").Code)
+
+	req, _ := http.NewRequest("GET", "/tags/lookup?name=Tee", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var found tag
+	json.Unmarshal(response.Body.Bytes(), &found)
+	if found.ID != 1 || found.Name != "Tag 0" {
+		t.Errorf("Expected the alias to find Tag 0. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", `/products?filter=tag+%3D+"tee"`, nil)
+	response = executeRequest(req)
+	var products []product
+	json.Unmarshal(response.Body.Bytes(), &products)
+	if len(products) != 1 {
+		t.Errorf("Expected the filter to match the alias. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("DELETE", "/tag/1/alias/1", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/tags/lookup?name=tee", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestMergeTag(t *testing.T) {
+	clearTable()
+	addTags(3)
+	addProducts(3)
+	addTagAssignment(1, 1)
+	addTagAssignment(2, 1)
+	addTagAssignment(2, 2)
+	addTagAssignment(3, 2)
+	addTagAlias("1", "tee")
+
+	// Tag 2 sits below Tag 0 and moves below Tag 1 with the merge
+	req, _ := http.NewRequest("PATCH", "/tag/3", bytes.NewBufferString(`{"parentId":1}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("POST", "/tag/1/merge?into=2", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var merge tagMerge
+	json.Unmarshal(response.Body.Bytes(), &merge)
+	if merge.Tag.ID != 2 || merge.Moved != 1 || merge.Deduplicated != 1 || len(merge.Aliases) != 2 {
+		t.Errorf("Expected one moved and one deduplicated assignment and two aliases. Got %s", response.Body.String())
+	}
+
+	products, _ := getProductsWithTagAssigned(a.DB, 2, 0, 10, false)
+	if len(products) != 3 {
+		t.Errorf("Expected all three products to have Tag 1. Got %v", products)
+	}
+
+	source := tag{ID: 1}
+	if err := source.getTag(a.DB); err == nil {
+		t.Errorf("Expected the merged tag to be gone")
+	}
+
+	moved := tag{ID: 3}
+	moved.getTag(a.DB)
+	if moved.ParentID == nil || *moved.ParentID != 2 {
+		t.Errorf("Expected Tag 2 below Tag 1. Got %v", moved.ParentID)
+	}
+
+	for _, name := range []string{"Tag 0", "tee"} {
+		named := tag{Name: name}
+		if err := named.getTagByName(a.DB); err != nil || named.ID != 2 {
+			t.Errorf("Expected %q to find Tag 1. Got %d %v", name, named.ID, err)
+		}
+	}
+
+	entries, _ := getAuditLog(a.DB, auditFilter{Entity: "tag"}, 0, 10)
+	if len(entries) == 0 || entries[0].Action != "merged" {
+		t.Errorf("Expected the merge to be audited. Got %v", entries)
+	}
+}
+
+func TestMergeTagForgetsPositions(t *testing.T) {
+	clearTable()
+	addTags(2)
+	addProducts(3)
+	addTagAssignment(1, 1)
+	addTagAssignment(2, 1)
+	addTagAssignment(3, 2)
+
+	for url, body := range map[string]string{
+		"/tag/1/products/order": `{"productIDs":[2,1]}`,
+		"/tag/2/products/order": `{"productIDs":[3]}`,
+	} {
+		req, _ := http.NewRequest("PUT", url, bytes.NewBufferString(body))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+
+	req, _ := http.NewRequest("POST", "/tag/1/merge?into=2", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	// the moved products come after the curated one, in the order they were
+	// assigned
+	order, _ := productsOfTagOrdering.getOrder(a.DB, 2)
+	if !reflect.DeepEqual(order, []int{3, 1, 2}) {
+		t.Errorf("Expected product 3 first and the moved products last. Got %v", order)
+	}
+}
+
+func TestMergeTagRejectsInvalidTargets(t *testing.T) {
+	clearTable()
+	addTags(2)
+
+	req, _ := http.NewRequest("PATCH", "/tag/2", bytes.NewBufferString(`{"parentId":1}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	for url, code := range map[string]int{
+		"/tag/1/merge":         http.StatusBadRequest,
+		"/tag/1/merge?into=1":  http.StatusUnprocessableEntity,
+		"/tag/1/merge?into=2":  http.StatusUnprocessableEntity,
+		"/tag/1/merge?into=9":  http.StatusNotFound,
+		"/tag/9/merge?into=1":  http.StatusNotFound,
+		"/tag/1/merge?into=no": http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest("POST", url, nil)
+		response := executeRequest(req)
+		if response.Code != code {
+			t.Errorf("Expected %d for %s. Got %d", code, url, response.Code)
+		}
+	}
+}
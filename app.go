@@ -3,21 +3,33 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"strings"
+	"time"
 
 	"encoding/json"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/mux"
+	graphql "github.com/graph-gophers/graphql-go"
 	_ "github.com/lib/pq"
 )
 
 type App struct {
 	Router *mux.Router
 	DB     *sql.DB
+
+	webhookWake chan struct{}
+	outboxWake  chan struct{}
+	events      *eventHub
+	graphql     *graphql.Schema
 }
 
 func (a *App) Initialize(user, password, port, host, dbname string) {
@@ -36,7 +48,14 @@ func (a *App) Initialize(user, password, port, host, dbname string) {
 		log.Fatal(err)
 	}
 
+	a.webhookWake = make(chan struct{}, 1)
+	a.outboxWake = make(chan struct{}, 1)
+	a.events = newEventHub(a.DB)
+	a.graphql = newGraphQLSchema(a)
+
 	a.Router = mux.NewRouter()
+	a.Router.Use(requestContextMiddleware)
+	a.Router.Use(negotiationMiddleware)
 
 	a.initializeRoutes()
 }
@@ -45,6 +64,34 @@ func (a *App) Run(addr string) {
 	log.Fatal(http.ListenAndServe(":8888", a.Router))
 }
 
+// StartPurgeJob permanently removes items that have been in the trash for
+// longer than retention, checking once every interval.
+func (a *App) StartPurgeJob(retention, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := a.inTx(systemContext(), func(tx *sql.Tx, cs *changeSet) error {
+				purged, err := purgeDeleted(tx, time.Now().Add(-retention))
+				if err != nil {
+					return err
+				}
+
+				for entity, ids := range purged {
+					for _, id := range ids {
+						cs.record(entity, id, "purged", nil, nil)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Printf("purging deleted items: %v", err)
+			}
+		}
+	}()
+}
+
 func (a *App) getProduct(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
@@ -53,6 +100,12 @@ func (a *App) getProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	include, err := parseInclude(r, "tags")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	p := product{ID: id}
 	if err := p.getProduct(a.DB); err != nil {
 		switch err {
@@ -64,6 +117,16 @@ func (a *App) getProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if include["tags"] {
+		embedded, err := withTags(a.DB, []product{p})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, embedded[0])
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, p)
 }
 
@@ -71,10 +134,99 @@ func respondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]string{"error": message})
 }
 
+// readPatch checks the Content-Type of a PATCH request and reads its body.
+// On failure the error response has already been written and ok is false.
+func readPatch(w http.ResponseWriter, r *http.Request) (apply func(doc, patch []byte) ([]byte, error), patch []byte, ok bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	apply, ok = patchFuncs[mediaType]
+	if !ok {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+mergePatchMediaType+" or "+jsonPatchMediaType)
+		return nil, nil, false
+	}
+
+	defer r.Body.Close()
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return nil, nil, false
+	}
+
+	return apply, patch, true
+}
+
+// requiredFields is the input of a request that tells which of its fields
+// are missing.
+type requiredFields interface {
+	missingFields() []string
+}
+
+// patchDocument applies patch to the JSON form of current and decodes the
+// outcome into patched, which must point to a zero value of the same type.
+// The outcome is also decoded into required unless it is nil, so that a
+// patch removing a required field is rejected instead of zeroing it.
+func patchDocument(apply func(doc, patch []byte) ([]byte, error), current interface{}, patch []byte, patched interface{}, required requiredFields) error {
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	if doc, err = apply(doc, patch); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(patched); err != nil {
+		return validationError("The patch could not be applied: " + err.Error())
+	}
+
+	if required != nil {
+		if err := json.Unmarshal(doc, required); err != nil {
+			return validationError("The patch could not be applied: " + err.Error())
+		}
+		if missing := required.missingFields(); len(missing) > 0 {
+			return validationError("The patch removes required fields: " + strings.Join(missing, ", "))
+		}
+	}
+
+	return nil
+}
+
+// respondWithMutationError maps the errors of a mutation to a response.
+// notFound is the message used when the affected row does not exist.
+func respondWithMutationError(w http.ResponseWriter, err error, notFound string) {
+	var invalid validationError
+	var missing notFoundError
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondWithError(w, http.StatusNotFound, notFound)
+	case errors.As(err, &missing):
+		respondWithError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errInvalidPatch):
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errPatchTestFailed):
+		respondWithError(w, http.StatusConflict, err.Error())
+	case errors.As(err, &invalid):
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	response, _ := json.Marshal(payload)
+	encoder := jsonEncoder
+	if ew, ok := w.(*encodingResponseWriter); ok {
+		encoder = ew.encoder
+	}
 
-	w.Header().Set("Content-Type", "application/json")
+	response, err := encoder.encode(payload)
+	if err != nil {
+		encoder, code = jsonEncoder, http.StatusInternalServerError
+		response, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+
+	w.Header().Set("Content-Type", encoder.mediaType)
 	w.WriteHeader(code)
 	w.Write(response)
 }
@@ -90,12 +242,54 @@ func (a *App) getProducts(w http.ResponseWriter, r *http.Request) {
 		start = 0
 	}
 
-	products, err := getProducts(a.DB, start, count)
+	deleted, err := parseDeletedFilter(r.FormValue("deleted"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter, err := parseProductFilterParams(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	include, err := parseInclude(r, "tags")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// NDJSON streams every row, so the page size does not apply
+	if r.FormValue("format") == "ndjson" {
+		if filter != nil {
+			respondWithError(w, http.StatusBadRequest, "filter cannot be combined with format=ndjson")
+			return
+		}
+		if include["tags"] {
+			respondWithError(w, http.StatusBadRequest, "include cannot be combined with format=ndjson")
+			return
+		}
+		a.streamProducts(w, r, deleted)
+		return
+	}
+
+	products, err := getProducts(a.DB, start, count, deleted, filter)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	if include["tags"] {
+		embedded, err := withTags(a.DB, products)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, embedded)
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, products)
 }
 
@@ -108,8 +302,11 @@ func (a *App) createProduct(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if err := p.createProduct(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	err := a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		return createProductTx(tx, cs, &p)
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Product not found")
 		return
 	}
 
@@ -124,17 +321,69 @@ func (a *App) updateProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var p product
+	var in productInput
 	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&p); err != nil {
+	if err := decoder.Decode(&in); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
 		return
 	}
 	defer r.Body.Close()
-	p.ID = id
 
-	if err := p.updateProduct(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if missing := in.missingFields(); len(missing) > 0 {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: "+strings.Join(missing, ", "))
+		return
+	}
+
+	p := product{ID: id, Name: *in.Name, Price: *in.Price}
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		return updateProductTx(tx, cs, p)
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Product not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) patchProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	apply, patch, ok := readPatch(w, r)
+	if !ok {
+		return
+	}
+
+	var p product
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		current := product{ID: id}
+		if err := current.getProductForUpdate(tx); err != nil {
+			return err
+		}
+
+		if err := patchDocument(apply, current, patch, &p, &productInput{}); err != nil {
+			return err
+		}
+		if p.ID != id {
+			return validationError("The product ID cannot be changed")
+		}
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if err := p.updateProduct(tx); err != nil {
+			return err
+		}
+
+		cs.record("product", id, "updated", current, p)
+		return nil
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Product not found")
 		return
 	}
 
@@ -149,8 +398,10 @@ func (a *App) deleteProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p := product{ID: id}
-	if err := p.deleteProduct(a.DB); err != nil {
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		return deleteProductTx(tx, cs, id)
+	})
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -158,6 +409,26 @@ func (a *App) deleteProduct(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
+func (a *App) restoreProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	p := product{ID: id}
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		return restoreProductTx(tx, cs, &p)
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Deleted product not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
 /*
 ##################
 Tags Functionality
@@ -172,6 +443,17 @@ func (a *App) getTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	include, err := parseInclude(r, "products", "usage")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// productCount of the embedded products is the usage of the tag
+	if include["products"] && include["usage"] {
+		respondWithError(w, http.StatusBadRequest, "include=products already counts the products, leave out usage")
+		return
+	}
+
 	t := tag{ID: id}
 	if err := t.getTag(a.DB); err != nil {
 		switch err {
@@ -183,6 +465,26 @@ func (a *App) getTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if include["products"] {
+		embedded, err := withProducts(a.DB, t)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, embedded)
+		return
+	}
+
+	if include["usage"] {
+		usage, err := getTagUsage(a.DB, t.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, tagWithUsage{t, usage})
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, t)
 }
 
@@ -197,13 +499,54 @@ func (a *App) getTags(w http.ResponseWriter, r *http.Request) {
 		start = 0
 	}
 
-	products, err := getTags(a.DB, start, count)
+	deleted, err := parseDeletedFilter(r.FormValue("deleted"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	include, sort, unused, err := tagListOptions(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// NDJSON streams every row, so the page size does not apply
+	if r.FormValue("format") == "ndjson" {
+		if len(include) > 0 || sort != sortTagsByID || unused {
+			respondWithError(w, http.StatusBadRequest, "include, sort and unused cannot be combined with format=ndjson")
+			return
+		}
+		a.streamTags(w, r, deleted)
+		return
+	}
+
+	if len(include) == 0 && sort == sortTagsByID && !unused {
+		tags, err := getTags(a.DB, start, count, deleted)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, tags)
+		return
+	}
+
+	usages, err := getTagsWithUsage(a.DB, start, count, deleted, sort, unused)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, products)
+	if include["usage"] {
+		respondWithJSON(w, http.StatusOK, usages)
+		return
+	}
+
+	tags := make([]tag, len(usages))
+	for i, u := range usages {
+		tags[i] = u.tag
+	}
+	respondWithJSON(w, http.StatusOK, tags)
 }
 
 func (a *App) createTag(w http.ResponseWriter, r *http.Request) {
@@ -215,8 +558,13 @@ func (a *App) createTag(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if err := t.createTag(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	// the database assigns the ID
+	t.ID = 0
+	err := a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		return createTagTx(tx, cs, &t)
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Tag not found")
 		return
 	}
 
@@ -231,17 +579,78 @@ func (a *App) updateTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var t tag
+	var in tagInput
 	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&t); err != nil {
+	if err := decoder.Decode(&in); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
 		return
 	}
 	defer r.Body.Close()
-	t.ID = id
 
-	if err := t.updateTag(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if missing := in.missingFields(); len(missing) > 0 {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: "+strings.Join(missing, ", "))
+		return
+	}
+
+	t := tag{ID: id, Name: *in.Name, ParentID: in.ParentID, Key: in.Key, Value: in.Value, Rule: in.Rule}
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		return updateTagTx(tx, cs, t)
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Tag not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, t)
+}
+
+func (a *App) patchTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+
+	apply, patch, ok := readPatch(w, r)
+	if !ok {
+		return
+	}
+
+	var t tag
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		current := tag{ID: id}
+		if err := current.getTagForUpdate(tx); err != nil {
+			return err
+		}
+
+		if err := patchDocument(apply, current, patch, &t, nil); err != nil {
+			return err
+		}
+		if t.ID != id {
+			return validationError("The tag ID cannot be changed")
+		}
+		if err := t.validate(); err != nil {
+			return err
+		}
+		if err := t.checkParent(tx); err != nil {
+			return err
+		}
+		if err := t.checkFacet(tx); err != nil {
+			return err
+		}
+		if err := t.checkRule(); err != nil {
+			return err
+		}
+		if err := t.updateTag(tx); err != nil {
+			return err
+		}
+
+		cs.record("tag", id, "updated", current, t)
+		return nil
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Tag not found")
 		return
 	}
 
@@ -256,8 +665,10 @@ func (a *App) deleteTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	t := tag{ID: id}
-	if err := t.deleteTag(a.DB); err != nil {
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		return deleteTagTx(tx, cs, id)
+	})
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -265,6 +676,26 @@ func (a *App) deleteTag(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
+func (a *App) restoreTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+
+	t := tag{ID: id}
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		return restoreTagTx(tx, cs, &t)
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Deleted tag not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, t)
+}
+
 // ###############################################################################
 
 func (a *App) getProductToTagAssignment(w http.ResponseWriter, r *http.Request) {
@@ -306,6 +737,7 @@ func (a *App) getProductsWithTag(w http.ResponseWriter, r *http.Request) {
 	}
 	count, _ := strconv.Atoi(r.FormValue("count"))
 	start, _ := strconv.Atoi(r.FormValue("start"))
+	descendants, _ := strconv.ParseBool(r.FormValue("descendants"))
 
 	if count > 10 || count < 1 {
 		count = 10
@@ -314,7 +746,7 @@ func (a *App) getProductsWithTag(w http.ResponseWriter, r *http.Request) {
 		start = 0
 	}
 
-	products, err := getProductsWithTagAssigned(a.DB, tagID, start, count)
+	products, err := getProductsWithTagAssigned(a.DB, tagID, start, count, descendants)
 	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
@@ -377,8 +809,11 @@ func (a *App) createProductToTagAssignment(w http.ResponseWriter, r *http.Reques
 
 	pta := productToTagAssignment{ProductID: productID, TagID: tagID}
 
-	if err := pta.createProductToTagAssignment(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	err := a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		return assignTagTx(tx, cs, &pta)
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Product or tag not found")
 		return
 	}
 
@@ -400,8 +835,11 @@ func (a *App) deleteProductToTagAssignment(w http.ResponseWriter, r *http.Reques
 	}
 
 	pta := productToTagAssignment{ProductID: productid, TagID: tagID}
-	if err := pta.deleteProductToTagAssignmentByProductAndTag(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	err := a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		return unassignTagTx(tx, cs, pta)
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Tag assignment to product not found")
 		return
 	}
 
@@ -416,21 +854,69 @@ Routes
 
 func (a *App) initializeRoutes() {
 	a.Router.HandleFunc("/product/{productID:[0-9]+}/tags", a.getTagsOfProduct).Methods("GET")
+	a.Router.HandleFunc("/product/{productID:[0-9]+}/tags", a.replaceTagsOfProduct).Methods("PUT")
+	a.Router.HandleFunc("/product/{productID:[0-9]+}/tags/order", a.reorderTagsOfProduct).Methods("PUT")
 	a.Router.HandleFunc("/product/{productID:[0-9]+}/tag/{tagID:[0-9]+}", a.getProductToTagAssignment).Methods("GET")
 	a.Router.HandleFunc("/product/{productID:[0-9]+}/tag/{tagID:[0-9]+}", a.createProductToTagAssignment).Methods("POST")
 	a.Router.HandleFunc("/product/{productID:[0-9]+}/tag/{tagID:[0-9]+}", a.deleteProductToTagAssignment).Methods("DELETE")
+	a.Router.HandleFunc("/product/{productID:[0-9]+}/tag/{tagID:[0-9]+}/move", a.moveTagOfProduct).Methods("POST")
 
 	a.Router.HandleFunc("/products", a.getProducts).Methods("GET")
+	a.Router.HandleFunc("/products", a.ingestProducts).Methods("POST")
+	a.Router.HandleFunc("/products/bulk", a.bulkProducts).Methods("POST")
+	a.Router.HandleFunc("/products/export", a.exportProducts).Methods("GET")
+	a.Router.HandleFunc("/products/facets", a.getProductFacets).Methods("GET")
+	a.Router.HandleFunc("/products/import", a.importProducts).Methods("POST")
+	a.Router.HandleFunc("/products/import/{id:[0-9]+}/errors", a.getImportErrors).Methods("GET")
 	a.Router.HandleFunc("/product", a.createProduct).Methods("POST")
 	a.Router.HandleFunc("/product/{id:[0-9]+}", a.getProduct).Methods("GET")
 	a.Router.HandleFunc("/product/{id:[0-9]+}", a.updateProduct).Methods("PUT")
+	a.Router.HandleFunc("/product/{id:[0-9]+}", a.patchProduct).Methods("PATCH")
 	a.Router.HandleFunc("/product/{id:[0-9]+}", a.deleteProduct).Methods("DELETE")
+	a.Router.HandleFunc("/product/{id:[0-9]+}/restore", a.restoreProduct).Methods("POST")
+	a.Router.HandleFunc("/product/{id:[0-9]+}/related", a.getRelatedProducts).Methods("GET")
 
 	a.Router.HandleFunc("/tags", a.getTags).Methods("GET")
+	a.Router.HandleFunc("/tags", a.ingestTags).Methods("POST")
+	a.Router.HandleFunc("/tags/lookup", a.lookupTag).Methods("GET")
+	a.Router.HandleFunc("/tags/suggest", a.suggestTags).Methods("GET")
+	a.Router.HandleFunc("/tags/cleanup", a.cleanupTags).Methods("POST")
 	a.Router.HandleFunc("/tag", a.createTag).Methods("POST")
 	a.Router.HandleFunc("/tag/{id:[0-9]+}", a.getTag).Methods("GET")
 	a.Router.HandleFunc("/tag/{id:[0-9]+}/products", a.getProductsWithTag).Methods("GET")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/products", a.assignTagToProducts).Methods("POST")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/products", a.unassignTagFromProducts).Methods("DELETE")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/products/order", a.reorderProductsOfTag).Methods("PUT")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/product/{productID:[0-9]+}/move", a.moveProductInTag).Methods("POST")
 	a.Router.HandleFunc("/tag/{id:[0-9]+}", a.updateTag).Methods("PUT")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}", a.patchTag).Methods("PATCH")
 	a.Router.HandleFunc("/tag/{id:[0-9]+}", a.deleteTag).Methods("DELETE")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/restore", a.restoreTag).Methods("POST")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/children", a.getTagChildren).Methods("GET")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/ancestors", a.getTagAncestors).Methods("GET")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/breadcrumb", a.getTagBreadcrumb).Methods("GET")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/aliases", a.getTagAliases).Methods("GET")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/aliases", a.createTagAlias).Methods("POST")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/alias/{aliasID:[0-9]+}", a.deleteTagAlias).Methods("DELETE")
+	a.Router.HandleFunc("/tag/{id:[0-9]+}/merge", a.mergeTag).Methods("POST")
+
+	a.Router.HandleFunc("/audit", a.getAudit).Methods("GET")
+	a.Router.HandleFunc("/outbox", a.getOutbox).Methods("GET")
+	a.Router.HandleFunc("/events", a.streamEvents).Methods("GET")
+
+	a.Router.HandleFunc("/webhooks", a.getWebhookSubscriptions).Methods("GET")
+	a.Router.HandleFunc("/webhooks/deadletters", a.getDeadLetters).Methods("GET")
+	a.Router.HandleFunc("/webhook", a.createWebhookSubscription).Methods("POST")
+	a.Router.HandleFunc("/webhook/{id:[0-9]+}", a.getWebhookSubscription).Methods("GET")
+	a.Router.HandleFunc("/webhook/{id:[0-9]+}", a.updateWebhookSubscription).Methods("PUT")
+	a.Router.HandleFunc("/webhook/{id:[0-9]+}", a.deleteWebhookSubscription).Methods("DELETE")
+	a.Router.HandleFunc("/webhook/{id:[0-9]+}/deliveries", a.getWebhookDeliveries).Methods("GET")
+	a.Router.HandleFunc("/webhook/delivery/{id:[0-9]+}/retry", a.retryWebhookDelivery).Methods("POST")
+
+	a.Router.HandleFunc("/graphql", a.serveGraphQL).Methods("POST")
+
+	a.Router.HandleFunc("/openapi.json", a.getOpenAPI).Methods("GET")
+	a.Router.HandleFunc("/docs", a.getDocs).Methods("GET")
+	a.Router.PathPrefix(docsAssetsPath).Handler(http.StripPrefix("/docs/", http.FileServer(http.FS(swaggerUI))))
 
 }
@@ -0,0 +1,338 @@
+// assign.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// productSelection is the body of the bulk assignment endpoints. It names
+// the products either by ID or with a filter expression, see filter.go.
+type productSelection struct {
+	ProductIDs []int  `json:"productIDs"`
+	Filter     string `json:"filter"`
+}
+
+// assignmentDiff reports which IDs a bulk assignment request added, removed
+// or left as they were.
+type assignmentDiff struct {
+	Added     []int `json:"added"`
+	Removed   []int `json:"removed"`
+	Unchanged []int `json:"unchanged"`
+}
+
+func newAssignmentDiff() assignmentDiff {
+	return assignmentDiff{Added: []int{}, Removed: []int{}, Unchanged: []int{}}
+}
+
+// uniqueIDs returns ids sorted and without duplicates.
+func uniqueIDs(ids []int) []int {
+	seen := map[int]bool{}
+	unique := []int{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	sort.Ints(unique)
+
+	return unique
+}
+
+// readProductSelection decodes the selection and parses its filter. It
+// answers the request itself when the selection is invalid.
+func readProductSelection(w http.ResponseWriter, r *http.Request) (productSelection, filterExpr, bool) {
+	var sel productSelection
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&sel); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return sel, nil, false
+	}
+	defer r.Body.Close()
+
+	if (sel.ProductIDs == nil) == (sel.Filter == "") {
+		respondWithError(w, http.StatusBadRequest, "Either productIDs or filter is required")
+		return sel, nil, false
+	}
+	if sel.Filter == "" {
+		return sel, nil, true
+	}
+
+	filter, err := parseProductFilter(sel.Filter)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid filter: "+err.Error())
+		return sel, nil, false
+	}
+
+	return sel, filter, true
+}
+
+// selectProducts resolves a selection to product IDs and locks those
+// products. Unknown product IDs make the whole request fail.
+func selectProducts(tx *sql.Tx, sel productSelection, filter filterExpr) ([]int, error) {
+	ids := uniqueIDs(sel.ProductIDs)
+	if filter != nil {
+		var err error
+		if ids, err = getProductIDsMatching(tx, filter); err != nil {
+			return nil, err
+		}
+	}
+
+	found, err := lockActiveIDs(tx, "products", ids)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []int{}
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, missingIDsError("Products", missing)
+	}
+
+	return ids, nil
+}
+
+func (a *App) assignTagToProducts(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tagID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+
+	sel, filter, ok := readProductSelection(w, r)
+	if !ok {
+		return
+	}
+
+	diff := newAssignmentDiff()
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		t := tag{ID: tagID}
+		if err := t.getTagForUpdate(tx); err != nil {
+			return err
+		}
+		if t.Rule != "" {
+			return smartTagError(tagID)
+		}
+
+		productIDs, err := selectProducts(tx, sel, filter)
+		if err != nil {
+			return err
+		}
+
+		current, err := getAssignmentsOf(tx, "tagID", tagID)
+		if err != nil {
+			return err
+		}
+		assigned := map[int]bool{}
+		for _, pta := range current {
+			assigned[pta.ProductID] = true
+		}
+
+		missing := []productToTagAssignment{}
+		for _, id := range productIDs {
+			if assigned[id] {
+				diff.Unchanged = append(diff.Unchanged, id)
+			} else {
+				missing = append(missing, productToTagAssignment{ProductID: id, TagID: tagID})
+			}
+		}
+
+		created, err := createAssignments(tx, missing)
+		if err != nil {
+			return err
+		}
+
+		for _, pta := range created {
+			diff.Added = append(diff.Added, pta.ProductID)
+			cs.record("assignment", pta.ID, "created", nil, pta)
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Tag not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, diff)
+}
+
+func (a *App) unassignTagFromProducts(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tagID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+
+	sel, filter, ok := readProductSelection(w, r)
+	if !ok {
+		return
+	}
+
+	diff := newAssignmentDiff()
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		t := tag{ID: tagID}
+		if err := t.getTagForUpdate(tx); err != nil {
+			return err
+		}
+		if t.Rule != "" {
+			return smartTagError(tagID)
+		}
+
+		productIDs, err := selectProducts(tx, sel, filter)
+		if err != nil {
+			return err
+		}
+
+		current, err := getAssignmentsOf(tx, "tagID", tagID)
+		if err != nil {
+			return err
+		}
+		byProduct := map[int][]productToTagAssignment{}
+		for _, pta := range current {
+			byProduct[pta.ProductID] = append(byProduct[pta.ProductID], pta)
+		}
+
+		removed := []productToTagAssignment{}
+		for _, id := range productIDs {
+			if len(byProduct[id]) == 0 {
+				diff.Unchanged = append(diff.Unchanged, id)
+				continue
+			}
+			diff.Removed = append(diff.Removed, id)
+			removed = append(removed, byProduct[id]...)
+		}
+
+		if err := deleteAssignments(tx, removed); err != nil {
+			return err
+		}
+
+		for _, pta := range removed {
+			cs.record("assignment", pta.ID, "deleted", pta, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Tag not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, diff)
+}
+
+// replaceTagsOfProduct sets the tags of a product to exactly the given ones.
+func (a *App) replaceTagsOfProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	productID, err := strconv.Atoi(vars["productID"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var in struct {
+		TagIDs []int `json:"tagIDs"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&in); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if in.TagIDs == nil {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: tagIDs")
+		return
+	}
+
+	var diff assignmentDiff
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		var err error
+		diff, err = replaceTagsOfProductTx(tx, cs, productID, in.TagIDs)
+		return err
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Product not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, diff)
+}
+
+// setTagsOfProduct makes tagIDs, which must be unique and name active tags,
+// the tags of the product: missing assignments are created and the others
+// removed, while assignments that stay keep their IDs. Smart tags are left
+// to their rules, whether they are among tagIDs or not, so that exported
+// tags can be imported again.
+func setTagsOfProduct(tx *sql.Tx, cs *changeSet, productID int, tagIDs []int) (assignmentDiff, error) {
+	diff := newAssignmentDiff()
+	smart, err := getSmartTagIDs(tx)
+	if err != nil {
+		return diff, err
+	}
+
+	wanted := map[int]bool{}
+	for _, id := range tagIDs {
+		wanted[id] = true
+	}
+
+	current, err := getAssignmentsOf(tx, "productID", productID)
+	if err != nil {
+		return diff, err
+	}
+
+	assigned := map[int]bool{}
+	removed := []productToTagAssignment{}
+	for _, pta := range current {
+		if smart[pta.TagID] {
+			continue
+		}
+		if wanted[pta.TagID] && !assigned[pta.TagID] {
+			assigned[pta.TagID] = true
+			diff.Unchanged = append(diff.Unchanged, pta.TagID)
+		} else {
+			removed = append(removed, pta)
+		}
+	}
+
+	added := []productToTagAssignment{}
+	for _, id := range tagIDs {
+		if !assigned[id] && !smart[id] {
+			added = append(added, productToTagAssignment{ProductID: productID, TagID: id})
+		}
+	}
+
+	if err := deleteAssignments(tx, removed); err != nil {
+		return diff, err
+	}
+	created, err := createAssignments(tx, added)
+	if err != nil {
+		return diff, err
+	}
+
+	for _, pta := range removed {
+		if !wanted[pta.TagID] {
+			diff.Removed = append(diff.Removed, pta.TagID)
+		}
+		cs.record("assignment", pta.ID, "deleted", pta, nil)
+	}
+	for _, pta := range created {
+		diff.Added = append(diff.Added, pta.TagID)
+		cs.record("assignment", pta.ID, "created", nil, pta)
+	}
+
+	sort.Ints(diff.Unchanged)
+	sort.Ints(diff.Removed)
+	return diff, nil
+}
@@ -0,0 +1,83 @@
+// assign_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func checkAssignmentDiff(t *testing.T, body []byte, expected assignmentDiff) {
+	var diff assignmentDiff
+	json.Unmarshal(body, &diff)
+
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Expected %+v. Got %s", expected, body)
+	}
+}
+
+func TestAssignTagToProducts(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addTags(1)
+	addTagAssignment(1, 1)
+
+	req, _ := http.NewRequest("POST", "/tag/1/products", bytes.NewBuffer([]byte(`{"productIDs":[3, 1, 2, 3]}`)))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkAssignmentDiff(t, response.Body.Bytes(), assignmentDiff{Added: []int{2, 3}, Removed: []int{}, Unchanged: []int{1}})
+
+	req, _ = http.NewRequest("POST", "/tag/1/products", bytes.NewBuffer([]byte(`{"productIDs":[1, 7]}`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("POST", "/tag/2/products", bytes.NewBuffer([]byte(`{"productIDs":[1]}`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestAssignTagByFilter(t *testing.T) {
+	clearTable()
+	// prices are 10, 20 and 30
+	addProducts(3)
+	addTags(1)
+
+	req, _ := http.NewRequest("POST", "/tag/1/products", bytes.NewBuffer([]byte(`{"filter":"price >= 20"}`)))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkAssignmentDiff(t, response.Body.Bytes(), assignmentDiff{Added: []int{2, 3}, Removed: []int{}, Unchanged: []int{}})
+
+	req, _ = http.NewRequest("DELETE", "/tag/1/products", bytes.NewBuffer([]byte(`{"filter":"tag = 'tag 0' and price < 25"}`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkAssignmentDiff(t, response.Body.Bytes(), assignmentDiff{Added: []int{}, Removed: []int{2}, Unchanged: []int{}})
+
+	req, _ = http.NewRequest("DELETE", "/tag/1/products", bytes.NewBuffer([]byte(`{"filter":"price >"}`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestReplaceTagsOfProduct(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addTags(3)
+	addTagAssignment(1, 1)
+	addTagAssignment(1, 2)
+
+	req, _ := http.NewRequest("PUT", "/product/1/tags", bytes.NewBuffer([]byte(`{"tagIDs":[2, 3]}`)))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkAssignmentDiff(t, response.Body.Bytes(), assignmentDiff{Added: []int{3}, Removed: []int{1}, Unchanged: []int{2}})
+
+	req, _ = http.NewRequest("PUT", "/product/1/tags", bytes.NewBuffer([]byte(`{"tagIDs":[2, 9]}`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/product/1/tags", bytes.NewBuffer([]byte(`{"tagIDs":[]}`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkAssignmentDiff(t, response.Body.Bytes(), assignmentDiff{Added: []int{}, Removed: []int{2, 3}, Unchanged: []int{}})
+}
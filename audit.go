@@ -0,0 +1,319 @@
+// audit.go
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type contextKey string
+
+const (
+	actorKey     contextKey = "actor"
+	requestIDKey contextKey = "requestID"
+
+	// systemActor is recorded for changes made by background jobs.
+	systemActor = "system"
+)
+
+// requestContextMiddleware stores the actor and request ID of every request
+// in its context. The service has no authentication, so the actor is taken
+// from the X-Actor header. The request ID is echoed back to the client.
+func requestContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, requestID := withRequestContext(r.Context(), r.Header.Get("X-Request-ID"), r.Header.Get("X-Actor"))
+		w.Header().Set("X-Request-ID", requestID)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withRequestContext stores the actor and request ID a client sent in ctx.
+// It makes up a request ID when there is none and returns it.
+func withRequestContext(ctx context.Context, requestID, actor string) (context.Context, string) {
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	if actor == "" {
+		actor = "anonymous"
+	}
+
+	ctx = context.WithValue(ctx, requestIDKey, requestID)
+	return context.WithValue(ctx, actorKey, actor), requestID
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// systemContext is the context background jobs run their changes in.
+func systemContext() context.Context {
+	ctx := context.WithValue(context.Background(), requestIDKey, newRequestID())
+	return context.WithValue(ctx, actorKey, systemActor)
+}
+
+func contextString(ctx context.Context, key contextKey) string {
+	value, _ := ctx.Value(key).(string)
+	return value
+}
+
+// change describes a single mutation of a product, tag or assignment.
+// Before is nil for creations and After is nil for deletions.
+type change struct {
+	Entity   string      `json:"entity"`
+	EntityID int         `json:"entity_id"`
+	Action   string      `json:"action"`
+	Before   interface{} `json:"before"`
+	After    interface{} `json:"after"`
+	Diff     interface{} `json:"diff"`
+}
+
+// changeSet collects the changes made within one transaction.
+type changeSet struct {
+	changes []change
+}
+
+func (cs *changeSet) record(entity string, id int, action string, before, after interface{}) {
+	cs.changes = append(cs.changes, change{
+		Entity:   entity,
+		EntityID: id,
+		Action:   action,
+		Before:   before,
+		After:    after,
+		Diff:     diffJSON(before, after),
+	})
+}
+
+// inTx runs fn in a transaction and writes the changes it recorded to the
+// audit log, the outbox and the webhook queue before committing, so the
+// data, its history and the events sent about it never diverge. Smart tags
+// are updated first, so their changes are recorded too. The error returned
+// by fn is passed through unchanged.
+func (a *App) inTx(ctx context.Context, fn func(tx *sql.Tx, cs *changeSet) error) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cs := &changeSet{}
+	if err := fn(tx, cs); err != nil {
+		return err
+	}
+
+	if err := updateSmartTags(tx, cs); err != nil {
+		return err
+	}
+
+	if err := writeAuditLog(tx, ctx, cs.changes); err != nil {
+		return err
+	}
+
+	events := newCatalogEvents(ctx, cs.changes)
+	if err := writeOutbox(tx, events); err != nil {
+		return err
+	}
+
+	enqueued, err := enqueueWebhooks(tx, events)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if len(events) > 0 {
+		a.wakeOutboxRelay()
+		a.events.notify()
+	}
+	if enqueued > 0 {
+		a.wakeWebhookWorker()
+	}
+
+	return nil
+}
+
+func writeAuditLog(db dbtx, ctx context.Context, changes []change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	records, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO audit_log(entity, entity_id, action, actor, request_id, before, after, diff)
+		SELECT entity, entity_id, action, $1, $2, before, after, diff
+		FROM ROWS FROM (jsonb_to_recordset($3::jsonb) AS (entity TEXT, entity_id integer, action TEXT, before JSONB, after JSONB, diff JSONB))
+		WITH ORDINALITY AS x(entity, entity_id, action, before, after, diff, n)
+		ORDER BY n`,
+		contextString(ctx, actorKey), contextString(ctx, requestIDKey), string(records))
+
+	return err
+}
+
+// diffJSON compares the top level fields of the JSON form of before and
+// after and returns the changed ones as {"field": {"from": x, "to": y}}.
+func diffJSON(before, after interface{}) map[string]interface{} {
+	from := jsonFields(before)
+	to := jsonFields(after)
+
+	diff := map[string]interface{}{}
+	for k, v := range from {
+		if w, ok := to[k]; !ok || !jsonEqual(v, w) {
+			diff[k] = map[string]interface{}{"from": v, "to": to[k]}
+		}
+	}
+	for k, w := range to {
+		if _, ok := from[k]; !ok {
+			diff[k] = map[string]interface{}{"from": nil, "to": w}
+		}
+	}
+
+	return diff
+}
+
+func jsonFields(v interface{}) map[string]interface{} {
+	if v == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	fields, _ := decodeJSONValue(data)
+	m, _ := fields.(map[string]interface{})
+	return m
+}
+
+type auditEntry struct {
+	ID        int64           `json:"id"`
+	Entity    string          `json:"entity"`
+	EntityID  int             `json:"entityID"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	RequestID string          `json:"requestID"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Diff      json.RawMessage `json:"diff,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// auditFilter narrows down getAuditLog. Zero values match everything.
+type auditFilter struct {
+	Entity    string
+	EntityID  int
+	Action    string
+	Actor     string
+	RequestID string
+	Since     time.Time
+	Until     time.Time
+}
+
+func getAuditLog(db dbtx, f auditFilter, start, count int) ([]auditEntry, error) {
+	var since, until *time.Time
+	if !f.Since.IsZero() {
+		since = &f.Since
+	}
+	if !f.Until.IsZero() {
+		until = &f.Until
+	}
+
+	rows, err := db.Query(`SELECT id, entity, entity_id, action, actor, request_id, before, after, diff, created_at
+		FROM audit_log
+		WHERE ($1 = '' OR entity = $1) AND ($2 = 0 OR entity_id = $2) AND ($3 = '' OR action = $3)
+		AND ($4 = '' OR actor = $4) AND ($5 = '' OR request_id = $5)
+		AND ($6::timestamptz IS NULL OR created_at >= $6) AND ($7::timestamptz IS NULL OR created_at < $7)
+		ORDER BY id DESC LIMIT $8 OFFSET $9`,
+		f.Entity, f.EntityID, f.Action, f.Actor, f.RequestID, since, until, count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []auditEntry{}
+
+	for rows.Next() {
+		var e auditEntry
+		var before, after, diff []byte
+		if err := rows.Scan(&e.ID, &e.Entity, &e.EntityID, &e.Action, &e.Actor, &e.RequestID, &before, &after, &diff, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Before, e.After, e.Diff = before, after, diff
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+func (a *App) getAudit(w http.ResponseWriter, r *http.Request) {
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	if count > 100 || count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	f := auditFilter{
+		Entity:    r.FormValue("entity"),
+		Action:    r.FormValue("action"),
+		Actor:     r.FormValue("actor"),
+		RequestID: r.FormValue("requestID"),
+	}
+
+	switch f.Entity {
+	case "", "product", "tag", "assignment", "alias", "tag_order", "product_order":
+	default:
+		respondWithError(w, http.StatusBadRequest, "entity must be one of product, tag, assignment, alias, tag_order or product_order")
+		return
+	}
+
+	if id := r.FormValue("id"); id != "" {
+		var err error
+		if f.EntityID, err = strconv.Atoi(id); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid entity ID")
+			return
+		}
+	}
+
+	for _, bound := range []struct {
+		name   string
+		target *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if value := r.FormValue(bound.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, bound.name+" must be an RFC 3339 timestamp")
+				return
+			}
+			*bound.target = t
+		}
+	}
+
+	entries, err := getAuditLog(a.DB, f, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, entries)
+}
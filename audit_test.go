@@ -0,0 +1,115 @@
+// audit_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAuditLogOfProductChanges(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer([]byte(`{"name":"audited", "price": 10}`)))
+	req.Header.Set("X-Actor", "alice")
+	req.Header.Set("X-Request-ID", "req-1")
+	executeRequest(req)
+
+	req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBuffer([]byte(`{"price": 12.5}`)))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("X-Actor", "bob")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if response.Header().Get("X-Request-ID") == "" {
+		t.Errorf("Expected the response to carry a request ID")
+	}
+
+	req, _ = http.NewRequest("GET", "/audit?entity=product&id=1", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var entries []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &entries)
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries. Got %s", response.Body.String())
+	}
+
+	// newest first
+	update, create := entries[0], entries[1]
+
+	if create["action"] != "created" || create["actor"] != "alice" || create["requestID"] != "req-1" {
+		t.Errorf("Expected the creation by alice in request req-1. Got %v", create)
+	}
+
+	diff, _ := update["diff"].(map[string]interface{})
+	price, _ := diff["price"].(map[string]interface{})
+	if update["actor"] != "bob" || price["from"] != 10.0 || price["to"] != 12.5 {
+		t.Errorf("Expected bob's price change from 10 to 12.5. Got %v", update)
+	}
+	if _, ok := diff["name"]; ok {
+		t.Errorf("Expected the unchanged name to be left out of the diff. Got %v", diff)
+	}
+}
+
+func TestAuditLogOfAssignments(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addTags(1)
+
+	req, _ := http.NewRequest("POST", "/product/1/tag/1", nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("DELETE", "/product/1", nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("GET", "/audit?entity=assignment&action=deleted", nil)
+	response := executeRequest(req)
+
+	var entries []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &entries)
+
+	if len(entries) != 1 {
+		t.Errorf("Expected the assignment deleted along with the product to be audited. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/audit?count=1", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &entries)
+
+	if len(entries) != 1 || entries[0]["entity"] != "product" {
+		t.Errorf("Expected one page with the product deletion. Got %s", response.Body.String())
+	}
+
+	addTagAlias("1", "label")
+	req, _ = http.NewRequest("GET", "/audit?entity=alias", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &entries)
+
+	if len(entries) != 1 || entries[0]["action"] != "created" {
+		t.Errorf("Expected the new alias to be audited. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/audit?entity=order", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestAuditLogIsAppendOnly(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("POST", "/tag", bytes.NewBuffer([]byte(`{"name":"audited"}`)))
+	executeRequest(req)
+
+	if _, err := a.DB.Exec("UPDATE audit_log SET actor='mallory'"); err == nil {
+		t.Errorf("Expected updating the audit log to fail")
+	}
+
+	if _, err := a.DB.Exec("DELETE FROM audit_log"); err == nil {
+		t.Errorf("Expected deleting from the audit log to fail")
+	}
+}
@@ -0,0 +1,411 @@
+// bulk.go
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// bulkBatchSize is how many operations are read from the request and written
+// to the database at a time.
+const bulkBatchSize = 1000
+
+// errBulkFailed rolls back an all-or-nothing bulk request in which at least
+// one operation failed.
+var errBulkFailed = errors.New("bulk operation failed")
+
+// bulkOperation is one line of a bulk request. Updates replace the whole
+// product like PUT does, so they need all fields.
+type bulkOperation struct {
+	Op    string   `json:"op"`
+	ID    int      `json:"id"`
+	Name  *string  `json:"name"`
+	Price *float64 `json:"price"`
+	// keepID makes a create use ID instead of a new one, see ingestNDJSON
+	keepID bool
+	// raw is the line the operation was read from
+	raw json.RawMessage
+}
+
+// bulkResult reports the outcome of one operation, identified by its
+// position in the request. Status is the code the single-product endpoint
+// would have answered with.
+type bulkResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	ID     int    `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (r bulkResult) failed() bool {
+	return r.Status >= 400
+}
+
+type bulkResponse struct {
+	Mode      string       `json:"mode"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Error     string       `json:"error,omitempty"`
+	Results   []bulkResult `json:"results"`
+}
+
+func (resp *bulkResponse) add(results []bulkResult) {
+	for _, r := range results {
+		if r.failed() {
+			resp.Failed++
+		} else {
+			resp.Succeeded++
+		}
+	}
+	resp.Results = append(resp.Results, results...)
+}
+
+// bulkReader reads operations from either a JSON array or a stream of
+// newline delimited JSON documents, without holding the whole body in memory.
+type bulkReader struct {
+	decoder *json.Decoder
+	array   bool
+	index   int
+}
+
+func newBulkReader(body io.Reader) (*bulkReader, error) {
+	buffered := bufio.NewReader(body)
+
+	for {
+		b, err := buffered.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			break
+		}
+		buffered.ReadByte()
+	}
+
+	r := &bulkReader{decoder: json.NewDecoder(buffered)}
+
+	if b, err := buffered.Peek(1); err == nil && b[0] == '[' {
+		r.decoder.Token()
+		r.array = true
+	}
+
+	return r, nil
+}
+
+// next reads up to n operations. Operations that are valid JSON but do not
+// fit bulkOperation are returned with a failed result; a syntax error ends
+// the stream, since there is no way to find the start of the next document.
+func (r *bulkReader) next(n int) ([]bulkOperation, []bulkResult, error) {
+	ops := []bulkOperation{}
+	results := []bulkResult{}
+
+	for len(ops) < n {
+		if r.array && !r.decoder.More() {
+			break
+		}
+
+		var raw json.RawMessage
+		if err := r.decoder.Decode(&raw); err == io.EOF && !r.array {
+			break
+		} else if err != nil {
+			return ops, results, fmt.Errorf("Invalid request payload at operation %d", r.index)
+		}
+
+		var op bulkOperation
+		result := bulkResult{Index: r.index}
+		if err := json.Unmarshal(raw, &op); err != nil {
+			result.Status, result.Error = http.StatusBadRequest, "Invalid operation payload"
+		} else {
+			result.Op, result.ID = op.Op, op.ID
+		}
+		op.raw = raw
+		ops = append(ops, op)
+		results = append(results, result)
+		r.index++
+	}
+
+	return ops, results, nil
+}
+
+// validate turns op into the product it creates, updates or deletes. A
+// failed result is returned for operations that cannot be applied.
+func (op bulkOperation) validate() (product, int, string) {
+	p := product{ID: op.ID}
+
+	switch op.Op {
+	case "create":
+		if !op.keepID {
+			p.ID = 0
+		}
+		if op.Name != nil {
+			p.Name = *op.Name
+		}
+		if op.Price != nil {
+			p.Price = *op.Price
+		}
+	case "update":
+		if op.ID < 1 {
+			return p, http.StatusBadRequest, "Invalid product ID"
+		}
+		if missing := (productInput{Name: op.Name, Price: op.Price}).missingFields(); len(missing) > 0 {
+			return p, http.StatusBadRequest, "Missing required fields: " + strings.Join(missing, ", ")
+		}
+		p.Name, p.Price = *op.Name, *op.Price
+	case "delete":
+		if op.ID < 1 {
+			return p, http.StatusBadRequest, "Invalid Product ID"
+		}
+		return p, 0, ""
+	default:
+		return p, http.StatusBadRequest, "Invalid operation, op must be one of create, update or delete"
+	}
+
+	if err := p.validate(); err != nil {
+		return p, http.StatusUnprocessableEntity, err.Error()
+	}
+
+	return p, 0, ""
+}
+
+// applyBulkBatch applies the valid operations of a batch and fills in their
+// results. Consecutive operations of the same kind run as one statement;
+// a run ends early when it would touch a product twice, so the outcome is
+// the same as applying the operations one by one.
+func applyBulkBatch(tx *sql.Tx, cs *changeSet, ops []bulkOperation, results []bulkResult) error {
+	type run struct {
+		op       string
+		products []product
+		results  []*bulkResult
+	}
+
+	runs := []*run{}
+	var current *run
+	seen := map[int]bool{}
+
+	for i, op := range ops {
+		if results[i].failed() {
+			continue
+		}
+
+		p, status, message := op.validate()
+		if status != 0 {
+			results[i].Status, results[i].Error = status, message
+			continue
+		}
+
+		if current == nil || current.op != op.Op || (op.Op != "create" && seen[p.ID]) {
+			current = &run{op: op.Op}
+			runs = append(runs, current)
+			seen = map[int]bool{}
+		}
+		seen[p.ID] = true
+		current.products = append(current.products, p)
+		current.results = append(current.results, &results[i])
+	}
+
+	for _, r := range runs {
+		var err error
+		switch r.op {
+		case "create":
+			err = bulkCreate(tx, cs, r.products, r.results)
+		case "update":
+			err = bulkUpdate(tx, cs, r.products, r.results)
+		case "delete":
+			err = bulkDelete(tx, cs, r.products, r.results)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func bulkCreate(tx *sql.Tx, cs *changeSet, products []product, results []*bulkResult) error {
+	if err := createProducts(tx, products); err != nil {
+		return err
+	}
+
+	for i, p := range products {
+		results[i].ID, results[i].Status = p.ID, http.StatusCreated
+		cs.record("product", p.ID, "created", nil, p)
+	}
+
+	return nil
+}
+
+func bulkUpdate(tx *sql.Tx, cs *changeSet, products []product, results []*bulkResult) error {
+	current, err := getProductsForUpdate(tx, productIDs(products))
+	if err != nil {
+		return err
+	}
+
+	found := []product{}
+	for i, p := range products {
+		if _, ok := current[p.ID]; !ok {
+			results[i].Status, results[i].Error = http.StatusNotFound, "Product not found"
+			continue
+		}
+		found = append(found, p)
+		results[i].Status = http.StatusOK
+	}
+
+	if err := updateProducts(tx, found); err != nil {
+		return err
+	}
+
+	for _, p := range found {
+		cs.record("product", p.ID, "updated", current[p.ID], p)
+	}
+
+	return nil
+}
+
+func bulkDelete(tx *sql.Tx, cs *changeSet, products []product, results []*bulkResult) error {
+	ids := productIDs(products)
+	current, err := getProductsForUpdate(tx, ids)
+	if err != nil {
+		return err
+	}
+
+	trashed, err := deleteProducts(tx, ids)
+	if err != nil {
+		return err
+	}
+
+	// deleting a product that does not exist is not an error
+	for i := range products {
+		results[i].Status = http.StatusOK
+	}
+
+	for _, pta := range trashed {
+		cs.record("assignment", pta.ID, "deleted", pta, nil)
+	}
+	for _, id := range ids {
+		if p, ok := current[id]; ok {
+			cs.record("product", id, "deleted", p, nil)
+		}
+	}
+
+	return nil
+}
+
+func productIDs(products []product) []int {
+	ids := make([]int, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+
+	return ids
+}
+
+// bulkProducts applies a list of create, update and delete operations, sent
+// as a JSON array or as NDJSON, in batches of bulkBatchSize.
+//
+// In the default atomic mode all batches share one transaction, which is
+// rolled back as soon as a batch contains a failed operation; the response
+// then lists the failed operations only. With mode=partial every batch is
+// committed on its own and failed operations are skipped, and the response
+// lists the result of every operation.
+func (a *App) bulkProducts(w http.ResponseWriter, r *http.Request) {
+	mode := r.FormValue("mode")
+	switch mode {
+	case "":
+		mode = "atomic"
+	case "atomic", "partial":
+	default:
+		respondWithError(w, http.StatusBadRequest, "mode must be one of atomic or partial")
+		return
+	}
+
+	reader, err := newBulkReader(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	resp := bulkResponse{Mode: mode, Results: []bulkResult{}}
+
+	if mode == "atomic" {
+		var payloadErr error
+		err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+			for {
+				ops, results, err := reader.next(bulkBatchSize)
+				if err != nil {
+					payloadErr = err
+					return err
+				}
+				if len(ops) == 0 {
+					return nil
+				}
+
+				if err := applyBulkBatch(tx, cs, ops, results); err != nil {
+					return err
+				}
+
+				for _, result := range results {
+					if result.failed() {
+						resp.add([]bulkResult{result})
+					}
+				}
+				if resp.Failed > 0 {
+					return errBulkFailed
+				}
+				resp.Succeeded += len(results)
+			}
+		})
+
+		switch {
+		case err == nil:
+			respondWithJSON(w, http.StatusOK, resp)
+		case err == payloadErr:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case err == errBulkFailed:
+			resp.Succeeded = 0
+			resp.Error = "No operation was applied because some of them failed"
+			respondWithJSON(w, http.StatusUnprocessableEntity, resp)
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	for {
+		// the operations read before a malformed one are still applied
+		ops, results, readErr := reader.next(bulkBatchSize)
+		if len(ops) > 0 {
+			err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+				return applyBulkBatch(tx, cs, ops, results)
+			})
+			if err != nil {
+				// the batch was rolled back, so none of its operations took effect
+				for i := range results {
+					results[i].Status, results[i].Error = http.StatusInternalServerError, err.Error()
+				}
+			}
+			resp.add(results)
+		}
+
+		if readErr != nil {
+			resp.Error = readErr.Error()
+			break
+		}
+		if len(ops) == 0 {
+			break
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,135 @@
+// bulk_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func executeBulk(t *testing.T, query, body string, code int) bulkResponse {
+	req, _ := http.NewRequest("POST", "/products/bulk"+query, bytes.NewBufferString(body))
+	response := executeRequest(req)
+	checkResponseCode(t, code, response.Code)
+
+	var resp bulkResponse
+	json.Unmarshal(response.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestBulkProductsAtomic(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	resp := executeBulk(t, "", `[
+		{"op":"create", "name":"bulk one", "price": 1},
+		{"op":"create", "name":"bulk two", "price": 2},
+		{"op":"update", "id": 1, "name":"renamed", "price": 5},
+		{"op":"delete", "id": 2}
+	]`, http.StatusOK)
+
+	if resp.Succeeded != 4 || resp.Failed != 0 {
+		t.Fatalf("Expected 4 applied operations. Got %+v", resp)
+	}
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	response := executeRequest(req)
+
+	var products []product
+	json.Unmarshal(response.Body.Bytes(), &products)
+	names := map[int]string{}
+	for _, p := range products {
+		names[p.ID] = p.Name
+	}
+	if len(products) != 3 || names[1] != "renamed" || names[3] != "bulk one" || names[4] != "bulk two" {
+		t.Errorf("Expected the renamed product and the two created ones. Got %s", response.Body.String())
+	}
+
+	resp = executeBulk(t, "?mode=atomic", `[
+		{"op":"create", "name":"never stored", "price": 1},
+		{"op":"update", "id": 42, "name":"missing", "price": 1}
+	]`, http.StatusUnprocessableEntity)
+
+	if len(resp.Results) != 1 || resp.Results[0].Index != 1 || resp.Results[0].Status != http.StatusNotFound {
+		t.Errorf("Expected only the failed update to be reported. Got %+v", resp)
+	}
+
+	var count int
+	a.DB.QueryRow("SELECT COUNT(*) FROM products WHERE name = 'never stored'").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected the atomic request to be rolled back")
+	}
+}
+
+func TestBulkProductsPartialNDJSON(t *testing.T) {
+	clearTable()
+
+	body := strings.Join([]string{
+		`{"op":"create", "name":"kept", "price": 1}`,
+		`{"op":"create", "name":"", "price": 1}`,
+		`{"op":"update", "id": 1, "name":"no price"}`,
+		`{"op":"create", "price":"not a number"}`,
+		`{"op":"merge", "id": 1}`,
+	}, "\n")
+
+	resp := executeBulk(t, "?mode=partial", body, http.StatusOK)
+
+	expected := []int{http.StatusCreated, http.StatusUnprocessableEntity, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest}
+	if len(resp.Results) != len(expected) || resp.Succeeded != 1 || resp.Failed != 4 {
+		t.Fatalf("Expected a result for every operation. Got %+v", resp)
+	}
+	for i, status := range expected {
+		if resp.Results[i].Status != status {
+			t.Errorf("Expected status %d for operation %d. Got %+v", status, i, resp.Results[i])
+		}
+	}
+}
+
+func TestBulkProductsPartialKeepsOperationsBeforeMalformedOne(t *testing.T) {
+	clearTable()
+
+	body := strings.Join([]string{
+		`{"op":"create", "name":"first", "price": 1}`,
+		`{"op":"create", "name":"second", "price": 2}`,
+		`{"op":"create", "name": nope}`,
+		`{"op":"create", "name":"never read", "price": 3}`,
+	}, "\n")
+
+	resp := executeBulk(t, "?mode=partial", body, http.StatusOK)
+	if len(resp.Results) != 2 || resp.Succeeded != 2 || resp.Error == "" {
+		t.Errorf("Expected the two operations before the malformed one to be applied. Got %+v", resp)
+	}
+
+	products, _ := getProductsAfter(a.DB, 0, 10, nil)
+	if len(products) != 2 {
+		t.Errorf("Expected two products. Got %v", products)
+	}
+}
+
+func TestBulkProductsAreAudited(t *testing.T) {
+	clearTable()
+	addTags(1)
+
+	executeBulk(t, "", `[{"op":"create", "name":"tagged", "price": 1}]`, http.StatusOK)
+	req, _ := http.NewRequest("POST", "/product/1/tag/1", nil)
+	executeRequest(req)
+
+	executeBulk(t, "", `{"op":"delete", "id": 1}`, http.StatusOK)
+
+	var actions []string
+	rows, _ := a.DB.Query("SELECT entity || '.' || action FROM audit_log ORDER BY id")
+	for rows.Next() {
+		var action string
+		rows.Scan(&action)
+		actions = append(actions, action)
+	}
+	rows.Close()
+
+	expected := "product.created assignment.created assignment.deleted product.deleted"
+	if strings.Join(actions, " ") != expected {
+		t.Errorf("Expected audit entries %s. Got %v", expected, actions)
+	}
+}
@@ -0,0 +1,716 @@
+// cli.go
+
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Rockensc20/cicd-microservices/client"
+)
+
+// schemaSQL is the schema of the catalog, applied by the migrate command.
+//
+//go:embed init.sql
+var schemaSQL string
+
+const cliUsage = `Usage: catalogctl [-server URL] [-o table|json|csv] [-actor NAME] COMMAND
+
+Without -server (or CATALOG_SERVER), commands work on the database given by
+the APP_DB_* variables, running the same code as the service.
+
+Commands:
+  products list [-start N] [-count N] [-deleted include|only]
+  products search [-start N] [-count N] FILTER     e.g. 'price < 10 and tag = "sale"'
+  products get ID
+  products create -name NAME -price PRICE
+  products update [-name NAME] [-price PRICE] ID
+  products delete ID
+  products restore ID
+  tags list [-start N] [-count N] [-deleted include|only] [-usage] [-sort id|usage|-usage] [-unused]
+  tags get ID
+  tags create NAME
+  tags rename ID NAME
+  tags delete ID
+  tags restore ID
+  tags cleanup [-dry-run] [-older-than DURATION]   trash tags no product has, e.g. -older-than 720h
+  tag PRODUCT_ID TAG_ID...
+  untag PRODUCT_ID TAG_ID...
+  import [-dry-run] [-match id|name] [-map Header:field,...] FILE|-
+  export [FILE|-]
+  migrate                                          database only
+`
+
+// cliArgs tells whether the binary was started as the admin tool, either
+// through a link named catalogctl or with the ctl subcommand, and returns
+// the arguments of the tool.
+func cliArgs(args []string) ([]string, bool) {
+	if strings.TrimSuffix(filepath.Base(args[0]), ".exe") == "catalogctl" {
+		return args[1:], true
+	}
+	if len(args) > 1 && args[1] == "ctl" {
+		return args[2:], true
+	}
+
+	return nil, false
+}
+
+// errUsage is returned for malformed command lines; the usage has already
+// been printed.
+var errUsage = errors.New("usage")
+
+type cli struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	// openApp connects to the database when no server is given
+	openApp func() (*App, error)
+
+	server string
+	output string
+	actor  string
+	app    *App
+}
+
+// runCLI runs the admin tool and returns its exit code.
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer, openApp func() (*App, error)) int {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr, openApp: openApp}
+
+	actor := os.Getenv("USER")
+	if actor == "" {
+		actor = "catalogctl"
+	}
+
+	fs := c.flagSet("catalogctl")
+	fs.StringVar(&c.server, "server", os.Getenv("CATALOG_SERVER"), "URL of a running service")
+	fs.StringVar(&c.output, "o", "table", "output format: table, json or csv")
+	fs.StringVar(&c.actor, "actor", actor, "actor recorded in the audit log")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	switch c.output {
+	case "table", "json", "csv":
+	default:
+		fmt.Fprintf(stderr, "catalogctl: unknown output format %q\n", c.output)
+		return 2
+	}
+
+	err := c.run(context.Background(), fs.Args())
+	switch {
+	case errors.Is(err, errUsage):
+		return 2
+	case err != nil:
+		fmt.Fprintf(stderr, "catalogctl: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func (c *cli) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() { fmt.Fprint(c.stderr, cliUsage) }
+
+	return fs
+}
+
+// parseArgs parses the flags of fs wherever they appear among args and
+// returns the positional arguments, which there must be want of unless want
+// is negative.
+func (c *cli) parseArgs(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if want >= 0 && len(positional) != want {
+		fs.Usage()
+		return nil, errUsage
+	}
+
+	return positional, nil
+}
+
+func (c *cli) usage() error {
+	fmt.Fprint(c.stderr, cliUsage)
+	return errUsage
+}
+
+func parseID(arg string) (int, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid ID %q", arg)
+	}
+
+	return id, nil
+}
+
+func (c *cli) run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return c.usage()
+	}
+
+	switch args[0] {
+	case "products":
+		return c.runProducts(ctx, args[1:])
+	case "tags":
+		return c.runTags(ctx, args[1:])
+	case "tag", "untag":
+		return c.runTag(ctx, args[0], args[1:])
+	case "import":
+		return c.runImport(ctx, args[1:])
+	case "export":
+		return c.runExport(ctx, args[1:])
+	case "migrate":
+		return c.runMigrate(args[1:])
+	case "help":
+		fmt.Fprint(c.stdout, cliUsage)
+		return nil
+	}
+
+	return c.usage()
+}
+
+// connect returns a client for the server, or for the database through the
+// router of an App when no server is given.
+func (c *cli) connect() (*client.Client, error) {
+	if c.server != "" {
+		return client.New(c.server, client.WithActor(c.actor)), nil
+	}
+
+	app, err := c.database()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Client{Transport: routerTransport{app.Router}}
+	return client.New("http://catalogctl", client.WithActor(c.actor), client.WithHTTPClient(transport), client.WithRetries(0)), nil
+}
+
+func (c *cli) database() (*App, error) {
+	if c.app == nil {
+		app, err := c.openApp()
+		if err != nil {
+			return nil, err
+		}
+		c.app = app
+	}
+
+	return c.app, nil
+}
+
+// listFlags adds the paging flags to fs.
+func listFlags(fs *flag.FlagSet) *client.ListOptions {
+	opts := &client.ListOptions{}
+	fs.IntVar(&opts.Start, "start", 0, "offset of the first item")
+	fs.IntVar(&opts.Count, "count", 0, "page size")
+	fs.StringVar(&opts.Deleted, "deleted", "", "include or only")
+
+	return opts
+}
+
+func (c *cli) runProducts(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return c.usage()
+	}
+
+	fs := c.flagSet("products " + args[0])
+	var result interface{}
+
+	switch args[0] {
+	case "list", "search":
+		opts := listFlags(fs)
+		positional, err := c.parseArgs(fs, args[1:], -1)
+		if err != nil {
+			return err
+		}
+		if args[0] == "search" {
+			if len(positional) == 0 {
+				return c.usage()
+			}
+			opts.Filter = strings.Join(positional, " ")
+		} else if len(positional) > 0 {
+			return c.usage()
+		}
+
+		cl, err := c.connect()
+		if err != nil {
+			return err
+		}
+		if result, err = cl.ListProducts(ctx, opts); err != nil {
+			return err
+		}
+
+	case "create", "update":
+		name := fs.String("name", "", "product name")
+		price := fs.Float64("price", 0, "product price")
+		want := 0
+		if args[0] == "update" {
+			want = 1
+		}
+		positional, err := c.parseArgs(fs, args[1:], want)
+		if err != nil {
+			return err
+		}
+
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+		cl, err := c.connect()
+		if err != nil {
+			return err
+		}
+
+		if args[0] == "create" {
+			if !set["name"] || !set["price"] {
+				return c.usage()
+			}
+			if result, err = cl.CreateProduct(ctx, *name, *price); err != nil {
+				return err
+			}
+			break
+		}
+
+		id, err := parseID(positional[0])
+		if err != nil {
+			return err
+		}
+		p, err := cl.GetProduct(ctx, id)
+		if err != nil {
+			return err
+		}
+		if set["name"] {
+			p.Name = *name
+		}
+		if set["price"] {
+			p.Price = *price
+		}
+		if result, err = cl.UpdateProduct(ctx, *p); err != nil {
+			return err
+		}
+
+	case "get", "delete", "restore":
+		positional, err := c.parseArgs(fs, args[1:], 1)
+		if err != nil {
+			return err
+		}
+		id, err := parseID(positional[0])
+		if err != nil {
+			return err
+		}
+
+		cl, err := c.connect()
+		if err != nil {
+			return err
+		}
+		switch args[0] {
+		case "get":
+			result, err = cl.GetProduct(ctx, id)
+		case "delete":
+			return cl.DeleteProduct(ctx, id)
+		case "restore":
+			result, err = cl.RestoreProduct(ctx, id)
+		}
+		if err != nil {
+			return err
+		}
+
+	default:
+		return c.usage()
+	}
+
+	return c.print(result)
+}
+
+func (c *cli) runTags(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return c.usage()
+	}
+
+	fs := c.flagSet("tags " + args[0])
+	var result interface{}
+
+	switch args[0] {
+	case "list":
+		opts := listFlags(fs)
+		fs.BoolVar(&opts.Usage, "usage", false, "show how many products have each tag")
+		fs.StringVar(&opts.Sort, "sort", "", "id, usage or -usage")
+		fs.BoolVar(&opts.Unused, "unused", false, "only tags no product has")
+		if _, err := c.parseArgs(fs, args[1:], 0); err != nil {
+			return err
+		}
+
+		cl, err := c.connect()
+		if err != nil {
+			return err
+		}
+		if result, err = cl.ListTags(ctx, opts); err != nil {
+			return err
+		}
+
+	case "create":
+		positional, err := c.parseArgs(fs, args[1:], 1)
+		if err != nil {
+			return err
+		}
+
+		cl, err := c.connect()
+		if err != nil {
+			return err
+		}
+		if result, err = cl.CreateTag(ctx, positional[0]); err != nil {
+			return err
+		}
+
+	case "rename":
+		positional, err := c.parseArgs(fs, args[1:], 2)
+		if err != nil {
+			return err
+		}
+		id, err := parseID(positional[0])
+		if err != nil {
+			return err
+		}
+
+		cl, err := c.connect()
+		if err != nil {
+			return err
+		}
+		if result, err = cl.RenameTag(ctx, id, positional[1]); err != nil {
+			return err
+		}
+
+	case "cleanup":
+		dryRun := fs.Bool("dry-run", false, "list the tags without removing them")
+		olderThan := fs.Duration("older-than", defaultCleanupAge, "minimum age of the tags")
+		if _, err := c.parseArgs(fs, args[1:], 0); err != nil {
+			return err
+		}
+
+		cl, err := c.connect()
+		if err != nil {
+			return err
+		}
+		cleanup, err := cl.CleanupTags(ctx, *olderThan, *dryRun)
+		if err != nil {
+			return err
+		}
+
+		if c.output != "table" {
+			return c.print(cleanup)
+		}
+		if err := c.print(cleanup.Tags); err != nil {
+			return err
+		}
+		verb := "moved to the trash"
+		if cleanup.DryRun {
+			verb = "would be moved to the trash"
+		}
+		fmt.Fprintf(c.stderr, "%d unused tags older than %s %s\n", len(cleanup.Tags), cleanup.OlderThan, verb)
+		return nil
+
+	case "get", "delete", "restore":
+		positional, err := c.parseArgs(fs, args[1:], 1)
+		if err != nil {
+			return err
+		}
+		id, err := parseID(positional[0])
+		if err != nil {
+			return err
+		}
+
+		cl, err := c.connect()
+		if err != nil {
+			return err
+		}
+		switch args[0] {
+		case "get":
+			result, err = cl.GetTag(ctx, id)
+		case "delete":
+			return cl.DeleteTag(ctx, id)
+		case "restore":
+			result, err = cl.RestoreTag(ctx, id)
+		}
+		if err != nil {
+			return err
+		}
+
+	default:
+		return c.usage()
+	}
+
+	return c.print(result)
+}
+
+// runTag assigns tags to or removes them from a product. It goes through
+// the bulk assignment endpoints, so tagging twice does not assign a tag
+// twice.
+func (c *cli) runTag(ctx context.Context, command string, args []string) error {
+	positional, err := c.parseArgs(c.flagSet(command), args, -1)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 2 {
+		return c.usage()
+	}
+
+	ids := make([]int, len(positional))
+	for i, arg := range positional {
+		if ids[i], err = parseID(arg); err != nil {
+			return err
+		}
+	}
+
+	cl, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	type tagChange struct {
+		ProductID int    `json:"productID"`
+		TagID     int    `json:"tagID"`
+		Change    string `json:"change"`
+	}
+
+	changes := []tagChange{}
+	sel := client.ProductSelection{ProductIDs: ids[:1]}
+	for _, tagID := range ids[1:] {
+		change := tagChange{ProductID: ids[0], TagID: tagID, Change: "unchanged"}
+
+		if command == "tag" {
+			diff, err := cl.AssignTagToProducts(ctx, tagID, sel)
+			if err != nil {
+				return err
+			}
+			if len(diff.Added) > 0 {
+				change.Change = "added"
+			}
+		} else {
+			diff, err := cl.UnassignTagFromProducts(ctx, tagID, sel)
+			if err != nil {
+				return err
+			}
+			if len(diff.Removed) > 0 {
+				change.Change = "removed"
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	return c.print(changes)
+}
+
+func (c *cli) runImport(ctx context.Context, args []string) error {
+	fs := c.flagSet("import")
+	var opts client.ImportOptions
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "check the rows without importing them")
+	fs.StringVar(&opts.Match, "match", "", "id or name")
+	fs.StringVar(&opts.Map, "map", "", "header mapping, e.g. Title:name,Cost:price")
+
+	positional, err := c.parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	in := c.stdin
+	if positional[0] != "-" {
+		f, err := os.Open(positional[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	cl, err := c.connect()
+	if err != nil {
+		return err
+	}
+	imp, err := cl.ImportProducts(ctx, in, opts)
+	if err != nil {
+		return err
+	}
+
+	if c.output != "table" {
+		return c.print(imp)
+	}
+
+	// the rejected rows do not fit into the summary row
+	errs := imp.Errors
+	imp.Errors = nil
+	if err := c.print(imp); err != nil {
+		return err
+	}
+	for _, e := range errs {
+		fmt.Fprintf(c.stderr, "line %d: %s\n", e.Line, e.Error)
+	}
+
+	return nil
+}
+
+func (c *cli) runExport(ctx context.Context, args []string) error {
+	positional, err := c.parseArgs(c.flagSet("export"), args, -1)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return c.usage()
+	}
+
+	cl, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	if len(positional) == 0 || positional[0] == "-" {
+		return cl.ExportProducts(ctx, c.stdout)
+	}
+
+	f, err := os.Create(positional[0])
+	if err != nil {
+		return err
+	}
+	if err := cl.ExportProducts(ctx, f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// runMigrate applies the schema. Every statement of it can be run again, so
+// migrating an up-to-date database changes nothing.
+func (c *cli) runMigrate(args []string) error {
+	if _, err := c.parseArgs(c.flagSet("migrate"), args, 0); err != nil {
+		return err
+	}
+	if c.server != "" {
+		return errors.New("migrate works on the database, leave out -server")
+	}
+
+	app, err := c.database()
+	if err != nil {
+		return err
+	}
+	if _, err := app.DB.Exec(schemaSQL); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.stderr, "schema is up to date")
+	return nil
+}
+
+// print writes v in the output format.
+func (c *cli) print(v interface{}) error {
+	switch c.output {
+	case "json":
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(c.stdout, "%s\n", data)
+		return err
+	case "csv":
+		data, err := encodeCSV(v)
+		if err != nil {
+			return err
+		}
+		_, err = c.stdout.Write(data)
+		return err
+	}
+
+	columns, records, err := tabulate(v)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+	for _, record := range records {
+		fmt.Fprintln(tw, strings.Join(record, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// routerTransport serves the requests of a client in-process with the
+// router of an App, so the direct database mode runs exactly the handlers
+// of the service. Response bodies are streamed through a pipe, so exports
+// do not have to fit into memory.
+type routerTransport struct {
+	handler http.Handler
+}
+
+func (t routerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+
+	body, pw := io.Pipe()
+	w := &pipeResponseWriter{header: http.Header{}, body: pw, started: make(chan struct{})}
+
+	go func() {
+		defer pw.Close()
+		t.handler.ServeHTTP(w, req)
+		w.WriteHeader(http.StatusOK)
+	}()
+
+	<-w.started
+	return &http.Response{
+		Status:        strconv.Itoa(w.code) + " " + http.StatusText(w.code),
+		StatusCode:    w.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.sent,
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+type pipeResponseWriter struct {
+	header  http.Header
+	sent    http.Header
+	code    int
+	body    *io.PipeWriter
+	started chan struct{}
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(code int) {
+	if w.sent != nil {
+		return
+	}
+	w.code, w.sent = code, w.header.Clone()
+	close(w.started)
+}
+
+func (w *pipeResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func (w *pipeResponseWriter) Flush() {}
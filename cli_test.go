@@ -0,0 +1,182 @@
+// cli_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// executeCLI runs the admin tool in direct mode on the test database.
+func executeCLI(t *testing.T, stdin string, args ...string) (string, string, int) {
+	var stdout, stderr bytes.Buffer
+	code := runCLI(args, strings.NewReader(stdin), &stdout, &stderr, func() (*App, error) { return &a, nil })
+
+	return stdout.String(), stderr.String(), code
+}
+
+func TestCLIProducts(t *testing.T) {
+	clearTable()
+
+	stdout, stderr, code := executeCLI(t, "", "-o", "json", "products", "create", "-name", "Lamp", "-price", "19.99")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0. Got %d: %s", code, stderr)
+	}
+	var p product
+	json.Unmarshal([]byte(stdout), &p)
+	if p.ID != 1 || p.Name != "Lamp" || p.Price != 19.99 {
+		t.Errorf("Expected the created product. Got %s", stdout)
+	}
+
+	executeCLI(t, "", "products", "update", "1", "-price", "5")
+	executeCLI(t, "", "products", "create", "-name", "Desk", "-price", "150")
+
+	stdout, _, _ = executeCLI(t, "", "-o", "csv", "products", "list")
+	if stdout != "id,name,price\n1,Lamp,5\n2,Desk,150\n" {
+		t.Errorf("Expected both products as CSV. Got %q", stdout)
+	}
+
+	stdout, _, _ = executeCLI(t, "", "products", "search", "price", ">", "100")
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "Desk") {
+		t.Errorf("Expected a table with the desk. Got %q", stdout)
+	}
+
+	if _, _, code := executeCLI(t, "", "products", "delete", "2"); code != 0 {
+		t.Errorf("Expected the product to be deleted")
+	}
+	if _, stderr, code := executeCLI(t, "", "products", "get", "2"); code != 1 || !strings.Contains(stderr, "Product not found") {
+		t.Errorf("Expected the deleted product to be missing. Got %d: %s", code, stderr)
+	}
+
+	if _, _, code := executeCLI(t, "", "products", "frobnicate"); code != 2 {
+		t.Errorf("Expected a usage error for an unknown command. Got %d", code)
+	}
+}
+
+func TestCLITagAndUntag(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	executeCLI(t, "", "tags", "create", "red")
+	executeCLI(t, "", "tags", "create", "blue")
+
+	executeCLI(t, "", "tag", "1", "1", "2")
+	stdout, _, _ := executeCLI(t, "", "-o", "json", "tag", "1", "1")
+	if !strings.Contains(stdout, `"change": "unchanged"`) {
+		t.Errorf("Expected tagging twice to change nothing. Got %s", stdout)
+	}
+
+	stdout, _, _ = executeCLI(t, "", "-o", "csv", "untag", "1", "2")
+	if stdout != "productID,tagID,change\n1,2,removed\n" {
+		t.Errorf("Expected the tag to be removed. Got %q", stdout)
+	}
+
+	tags, _ := getTagsAssignedToProduct(a.DB, 1, 0, 10)
+	if len(tags) != 1 || tags[0].Name != "red" {
+		t.Errorf("Expected only the red tag to remain. Got %v", tags)
+	}
+}
+
+func TestCLITagsCleanup(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	executeCLI(t, "", "tags", "create", "red")
+	executeCLI(t, "", "tags", "create", "blue")
+	executeCLI(t, "", "tag", "1", "1")
+
+	stdout, _, _ := executeCLI(t, "", "-o", "csv", "tags", "list", "-usage", "-sort", "-usage")
+	if stdout != "id,name,usage\n1,red,1\n2,blue,0\n" {
+		t.Errorf("Expected the tags with their usage. Got %q", stdout)
+	}
+
+	stdout, stderr, code := executeCLI(t, "", "tags", "cleanup", "-dry-run", "-older-than", "0s")
+	if code != 0 || !strings.Contains(stdout, "blue") || !strings.Contains(stderr, "1 unused tags older than 0s would be moved") {
+		t.Errorf("Expected the dry run to list the blue tag. Got %d: %q %q", code, stdout, stderr)
+	}
+
+	executeCLI(t, "", "tags", "cleanup", "-older-than", "0s")
+	stdout, _, _ = executeCLI(t, "", "-o", "json", "tags", "list", "-unused")
+	if stdout != "[]\n" {
+		t.Errorf("Expected no unused tag to remain. Got %q", stdout)
+	}
+}
+
+func TestCLIImportExport(t *testing.T) {
+	clearTable()
+
+	file := filepath.Join(t.TempDir(), "products.csv")
+	os.WriteFile(file, []byte("name,price,tags\nChair,49,furniture\n,1,\n"), 0o644)
+
+	stdout, stderr, code := executeCLI(t, "", "import", file)
+	if code != 0 || !strings.Contains(stdout, "CREATED") || !strings.Contains(stderr, "line 3:") {
+		t.Errorf("Expected a summary and the rejected line. Got %d: %s %s", code, stdout, stderr)
+	}
+
+	stdout, _, _ = executeCLI(t, "", "export")
+	if stdout != "id,name,price,tags\n1,Chair,49.00,furniture\n" {
+		t.Errorf("Expected the imported product. Got %q", stdout)
+	}
+
+	if _, stderr, code := executeCLI(t, "", "migrate"); code != 0 {
+		t.Errorf("Expected migrating an up-to-date database to succeed. Got %s", stderr)
+	}
+}
+
+func TestCLIOverHTTP(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	stdout, stderr, code := executeCLI(t, "", "-server", server.URL, "-actor", "ops", "-o", "json", "products", "get", "1")
+	if code != 0 || !strings.Contains(stdout, `"name": "Product 0"`) {
+		t.Errorf("Expected the product over HTTP. Got %d: %s %s", code, stdout, stderr)
+	}
+
+	if _, _, code := executeCLI(t, "", "-server", server.URL, "migrate"); code != 1 {
+		t.Errorf("Expected migrate to refuse working over HTTP")
+	}
+}
+
+func TestRouterTransport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		w.WriteHeader(http.StatusTeapot)
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("chunk\n"))
+		}
+	})
+
+	hc := &http.Client{Transport: routerTransport{handler}}
+	resp, err := hc.Get("http://catalogctl/brew")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTeapot || resp.Header.Get("X-Path") != "/brew" || string(body) != "chunk\nchunk\nchunk\n" {
+		t.Errorf("Expected the handler's response. Got %d %v %q", resp.StatusCode, resp.Header, body)
+	}
+}
+
+func TestCLIArgs(t *testing.T) {
+	if args, ok := cliArgs([]string{"/usr/local/bin/catalogctl", "tags", "list"}); !ok || len(args) != 2 {
+		t.Errorf("Expected the catalogctl link to run the tool")
+	}
+	if args, ok := cliArgs([]string{"cicd-microservices", "ctl", "migrate"}); !ok || args[0] != "migrate" {
+		t.Errorf("Expected the ctl subcommand to run the tool")
+	}
+	if _, ok := cliArgs([]string{"cicd-microservices"}); ok {
+		t.Errorf("Expected the service to run without arguments")
+	}
+}
@@ -0,0 +1,398 @@
+// catalog.go
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type Product struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Price     float64    `json:"price"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+type Tag struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentID *int   `json:"parentId,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Value    string `json:"value,omitempty"`
+	// Rule selects the products of a smart tag, e.g. "price < 10"
+	Rule      string     `json:"rule,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// Usage is the number of products with the tag, see ListOptions.Usage
+	Usage *int `json:"usage,omitempty"`
+}
+
+type Assignment struct {
+	ID        int `json:"id"`
+	ProductID int `json:"productID"`
+	TagID     int `json:"tagID"`
+}
+
+// AssignmentDiff reports which IDs a bulk assignment added, removed or left
+// as they were.
+type AssignmentDiff struct {
+	Added     []int `json:"added"`
+	Removed   []int `json:"removed"`
+	Unchanged []int `json:"unchanged"`
+}
+
+// ProductSelection picks products either by ID or by a filter expression
+// such as `price < 10 and tag = "sale"`, not both. An empty, non-nil
+// ProductIDs picks no products.
+type ProductSelection struct {
+	ProductIDs []int  `json:"productIDs"`
+	Filter     string `json:"filter,omitempty"`
+}
+
+// Deleted values of ListOptions.
+const (
+	ExcludeDeleted = ""
+	IncludeDeleted = "include"
+	OnlyDeleted    = "only"
+)
+
+// Sort values of ListOptions.
+const (
+	SortByID        = ""
+	SortByUsage     = "usage"
+	SortByUsageDesc = "-usage"
+)
+
+// ListOptions pages through a list. The service caps Count; zero values
+// use its defaults. Filter, an expression such as `price < 10 and tag =
+// "sale"`, only applies to ListProducts. Sort, Unused and Usage, which
+// fills in Tag.Usage, only apply to ListTags.
+type ListOptions struct {
+	Start   int
+	Count   int
+	Deleted string
+	Filter  string
+	Sort    string
+	Unused  bool
+	Usage   bool
+}
+
+func (o *ListOptions) query() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+	if o.Start > 0 {
+		q.Set("start", strconv.Itoa(o.Start))
+	}
+	if o.Count > 0 {
+		q.Set("count", strconv.Itoa(o.Count))
+	}
+	if o.Deleted != "" {
+		q.Set("deleted", o.Deleted)
+	}
+	if o.Filter != "" {
+		q.Set("filter", o.Filter)
+	}
+	if o.Sort != "" {
+		q.Set("sort", o.Sort)
+	}
+	if o.Unused {
+		q.Set("unused", "true")
+	}
+	if o.Usage {
+		q.Set("include", "usage")
+	}
+
+	return q
+}
+
+func productPath(id int) string {
+	return "/product/" + strconv.Itoa(id)
+}
+
+func tagPath(id int) string {
+	return "/tag/" + strconv.Itoa(id)
+}
+
+func assignmentPath(productID, tagID int) string {
+	return productPath(productID) + tagPath(tagID)
+}
+
+type productInput struct {
+	Name  string  `json:"name"`
+	Price float64 `json:"price"`
+}
+
+func (c *Client) ListProducts(ctx context.Context, opts *ListOptions) ([]Product, error) {
+	var products []Product
+	err := c.do(ctx, http.MethodGet, "/products", opts.query(), nil, &products)
+	return products, err
+}
+
+func (c *Client) GetProduct(ctx context.Context, id int) (*Product, error) {
+	var p Product
+	if err := c.do(ctx, http.MethodGet, productPath(id), nil, nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *Client) CreateProduct(ctx context.Context, name string, price float64) (*Product, error) {
+	var p Product
+	if err := c.do(ctx, http.MethodPost, "/product", nil, productInput{name, price}, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UpdateProduct replaces the name and price of product p.ID.
+func (c *Client) UpdateProduct(ctx context.Context, p Product) (*Product, error) {
+	var updated Product
+	if err := c.do(ctx, http.MethodPut, productPath(p.ID), nil, productInput{p.Name, p.Price}, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DeleteProduct moves a product and its tag assignments to the trash.
+func (c *Client) DeleteProduct(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, productPath(id), nil, nil, nil)
+}
+
+func (c *Client) RestoreProduct(ctx context.Context, id int) (*Product, error) {
+	var p Product
+	if err := c.do(ctx, http.MethodPost, productPath(id)+"/restore", nil, nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *Client) ListTags(ctx context.Context, opts *ListOptions) ([]Tag, error) {
+	var tags []Tag
+	err := c.do(ctx, http.MethodGet, "/tags", opts.query(), nil, &tags)
+	return tags, err
+}
+
+func (c *Client) GetTag(ctx context.Context, id int) (*Tag, error) {
+	var t Tag
+	if err := c.do(ctx, http.MethodGet, tagPath(id), nil, nil, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (c *Client) CreateTag(ctx context.Context, name string) (*Tag, error) {
+	var t Tag
+	if err := c.do(ctx, http.MethodPost, "/tag", nil, Tag{Name: name}, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RenameTag replaces the name of a tag, leaving its parent as it is.
+func (c *Client) RenameTag(ctx context.Context, id int, name string) (*Tag, error) {
+	var t Tag
+	if err := c.do(ctx, http.MethodPatch, tagPath(id), nil, mergePatch{"name": name}, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// MoveTag places a tag below another one, or at the top level if parentID is
+// nil.
+func (c *Client) MoveTag(ctx context.Context, id int, parentID *int) (*Tag, error) {
+	var t Tag
+	if err := c.do(ctx, http.MethodPatch, tagPath(id), nil, mergePatch{"parentId": parentID}, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// DeleteTag moves a tag and its assignments to the trash.
+func (c *Client) DeleteTag(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, tagPath(id), nil, nil, nil)
+}
+
+func (c *Client) RestoreTag(ctx context.Context, id int) (*Tag, error) {
+	var t Tag
+	if err := c.do(ctx, http.MethodPost, tagPath(id)+"/restore", nil, nil, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// TagCleanup lists the unused tags a cleanup moved to the trash, or would
+// have moved there in a dry run.
+type TagCleanup struct {
+	DryRun    bool   `json:"dryRun"`
+	OlderThan string `json:"olderThan"`
+	Tags      []Tag  `json:"tags"`
+}
+
+// CleanupTags moves the tags that no product has to the trash. Only tags
+// created longer than olderThan ago are removed. With dryRun the tags are
+// only listed.
+func (c *Client) CleanupTags(ctx context.Context, olderThan time.Duration, dryRun bool) (*TagCleanup, error) {
+	q := url.Values{"olderThan": {olderThan.String()}}
+	if dryRun {
+		q.Set("dryRun", "true")
+	}
+
+	var cleanup TagCleanup
+	if err := c.do(ctx, http.MethodPost, "/tags/cleanup", q, nil, &cleanup); err != nil {
+		return nil, err
+	}
+	return &cleanup, nil
+}
+
+// ListTagsOfProduct lists the tags assigned to a product. Only Start and
+// Count of opts apply.
+func (c *Client) ListTagsOfProduct(ctx context.Context, productID int, opts *ListOptions) ([]Tag, error) {
+	var tags []Tag
+	err := c.do(ctx, http.MethodGet, productPath(productID)+"/tags", opts.query(), nil, &tags)
+	return tags, err
+}
+
+// ListProductsWithTag lists the products a tag is assigned to. Only Start
+// and Count of opts apply.
+func (c *Client) ListProductsWithTag(ctx context.Context, tagID int, opts *ListOptions) ([]Product, error) {
+	var products []Product
+	err := c.do(ctx, http.MethodGet, tagPath(tagID)+"/products", opts.query(), nil, &products)
+	return products, err
+}
+
+func (c *Client) GetAssignment(ctx context.Context, productID, tagID int) (*Assignment, error) {
+	var pta Assignment
+	if err := c.do(ctx, http.MethodGet, assignmentPath(productID, tagID), nil, nil, &pta); err != nil {
+		return nil, err
+	}
+	return &pta, nil
+}
+
+// AssignTag assigns a tag to a product.
+func (c *Client) AssignTag(ctx context.Context, productID, tagID int) (*Assignment, error) {
+	var pta Assignment
+	if err := c.do(ctx, http.MethodPost, assignmentPath(productID, tagID), nil, nil, &pta); err != nil {
+		return nil, err
+	}
+	return &pta, nil
+}
+
+// UnassignTag removes a tag from a product.
+func (c *Client) UnassignTag(ctx context.Context, productID, tagID int) error {
+	return c.do(ctx, http.MethodDelete, assignmentPath(productID, tagID), nil, nil, nil)
+}
+
+// SetTagsOfProduct makes tagIDs the exact set of tags of a product.
+func (c *Client) SetTagsOfProduct(ctx context.Context, productID int, tagIDs []int) (*AssignmentDiff, error) {
+	var diff AssignmentDiff
+	in := struct {
+		TagIDs []int `json:"tagIDs"`
+	}{tagIDs}
+	if in.TagIDs == nil {
+		in.TagIDs = []int{}
+	}
+	if err := c.do(ctx, http.MethodPut, productPath(productID)+"/tags", nil, in, &diff); err != nil {
+		return nil, err
+	}
+	return &diff, nil
+}
+
+// AssignTagToProducts assigns a tag to every selected product.
+func (c *Client) AssignTagToProducts(ctx context.Context, tagID int, sel ProductSelection) (*AssignmentDiff, error) {
+	var diff AssignmentDiff
+	if err := c.do(ctx, http.MethodPost, tagPath(tagID)+"/products", nil, sel, &diff); err != nil {
+		return nil, err
+	}
+	return &diff, nil
+}
+
+// UnassignTagFromProducts removes a tag from every selected product.
+func (c *Client) UnassignTagFromProducts(ctx context.Context, tagID int, sel ProductSelection) (*AssignmentDiff, error) {
+	var diff AssignmentDiff
+	if err := c.do(ctx, http.MethodDelete, tagPath(tagID)+"/products", nil, sel, &diff); err != nil {
+		return nil, err
+	}
+	return &diff, nil
+}
+
+// ImportOptions configure ImportProducts.
+type ImportOptions struct {
+	// DryRun checks the rows without importing them
+	DryRun bool
+	// Match is "id" or "name", the column that matches rows to existing
+	// products; by default id when the file has an id column
+	Match string
+	// Map renames headers to fields, e.g. "Title:name,Cost:price"
+	Map string
+}
+
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ProductImport is the outcome of an import. ErrorReport is the path of the
+// CSV report of the rejected rows.
+type ProductImport struct {
+	ID          int           `json:"id"`
+	DryRun      bool          `json:"dryRun"`
+	Match       string        `json:"match"`
+	Created     int           `json:"created"`
+	Updated     int           `json:"updated"`
+	Unchanged   int           `json:"unchanged"`
+	Rejected    int           `json:"rejected"`
+	TagsCreated int           `json:"tagsCreated"`
+	Errors      []ImportError `json:"errors"`
+	ErrorReport string        `json:"errorReport,omitempty"`
+}
+
+// ImportProducts creates and updates products from CSV with the columns id,
+// name, price and tags.
+func (c *Client) ImportProducts(ctx context.Context, csv io.Reader, opts ImportOptions) (*ProductImport, error) {
+	body, err := io.ReadAll(csv)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	if opts.DryRun {
+		q.Set("dryRun", "true")
+	}
+	if opts.Match != "" {
+		q.Set("match", opts.Match)
+	}
+	if opts.Map != "" {
+		q.Set("map", opts.Map)
+	}
+
+	resp, err := c.send(ctx, http.MethodPost, "/products/import", q, "text/csv", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var imp ProductImport
+	if err := json.NewDecoder(resp.Body).Decode(&imp); err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
+
+// ExportProducts writes all active products to w as CSV.
+func (c *Client) ExportProducts(ctx context.Context, w io.Writer) error {
+	resp, err := c.send(ctx, http.MethodGet, "/products/export", url.Values{"format": {"csv"}}, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
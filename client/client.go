@@ -0,0 +1,252 @@
+// client.go
+
+// Package client is a typed Go client for the catalog service.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the catalog service at BaseURL. It is safe for concurrent
+// use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	actor      string
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient makes the client send its requests with hc.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithActor sends actor as X-Actor, so changes are attributed to it in the
+// audit log.
+func WithActor(actor string) Option {
+	return func(c *Client) { c.actor = actor }
+}
+
+// WithRetries sets how often a failed request is retried. 0 disables
+// retries.
+func WithRetries(n int) Option {
+	return func(c *Client) { c.maxRetries = n }
+}
+
+// WithBackoff sets the delay before the first retry and the maximum delay.
+// The delay doubles with every retry.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) { c.minBackoff, c.maxBackoff = min, max }
+}
+
+// New returns a client for the service at baseURL, e.g.
+// "http://localhost:8888".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		maxRetries: 3,
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// retryable tells whether a request may be sent again after it got status
+// code. 429 and 503 mean the request was not processed, so they are retried
+// for every method; other server errors only for idempotent methods, since
+// a POST may have taken effect before the error.
+func retryable(method string, code int) bool {
+	switch {
+	case code == http.StatusTooManyRequests, code == http.StatusServiceUnavailable:
+		return true
+	case code >= 500:
+		return method != http.MethodPost
+	}
+
+	return false
+}
+
+func (c *Client) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	d := c.minBackoff << attempt
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+
+	// full jitter keeps many clients from retrying in lockstep
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// mergePatch is a request body sent as a JSON merge patch: only the fields
+// it has are changed.
+type mergePatch map[string]interface{}
+
+// do sends a request with in as JSON body, retrying as configured, and
+// decodes the response into out unless out is nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body []byte
+	contentType := ""
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+		contentType = "application/json"
+		if _, ok := in.(mergePatch); ok {
+			contentType = "application/merge-patch+json"
+		}
+	}
+
+	resp, err := c.send(ctx, method, path, query, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s: %w", method, path, err)
+	}
+
+	return nil
+}
+
+// send sends a request, retrying as configured, and returns the first
+// successful response. The caller closes its body.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, contentType string, body []byte) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if c.actor != "" {
+			req.Header.Set("X-Actor", c.actor)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			// the request may not have reached the server, but a POST is
+			// only retried when the server said it was not processed
+			if ctx.Err() != nil || method == http.MethodPost || attempt >= c.maxRetries {
+				return nil, err
+			}
+		} else if resp.StatusCode < 400 {
+			return resp, nil
+		} else {
+			apiErr := readError(resp)
+			if !retryable(method, resp.StatusCode) || attempt >= c.maxRetries {
+				return nil, apiErr
+			}
+		}
+
+		timer := time.NewTimer(c.backoff(attempt, resp))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func readError(resp *http.Response) *APIError {
+	defer resp.Body.Close()
+
+	apiErr := &APIError{StatusCode: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err := json.Unmarshal(data, &body); err == nil && body.Error != "" {
+		apiErr.Message = body.Error
+	} else {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+
+	return apiErr
+}
+
+// APIError is an error response of the service.
+type APIError struct {
+	StatusCode int
+	// Message is the error the service gave
+	Message   string
+	RequestID string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("catalog: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("catalog: %d %s", e.StatusCode, e.Message)
+}
+
+// Is lets errors.Is match an APIError against the sentinel errors below.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrValidation:
+		return e.StatusCode == http.StatusUnprocessableEntity
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+
+	return false
+}
+
+// Errors to test an APIError for with errors.Is.
+var (
+	ErrBadRequest  = errors.New("catalog: bad request")
+	ErrNotFound    = errors.New("catalog: not found")
+	ErrConflict    = errors.New("catalog: conflict")
+	ErrValidation  = errors.New("catalog: validation failed")
+	ErrRateLimited = errors.New("catalog: rate limited")
+	ErrServer      = errors.New("catalog: server error")
+)
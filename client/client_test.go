@@ -0,0 +1,156 @@
+// client_test.go
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(handler http.HandlerFunc) (*Client, func()) {
+	server := httptest.NewServer(handler)
+	c := New(server.URL, WithBackoff(time.Millisecond, 5*time.Millisecond))
+	return c, server.Close
+}
+
+func TestRetryOnServerError(t *testing.T) {
+	var calls int32
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"id": 1, "name": "retried", "price": 1}`))
+	})
+	defer done()
+
+	p, err := c.GetProduct(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "retried" || calls != 3 {
+		t.Errorf("Expected the third attempt to succeed. Got %+v after %d calls", p, calls)
+	}
+}
+
+func TestNoRetryOfPostOnServerError(t *testing.T) {
+	var calls int32
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "boom"}`))
+	})
+	defer done()
+
+	_, err := c.CreateProduct(context.Background(), "x", 1)
+	if !errors.Is(err, ErrServer) || calls != 1 {
+		t.Errorf("Expected a single attempt failing with a server error. Got %v after %d calls", err, calls)
+	}
+}
+
+func TestRetryOfPostWhenRateLimited(t *testing.T) {
+	var calls int32
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 2, "name": "x", "price": 1}`))
+	})
+	defer done()
+
+	p, err := c.CreateProduct(context.Background(), "x", 1)
+	if err != nil || p.ID != 2 || calls != 2 {
+		t.Errorf("Expected the POST to be retried once. Got %v after %d calls", err, calls)
+	}
+}
+
+func TestGiveUpAfterRetries(t *testing.T) {
+	var calls int32
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer done()
+
+	err := c.DeleteTag(context.Background(), 1)
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the last error response. Got %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("Expected 1 attempt and 3 retries. Got %d calls", calls)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "abc")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Product not found"}`))
+	})
+	defer done()
+
+	_, err := c.GetProduct(context.Background(), 9)
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrValidation) {
+		t.Fatalf("Expected a not found error. Got %v", err)
+	}
+
+	var apiErr *APIError
+	errors.As(err, &apiErr)
+	if apiErr.Message != "Product not found" || apiErr.RequestID != "abc" {
+		t.Errorf("Expected the message and request ID of the response. Got %+v", apiErr)
+	}
+}
+
+func TestContextCancelsBackoff(t *testing.T) {
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer done()
+	c.minBackoff, c.maxBackoff = time.Hour, time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.ListTags(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to end the retries. Got %v", err)
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.RawQuery; q != "count=5&deleted=only&start=10" {
+			t.Errorf("Unexpected query %s", q)
+		}
+		w.Write([]byte(`[]`))
+	})
+	defer done()
+
+	c.ListProducts(context.Background(), &ListOptions{Start: 10, Count: 5, Deleted: OnlyDeleted})
+}
+
+func TestEmptyProductSelection(t *testing.T) {
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+		if got := body.String(); got != `{"productIDs":[]}` {
+			t.Errorf("Expected the empty list to be sent. Got %s", got)
+		}
+		w.Write([]byte(`{"added":[],"removed":[],"unchanged":[]}`))
+	})
+	defer done()
+
+	if _, err := c.AssignTagToProducts(context.Background(), 1, ProductSelection{ProductIDs: []int{}}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,82 @@
+// client_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Rockensc20/cicd-microservices/client"
+)
+
+func newCatalogClient(t *testing.T) *client.Client {
+	server := httptest.NewServer(a.Router)
+	t.Cleanup(server.Close)
+
+	return client.New(server.URL, client.WithActor("client-test"))
+}
+
+func TestClientProductsAndTags(t *testing.T) {
+	clearTable()
+	c := newCatalogClient(t)
+	ctx := context.Background()
+
+	p, err := c.CreateProduct(ctx, "Client product", 12.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg, err := c.CreateTag(ctx, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.AssignTag(ctx, p.ID, tg.ID); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := c.ListTagsOfProduct(ctx, p.ID, nil)
+	if err != nil || len(tags) != 1 || tags[0].Name != "client" {
+		t.Errorf("Expected the assigned tag. Got %v, %v", tags, err)
+	}
+
+	p.Price = 15
+	if p, err = c.UpdateProduct(ctx, *p); err != nil || p.Price != 15 {
+		t.Errorf("Expected the price to be updated. Got %v, %v", p, err)
+	}
+
+	diff, err := c.SetTagsOfProduct(ctx, p.ID, nil)
+	if err != nil || len(diff.Removed) != 1 {
+		t.Errorf("Expected the tag to be removed. Got %v, %v", diff, err)
+	}
+
+	if err := c.DeleteProduct(ctx, p.ID); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := c.ListProducts(ctx, &client.ListOptions{Deleted: client.OnlyDeleted})
+	if err != nil || len(deleted) != 1 || deleted[0].DeletedAt == nil {
+		t.Errorf("Expected the product in the trash. Got %v, %v", deleted, err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	clearTable()
+	c := newCatalogClient(t)
+	ctx := context.Background()
+
+	_, err := c.GetProduct(ctx, 99)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Expected a not found error. Got %v", err)
+	}
+
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.Message != "Product not found" || apiErr.RequestID == "" {
+		t.Errorf("Expected the server's message and request ID. Got %+v", apiErr)
+	}
+
+	addTags(1)
+	_, err = c.AssignTagToProducts(ctx, 1, client.ProductSelection{Filter: "price <"})
+	if !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("Expected an invalid filter to be rejected. Got %v", err)
+	}
+}
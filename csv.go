@@ -0,0 +1,459 @@
+// csv.go
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// exportFlushRows is how many rows are written between two flushes of
+	// the export stream.
+	exportFlushRows = 500
+	// importErrorsShown caps the rejected rows listed in the import response;
+	// the error report always has all of them.
+	importErrorsShown = 100
+	// tagSeparator joins the tag names of a product in a single CSV cell, so
+	// tag names must not contain it.
+	tagSeparator = ";"
+)
+
+// errImportDryRun rolls back the transaction of a dry-run import once all
+// rows have been checked.
+var errImportDryRun = errors.New("dry run")
+
+var importFields = []string{"id", "name", "price", "tags"}
+
+// exportProducts streams all active products as CSV, one row at a time, so
+// the catalog never has to fit into memory.
+func (a *App) exportProducts(w http.ResponseWriter, r *http.Request) {
+	// the negotiation middleware lets the other formats of the API through
+	if format := r.FormValue("format"); format != "" && format != "csv" {
+		respondWithError(w, http.StatusBadRequest, "Unsupported export format "+format)
+		return
+	}
+
+	rows, err := a.DB.QueryContext(r.Context(), `SELECT p.id, p.name, p.price,
+		COALESCE((SELECT string_agg(tag.name, '`+tagSeparator+`' ORDER BY pta.position_in_product NULLS LAST, pta.id)
+			FROM productToTagAssignment pta JOIN tag ON tag.id = pta.tagID
+			WHERE pta.productID = p.id AND pta.deleted_at IS NULL AND tag.deleted_at IS NULL), '')
+		FROM products p WHERE p.deleted_at IS NULL ORDER BY p.id`)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="products.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	writer := csv.NewWriter(w)
+	writer.Write(importFields)
+
+	for n := 1; rows.Next(); n++ {
+		var p product
+		var tags string
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &tags); err != nil {
+			log.Printf("exporting products: %v", err)
+			return
+		}
+
+		writer.Write([]string{strconv.Itoa(p.ID), p.Name, strconv.FormatFloat(p.Price, 'f', 2, 64), tags})
+
+		if n%exportFlushRows == 0 {
+			writer.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		// the status line is already sent, all we can do is cut the stream short
+		log.Printf("exporting products: %v", err)
+		return
+	}
+
+	writer.Flush()
+}
+
+// importColumns maps the fields of a product to the index of the CSV column
+// holding them.
+type importColumns map[string]int
+
+// mapImportColumns finds the columns of the fields in header. mapping
+// renames columns, as in "Title:name,Cost:price"; other columns are matched
+// by name, ignoring case, and columns matching no field are ignored.
+func mapImportColumns(header []string, mapping string) (importColumns, error) {
+	renamed := map[string]string{}
+	if mapping != "" {
+		for _, pair := range strings.Split(mapping, ",") {
+			parts := strings.SplitN(pair, ":", 2)
+			if len(parts) != 2 || !containsString(importFields, strings.ToLower(strings.TrimSpace(parts[1]))) {
+				return nil, fmt.Errorf("Invalid column mapping %q, expected <column>:<%s>", pair, strings.Join(importFields, "|"))
+			}
+			renamed[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.ToLower(strings.TrimSpace(parts[1]))
+		}
+	}
+
+	cols := importColumns{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		field, ok := renamed[name]
+		if !ok {
+			field = name
+		}
+		if !containsString(importFields, field) {
+			continue
+		}
+		if _, dup := cols[field]; dup {
+			return nil, fmt.Errorf("More than one column maps to %s", field)
+		}
+		cols[field] = i
+	}
+
+	if _, ok := cols["id"]; !ok {
+		if _, ok := cols["name"]; !ok {
+			return nil, errors.New("The CSV needs an id or a name column")
+		}
+	}
+
+	return cols, nil
+}
+
+// importRow is a parsed CSV row. Nil fields were not in the CSV, so an
+// update keeps their current value.
+type importRow struct {
+	id    int
+	name  *string
+	price *float64
+	tags  []string
+}
+
+func (cols importColumns) parse(record []string) (importRow, error) {
+	row := importRow{}
+
+	cell := func(field string) (string, bool) {
+		i, ok := cols[field]
+		if !ok || i >= len(record) {
+			return "", false
+		}
+		return strings.TrimSpace(record[i]), true
+	}
+
+	if id, ok := cell("id"); ok && id != "" {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 1 {
+			return row, validationError("Invalid product ID " + id)
+		}
+		row.id = n
+	}
+	if name, ok := cell("name"); ok {
+		row.name = &name
+	}
+	if price, ok := cell("price"); ok && price != "" {
+		f, err := strconv.ParseFloat(price, 64)
+		if err != nil {
+			return row, validationError("Invalid price " + price)
+		}
+		row.price = &f
+	}
+	if tags, ok := cell("tags"); ok {
+		row.tags = []string{}
+		for _, name := range strings.Split(tags, tagSeparator) {
+			if name = strings.TrimSpace(name); name != "" {
+				row.tags = append(row.tags, name)
+			}
+		}
+	}
+
+	return row, nil
+}
+
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// productImport is the outcome of an import, as stored in product_import
+// and returned to the client.
+type productImport struct {
+	ID          int           `json:"id"`
+	DryRun      bool          `json:"dryRun"`
+	Match       string        `json:"match"`
+	Created     int           `json:"created"`
+	Updated     int           `json:"updated"`
+	Unchanged   int           `json:"unchanged"`
+	Rejected    int           `json:"rejected"`
+	TagsCreated int           `json:"tagsCreated"`
+	Errors      []importError `json:"errors"`
+	ErrorReport string        `json:"errorReport,omitempty"`
+
+	tagIDs map[string]int
+	report *csv.Writer
+	buffer bytes.Buffer
+}
+
+func (imp *productImport) reject(line int, record []string, err error) {
+	imp.Rejected++
+	if len(imp.Errors) < importErrorsShown {
+		imp.Errors = append(imp.Errors, importError{Line: line, Error: err.Error()})
+	}
+	imp.report.Write(append([]string{strconv.Itoa(line), err.Error()}, record...))
+}
+
+// resolveTags returns the IDs of the named tags, creating the ones that do
+// not exist yet.
+func (imp *productImport) resolveTags(tx *sql.Tx, cs *changeSet, names []string) ([]int, error) {
+	ids := []int{}
+	for _, name := range names {
+		key := strings.ToLower(name)
+		if id, ok := imp.tagIDs[key]; ok {
+			ids = append(ids, id)
+			continue
+		}
+
+		t := tag{Name: name}
+		err := t.getTagByName(tx)
+		switch err {
+		case nil:
+		case sql.ErrNoRows:
+			if err := createTagTx(tx, cs, &t); err != nil {
+				return nil, err
+			}
+			imp.TagsCreated++
+		default:
+			return nil, err
+		}
+
+		imp.tagIDs[key] = t.ID
+		ids = append(ids, t.ID)
+	}
+
+	return uniqueIDs(ids), nil
+}
+
+// apply creates or updates the product of a row. Validation errors reject
+// the row, any other error aborts the import.
+func (imp *productImport) apply(tx *sql.Tx, cs *changeSet, row importRow) error {
+	var current *product
+
+	switch {
+	case imp.Match == "id" && row.id != 0:
+		p := product{ID: row.id}
+		if err := p.getProductForUpdate(tx); err == sql.ErrNoRows {
+			return validationError(fmt.Sprintf("Product %d not found", row.id))
+		} else if err != nil {
+			return err
+		}
+		current = &p
+	case imp.Match == "name" && row.name != nil:
+		matches, err := getProductsByNameForUpdate(tx, *row.name)
+		if err != nil {
+			return err
+		}
+		if len(matches) > 1 {
+			return validationError("More than one product is named " + *row.name)
+		}
+		if len(matches) == 1 {
+			current = &matches[0]
+		}
+	}
+
+	next := product{}
+	if current != nil {
+		next = *current
+	}
+	if row.name != nil {
+		next.Name = *row.name
+	}
+	if row.price != nil {
+		next.Price = *row.price
+	}
+	if err := next.validate(); err != nil {
+		return err
+	}
+
+	var tagIDs []int
+	if row.tags != nil {
+		var err error
+		if tagIDs, err = imp.resolveTags(tx, cs, row.tags); err != nil {
+			return err
+		}
+	}
+
+	changed := false
+	switch {
+	case current == nil:
+		if err := next.createProduct(tx); err != nil {
+			return err
+		}
+		cs.record("product", next.ID, "created", nil, next)
+	case next.Name != current.Name || next.Price != current.Price:
+		if err := next.updateProduct(tx); err != nil {
+			return err
+		}
+		cs.record("product", next.ID, "updated", *current, next)
+		changed = true
+	}
+
+	if tagIDs != nil {
+		diff, err := setTagsOfProduct(tx, cs, next.ID, tagIDs)
+		if err != nil {
+			return err
+		}
+		changed = changed || len(diff.Added) > 0 || len(diff.Removed) > 0
+	}
+
+	switch {
+	case current == nil:
+		imp.Created++
+	case changed:
+		imp.Updated++
+	default:
+		imp.Unchanged++
+	}
+
+	return nil
+}
+
+// importProducts creates and updates products from a CSV upload. Rows are
+// matched to existing products by ID (match=id, the default when there is
+// an id column) or by name (match=name); unmatched rows create products.
+// A tags column replaces the tags of the product, creating tags as needed.
+// Invalid rows are rejected while the others are imported, and the rejected
+// rows can be downloaded from errorReport. With dryRun=true nothing is
+// stored except the report.
+func (a *App) importProducts(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.FormValue("dryRun"))
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	defer r.Body.Close()
+
+	header, err := reader.Read()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid CSV header")
+		return
+	}
+
+	cols, err := mapImportColumns(header, r.FormValue("map"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	imp := &productImport{DryRun: dryRun, Match: r.FormValue("match"), Errors: []importError{}, tagIDs: map[string]int{}}
+	switch imp.Match {
+	case "":
+		imp.Match = "name"
+		if _, ok := cols["id"]; ok {
+			imp.Match = "id"
+		}
+	case "id", "name":
+		if _, ok := cols[imp.Match]; !ok {
+			respondWithError(w, http.StatusBadRequest, "Matching by "+imp.Match+" needs a "+imp.Match+" column")
+			return
+		}
+	default:
+		respondWithError(w, http.StatusBadRequest, "match must be one of id or name")
+		return
+	}
+
+	imp.report = csv.NewWriter(&imp.buffer)
+	imp.report.Write(append([]string{"line", "error"}, header...))
+
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				imp.reject(parseErr.Line, record, validationError("Invalid CSV: "+parseErr.Err.Error()))
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			line, _ := reader.FieldPos(0)
+			row, err := cols.parse(record)
+			if err == nil {
+				err = imp.apply(tx, cs, row)
+			}
+
+			var invalid validationError
+			if errors.As(err, &invalid) {
+				imp.reject(line, record, err)
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if dryRun {
+			return errImportDryRun
+		}
+		return nil
+	})
+	if err != nil && err != errImportDryRun {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	imp.report.Flush()
+	err = a.DB.QueryRow(`INSERT INTO product_import(actor, dry_run, created, updated, unchanged, rejected, tags_created, error_report)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		contextString(r.Context(), actorKey), imp.DryRun, imp.Created, imp.Updated, imp.Unchanged, imp.Rejected, imp.TagsCreated,
+		imp.buffer.String()).Scan(&imp.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if imp.Rejected > 0 {
+		imp.ErrorReport = fmt.Sprintf("/products/import/%d/errors", imp.ID)
+	}
+
+	respondWithJSON(w, http.StatusOK, imp)
+}
+
+// getImportErrors downloads the rejected rows of an import as CSV: the line
+// number and the reason, followed by the row as it was uploaded.
+func (a *App) getImportErrors(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid import ID")
+		return
+	}
+
+	var report string
+	if err := a.DB.QueryRow("SELECT error_report FROM product_import WHERE id=$1", id).Scan(&report); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Import not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="import-%d-errors.csv"`, id))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(report))
+}
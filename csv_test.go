@@ -0,0 +1,121 @@
+// csv_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func executeImport(t *testing.T, query, body string) productImport {
+	req, _ := http.NewRequest("POST", "/products/import"+query, strings.NewReader(body))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var imp productImport
+	json.Unmarshal(response.Body.Bytes(), &imp)
+	return imp
+}
+
+func TestExportProductsCSV(t *testing.T) {
+	clearTable()
+	addProducts(2)
+	addTags(2)
+	addTagAssignment(1, 2)
+	addTagAssignment(1, 1)
+
+	req, _ := http.NewRequest("GET", "/products/export?format=csv", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	// the tags come in the order of the product
+	expected := "id,name,price,tags\n1,Product 0,10.00,Tag 1;Tag 0\n2,Product 1,20.00,\n"
+	if body := response.Body.String(); body != expected {
+		t.Errorf("Expected %q. Got %q", expected, body)
+	}
+
+	req, _ = http.NewRequest("GET", "/products/export?format=pdf", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotAcceptable, response.Code)
+
+	// formats the rest of the API speaks are not exports
+	req, _ = http.NewRequest("GET", "/products/export?format=xml", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestImportProductsCSV(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addTags(1)
+
+	imp := executeImport(t, "?map=Title:name,Cost:price", strings.Join([]string{
+		"ID,Title,Cost,Tags,Notes",
+		"1,Renamed,12.50,Tag 0;new tag,ignored",
+		",Created,3,new tag,",
+		",,4,,",
+		"9,Missing,1,,",
+		",Cheap,abc,,",
+	}, "\n"))
+
+	if imp.Match != "id" || imp.Created != 1 || imp.Updated != 1 || imp.Rejected != 3 || imp.TagsCreated != 1 {
+		t.Fatalf("Expected 1 created, 1 updated and 3 rejected rows. Got %+v", imp)
+	}
+	if imp.Errors[0].Line != 4 || imp.Errors[1].Line != 5 || imp.Errors[2].Line != 6 {
+		t.Errorf("Expected lines 4, 5 and 6 to be rejected. Got %+v", imp.Errors)
+	}
+
+	req, _ := http.NewRequest("GET", "/tag/2/products", nil)
+	response := executeRequest(req)
+	var products []product
+	json.Unmarshal(response.Body.Bytes(), &products)
+	if len(products) != 2 {
+		t.Errorf("Expected both products to get the created tag. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", imp.ErrorReport, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	if len(lines) != 4 || lines[0] != "line,error,ID,Title,Cost,Tags,Notes" || !strings.HasPrefix(lines[2], "5,Product 9 not found,9,Missing") {
+		t.Errorf("Expected the rejected rows in the report. Got %v", lines)
+	}
+}
+
+func TestImportProductsByNameDryRun(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	imp := executeImport(t, "?dryRun=true", "name,price\nproduct 0,99\nAnother,1\n")
+	if imp.Match != "name" || imp.Updated != 1 || imp.Created != 1 || !imp.DryRun {
+		t.Fatalf("Expected a dry run matching by name. Got %+v", imp)
+	}
+
+	p := product{ID: 1}
+	p.getProduct(a.DB)
+	var count int
+	a.DB.QueryRow("SELECT COUNT(*) FROM products").Scan(&count)
+	if p.Price != 10 || count != 1 {
+		t.Errorf("Expected the dry run to leave the catalog unchanged")
+	}
+
+	imp = executeImport(t, "", "name,price\nProduct 0,10\n")
+	if imp.Unchanged != 1 {
+		t.Errorf("Expected an identical row to leave the product unchanged. Got %+v", imp)
+	}
+}
+
+func TestTagNamesCannotHoldTheSeparator(t *testing.T) {
+	tg := tag{Name: "a" + tagSeparator + "b"}
+	if err := tg.validate(); err == nil {
+		t.Errorf("Expected a tag name with %q to be rejected, it would not survive an export", tagSeparator)
+	}
+
+	clearTable()
+	addTags(1)
+	req, _ := http.NewRequest("PUT", "/tag/1", strings.NewReader(`{"name":"a;b"}`))
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+}
@@ -0,0 +1,509 @@
+// encoding.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Payloads are converted to the other formats through their JSON form, so
+// the json tags of the models are the single source of field names. The
+// JSON is read into a tree that keeps the order of object members.
+
+type jsonMember struct {
+	Key   string
+	Value interface{}
+}
+
+// jsonObject is a JSON object with its members in document order. The
+// values of a tree are jsonObject, []interface{}, string, json.Number, bool
+// and nil.
+type jsonObject []jsonMember
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.Key)
+		value, err := json.Marshal(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+func toJSONTree(payload interface{}) (interface{}, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	return readJSONValue(decoder)
+}
+
+func readJSONValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		object := jsonObject{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, jsonMember{key.(string), value})
+		}
+		_, err = decoder.Token()
+		return object, err
+	case json.Delim('['):
+		array := []interface{}{}
+		for decoder.More() {
+			value, err := readJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err = decoder.Token()
+		return array, err
+	}
+
+	return token, nil
+}
+
+// encodeXML writes the payload below a <response> element. Object members
+// become elements named after their key, array elements become <item>
+// elements. Values that are not strings carry a type attribute, so
+// decodeXML can read the document back.
+func encodeXML(payload interface{}) ([]byte, error) {
+	tree, err := toJSONTree(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	if err := writeXMLElement(encoder, "response", tree); err != nil {
+		return nil, err
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeXMLElement(encoder *xml.Encoder, name string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !validXMLName(name) {
+		// keys that are no valid element names, e.g. numeric map keys
+		start = xml.StartElement{
+			Name: xml.Name{Local: "member"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}},
+		}
+	}
+
+	if kind := xmlType(value); kind != "string" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "type"}, Value: kind})
+	}
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+
+	var err error
+	switch v := value.(type) {
+	case jsonObject:
+		for _, m := range v {
+			if err = writeXMLElement(encoder, m.Key, m.Value); err != nil {
+				break
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err = writeXMLElement(encoder, "item", item); err != nil {
+				break
+			}
+		}
+	case nil:
+	default:
+		err = encoder.EncodeToken(xml.CharData(scalarText(v)))
+	}
+	if err != nil {
+		return err
+	}
+
+	return encoder.EncodeToken(start.End())
+}
+
+func xmlType(value interface{}) string {
+	switch value.(type) {
+	case jsonObject:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+
+	return "string"
+}
+
+func validXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c == '-' || c == '.' || c >= '0' && c <= '9'):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func scalarText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+type xmlNode struct {
+	name     string
+	attrs    map[string]string
+	text     strings.Builder
+	children []*xmlNode
+}
+
+// decodeXML converts an XML document to JSON. type attributes, as written
+// by encodeXML, are honoured. Without one, an element with children is an
+// object, or an array when all children are <item>s, and repeated child
+// elements become an array. Leaves that read as a number or a boolean are
+// taken as one; give them type="string" to keep them text.
+func decodeXML(body []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+
+	var root *xmlNode
+	stack := []*xmlNode{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local, attrs: map[string]string{}}
+			for _, attr := range t.Attr {
+				node.attrs[attr.Name.Local] = attr.Value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("no XML element")
+	}
+
+	value, err := root.value()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(value)
+}
+
+func (n *xmlNode) key() string {
+	if name, ok := n.attrs["name"]; ok && n.name == "member" {
+		return name
+	}
+
+	return n.name
+}
+
+func (n *xmlNode) value() (interface{}, error) {
+	text := strings.TrimSpace(n.text.String())
+
+	switch kind := n.attrs["type"]; kind {
+	case "null":
+		return nil, nil
+	case "string":
+		return n.text.String(), nil
+	case "number":
+		if !isJSONNumber(text) {
+			return nil, fmt.Errorf("<%s> is not a number", n.name)
+		}
+		return json.Number(text), nil
+	case "boolean":
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return nil, fmt.Errorf("<%s> is not a boolean", n.name)
+		}
+		return b, nil
+	case "array":
+		return n.array()
+	case "object":
+		return n.object()
+	case "":
+	default:
+		return nil, fmt.Errorf("<%s> has unknown type %q", n.name, kind)
+	}
+
+	if len(n.children) == 0 {
+		switch {
+		case isJSONNumber(text):
+			return json.Number(text), nil
+		case text == "true", text == "false":
+			return text == "true", nil
+		}
+		return n.text.String(), nil
+	}
+
+	for _, child := range n.children {
+		if child.name != "item" {
+			return n.object()
+		}
+	}
+
+	return n.array()
+}
+
+func (n *xmlNode) array() (interface{}, error) {
+	array := []interface{}{}
+	for _, child := range n.children {
+		value, err := child.value()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+
+	return array, nil
+}
+
+func (n *xmlNode) object() (interface{}, error) {
+	object := jsonObject{}
+	index := map[string]int{}
+	count := map[string]int{}
+
+	for _, child := range n.children {
+		value, err := child.value()
+		if err != nil {
+			return nil, err
+		}
+
+		key := child.key()
+		count[key]++
+		switch i := index[key]; count[key] {
+		case 1:
+			index[key] = len(object)
+			object = append(object, jsonMember{key, value})
+		case 2:
+			// a repeated element turns the member into an array
+			object[i].Value = []interface{}{object[i].Value, value}
+		default:
+			object[i].Value = append(object[i].Value.([]interface{}), value)
+		}
+	}
+
+	return object, nil
+}
+
+func isJSONNumber(text string) bool {
+	if text == "" || text[0] != '-' && (text[0] < '0' || text[0] > '9') {
+		return false
+	}
+	return json.Valid([]byte(text))
+}
+
+// encodeCSV writes the payload as the rows of tabulate.
+func encodeCSV(payload interface{}) ([]byte, error) {
+	columns, records, err := tabulate(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(columns)
+	writer.WriteAll(records)
+
+	return buf.Bytes(), writer.Error()
+}
+
+// tabulate lays out an array of objects as one row per object, with a
+// column for every member in the order they first appear. A single object
+// is a single row, and arrays of scalars get a "value" column. Nested values
+// are written as JSON.
+func tabulate(payload interface{}) ([]string, [][]string, error) {
+	tree, err := toJSONTree(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rows []interface{}
+	switch v := tree.(type) {
+	case []interface{}:
+		rows = v
+	default:
+		rows = []interface{}{v}
+	}
+
+	objects := make([]jsonObject, len(rows))
+	columns := []string{}
+	seen := map[string]bool{}
+	for i, row := range rows {
+		object, ok := row.(jsonObject)
+		if !ok {
+			object = jsonObject{{"value", row}}
+		}
+		objects[i] = object
+
+		for _, m := range object {
+			if !seen[m.Key] {
+				seen[m.Key] = true
+				columns = append(columns, m.Key)
+			}
+		}
+	}
+
+	records := make([][]string, len(objects))
+	for i, object := range objects {
+		values := map[string]string{}
+		for _, m := range object {
+			values[m.Key] = scalarText(m.Value)
+		}
+		records[i] = make([]string, len(columns))
+		for j, column := range columns {
+			records[i][j] = values[column]
+		}
+	}
+
+	return columns, records, nil
+}
+
+// encodeMsgpack writes the payload as MessagePack, keeping the member order
+// of the JSON form. Integral numbers are encoded as integers.
+func encodeMsgpack(payload interface{}) ([]byte, error) {
+	tree, err := toJSONTree(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := writeMsgpackValue(msgpack.NewEncoder(&buf), tree); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeMsgpackValue(encoder *msgpack.Encoder, value interface{}) error {
+	switch v := value.(type) {
+	case jsonObject:
+		if err := encoder.EncodeMapLen(len(v)); err != nil {
+			return err
+		}
+		for _, m := range v {
+			if err := encoder.EncodeString(m.Key); err != nil {
+				return err
+			}
+			if err := writeMsgpackValue(encoder, m.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		if err := encoder.EncodeArrayLen(len(v)); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := writeMsgpackValue(encoder, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return encoder.EncodeInt(i)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return encoder.EncodeFloat64(f)
+	}
+
+	return encoder.Encode(value)
+}
+
+// decodeMsgpack converts a MessagePack document to JSON.
+func decodeMsgpack(body []byte) ([]byte, error) {
+	var value interface{}
+	if err := msgpack.Unmarshal(body, &value); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(value)
+}
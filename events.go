@@ -0,0 +1,378 @@
+// events.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// subscriberBuffer is how many events a client may fall behind before
+	// it is disconnected and has to resume with Last-Event-ID.
+	subscriberBuffer = 256
+	heartbeatPeriod  = 15 * time.Second
+	hubPollPeriod    = time.Second
+	replayPageSize   = 500
+)
+
+// streamEvent is a catalog event together with the tags its product or tag
+// relates to, which the per-connection tag filter works on.
+type streamEvent struct {
+	catalogEvent
+	tagIDs []int
+}
+
+// eventFilter narrows down the events of one connection. Zero values match
+// every event.
+type eventFilter struct {
+	entities map[string]bool
+	tagID    int
+}
+
+func (f eventFilter) matches(e streamEvent) bool {
+	if len(f.entities) > 0 && !f.entities[e.Entity] {
+		return false
+	}
+	if f.tagID == 0 {
+		return true
+	}
+
+	for _, id := range e.tagIDs {
+		if id == f.tagID {
+			return true
+		}
+	}
+
+	return false
+}
+
+type eventSubscriber struct {
+	events chan streamEvent
+	filter eventFilter
+	// dropped is closed when the hub gave up on a slow subscriber.
+	dropped chan struct{}
+}
+
+// eventHub tails the outbox and fans new events out to the connected
+// clients. Sends never block: a client whose buffer is full is dropped, so
+// a slow connection can neither stall the hub nor the mutation handlers.
+type eventHub struct {
+	db   *sql.DB
+	wake chan struct{}
+
+	mu          sync.Mutex
+	started     bool
+	lastSeq     int64
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newEventHub(db *sql.DB) *eventHub {
+	return &eventHub{
+		db:          db,
+		wake:        make(chan struct{}, 1),
+		subscribers: map[*eventSubscriber]struct{}{},
+	}
+}
+
+// notify tells the hub that new events may be in the outbox.
+func (h *eventHub) notify() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// subscribe registers a client and returns the last sequence number the hub
+// has broadcast; every later event will be delivered to the subscriber.
+func (h *eventHub) subscribe(filter eventFilter) (*eventSubscriber, int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// the hub only starts tailing once the first client connects
+	if !h.started {
+		if err := h.db.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM outbox").Scan(&h.lastSeq); err != nil {
+			return nil, 0, err
+		}
+		h.started = true
+		go h.run()
+	}
+
+	s := &eventSubscriber{
+		events:  make(chan streamEvent, subscriberBuffer),
+		filter:  filter,
+		dropped: make(chan struct{}),
+	}
+	h.subscribers[s] = struct{}{}
+
+	return s, h.lastSeq, nil
+}
+
+func (h *eventHub) unsubscribe(s *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, s)
+}
+
+func (h *eventHub) run() {
+	ticker := time.NewTicker(hubPollPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.wake:
+		}
+
+		for {
+			n, err := h.poll()
+			if err != nil {
+				log.Printf("tailing the outbox: %v", err)
+			}
+			if err != nil || n == 0 {
+				break
+			}
+		}
+	}
+}
+
+func (h *eventHub) poll() (int, error) {
+	h.mu.Lock()
+	after := h.lastSeq
+	h.mu.Unlock()
+
+	events, err := loadStreamEvents(h.db, after, replayPageSize)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, e := range events {
+		for s := range h.subscribers {
+			if !s.filter.matches(e) {
+				continue
+			}
+
+			select {
+			case s.events <- e:
+			default:
+				delete(h.subscribers, s)
+				close(s.dropped)
+			}
+		}
+	}
+	h.lastSeq = events[len(events)-1].Seq
+
+	return len(events), nil
+}
+
+// loadStreamEvents reads events from the outbox and looks up, with a single
+// query, the tags of the products they concern.
+func loadStreamEvents(db dbtx, after int64, count int) ([]streamEvent, error) {
+	events, err := getOutboxEvents(db, after, count)
+	if err != nil {
+		return nil, err
+	}
+
+	productIDs := []int64{}
+	for _, e := range events {
+		if e.Entity == "product" || e.Entity == "tag_order" {
+			productIDs = append(productIDs, int64(e.EntityID))
+		}
+	}
+
+	productTags := map[int][]int{}
+	if len(productIDs) > 0 {
+		rows, err := db.Query(`SELECT productID, tagID FROM productToTagAssignment
+			WHERE productID = ANY($1) AND deleted_at IS NULL`, pq.Array(productIDs))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var productID, tagID int
+			if err := rows.Scan(&productID, &tagID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			productTags[productID] = append(productTags[productID], tagID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	streamEvents := make([]streamEvent, len(events))
+	for i, e := range events {
+		streamEvents[i] = streamEvent{catalogEvent: e}
+
+		switch e.Entity {
+		case "product", "tag_order":
+			streamEvents[i].tagIDs = productTags[e.EntityID]
+		case "tag", "product_order":
+			streamEvents[i].tagIDs = []int{e.EntityID}
+		case "assignment":
+			streamEvents[i].tagIDs = []int{stateTagID(e, "tagID")}
+		case "alias":
+			streamEvents[i].tagIDs = []int{stateTagID(e, "tagId")}
+		}
+	}
+
+	return streamEvents, nil
+}
+
+// stateTagID returns the tag ID that assignments and aliases hold in field.
+func stateTagID(e catalogEvent, field string) int {
+	for _, state := range []interface{}{e.After, e.Before} {
+		if m, ok := state.(map[string]interface{}); ok {
+			if id, ok := m[field].(float64); ok {
+				return int(id)
+			}
+		}
+	}
+
+	return 0
+}
+
+func parseEventFilter(r *http.Request) (eventFilter, error) {
+	f := eventFilter{entities: map[string]bool{}}
+
+	if entities := r.FormValue("entity"); entities != "" {
+		for _, entity := range strings.Split(entities, ",") {
+			switch entity {
+			case "product", "tag", "assignment", "alias", "tag_order", "product_order":
+				f.entities[entity] = true
+			default:
+				return f, fmt.Errorf("Unknown entity %q", entity)
+			}
+		}
+	}
+
+	if tagID := r.FormValue("tag"); tagID != "" {
+		id, err := strconv.Atoi(tagID)
+		if err != nil || id < 1 {
+			return f, fmt.Errorf("Invalid tag ID")
+		}
+		f.tagID = id
+	}
+
+	return f, nil
+}
+
+// writeStreamEvent writes e in the text/event-stream format, using its
+// sequence number as the event ID clients resume from.
+func writeStreamEvent(w http.ResponseWriter, e streamEvent) error {
+	data, err := json.Marshal(e.catalogEvent)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+	return err
+}
+
+// streamEvents serves the change feed as Server-Sent Events. A client that
+// reconnects with Last-Event-ID first gets the events it missed from the
+// outbox and then continues with live events.
+func (a *App) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.FormValue("lastEventId")
+	}
+	var resumeFrom int64 = -1
+	if lastEventID != "" {
+		if resumeFrom, err = strconv.ParseInt(lastEventID, 10, 64); err != nil || resumeFrom < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid Last-Event-ID")
+			return
+		}
+	}
+
+	sub, hubSeq, err := a.events.subscribe(filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer a.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+
+	// replay what the client missed up to the point where live events start
+	sent := hubSeq
+	if resumeFrom >= 0 {
+		sent = resumeFrom
+	replay:
+		for sent < hubSeq {
+			missed, err := loadStreamEvents(a.DB, sent, replayPageSize)
+			if err != nil || len(missed) == 0 {
+				break
+			}
+			for _, e := range missed {
+				if e.Seq > hubSeq {
+					break replay
+				}
+				if filter.matches(e) {
+					if writeStreamEvent(w, e) != nil {
+						return
+					}
+				}
+				sent = e.Seq
+			}
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatPeriod)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.dropped:
+			fmt.Fprint(w, ": too slow, reconnect with Last-Event-ID to resume\n\n")
+			flusher.Flush()
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e := <-sub.events:
+			if e.Seq <= sent {
+				continue
+			}
+			if writeStreamEvent(w, e) != nil {
+				return
+			}
+			sent = e.Seq
+			flusher.Flush()
+		}
+	}
+}
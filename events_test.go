@@ -0,0 +1,138 @@
+// events_test.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStreamEvents reads the "event:" lines of an event stream until n events
+// arrived or the request context ends.
+func readStreamEvents(res *http.Response, n int) []string {
+	events := []string{}
+
+	scanner := bufio.NewScanner(res.Body)
+	for len(events) < n && scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "event: ") {
+			events = append(events, strings.TrimPrefix(line, "event: "))
+		}
+	}
+
+	return events
+}
+
+func openEventStream(t *testing.T, ctx context.Context, url, lastEventID string) *http.Response {
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream. Got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	return res
+}
+
+func TestEventStreamReplayAndLive(t *testing.T) {
+	clearTable()
+	// the hub remembers outbox positions, which clearTable resets
+	a.events = newEventHub(a.DB)
+
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer([]byte(`{"name":"streamed", "price": 1}`)))
+	executeRequest(req)
+	req, _ = http.NewRequest("POST", "/tag", bytes.NewBuffer([]byte(`{"name":"streamed"}`)))
+	executeRequest(req)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res := openEventStream(t, ctx, server.URL+"/events", "1")
+	defer res.Body.Close()
+
+	req, _ = http.NewRequest("POST", "/product/1/tag/1", nil)
+	executeRequest(req)
+
+	events := readStreamEvents(res, 2)
+	if len(events) != 2 || events[0] != "tag.created" || events[1] != "product.tagged" {
+		t.Errorf("Expected the missed tag.created followed by the live product.tagged. Got %v", events)
+	}
+}
+
+func TestEventStreamFilter(t *testing.T) {
+	clearTable()
+	a.events = newEventHub(a.DB)
+
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	for _, name := range []string{"other", "wanted"} {
+		req, _ := http.NewRequest("POST", "/tag", bytes.NewBuffer([]byte(`{"name":"`+name+`"}`)))
+		executeRequest(req)
+	}
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer([]byte(`{"name":"filtered", "price": 1}`)))
+	executeRequest(req)
+	req, _ = http.NewRequest("POST", "/product/1/tag/2", nil)
+	executeRequest(req)
+	addTagAlias("1", "another")
+	addTagAlias("2", "wished")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res := openEventStream(t, ctx, server.URL+"/events?entity=tag,assignment,alias&tag=2", "0")
+	defer res.Body.Close()
+
+	events := readStreamEvents(res, 3)
+	if len(events) != 3 || events[0] != "tag.created" || events[1] != "product.tagged" || events[2] != "alias.created" {
+		t.Errorf("Expected only the events of tag 2. Got %v", events)
+	}
+
+	req, _ = http.NewRequest("GET", "/events?entity=order", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestEventHubDropsSlowSubscribers(t *testing.T) {
+	clearTable()
+	hub := newEventHub(a.DB)
+
+	sub, _, err := hub.subscribe(eventFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.DB.Exec(`INSERT INTO outbox(seq, event_type, entity, entity_id, payload)
+		SELECT g, 'tag.created', 'tag', g, jsonb_build_object('seq', g, 'type', 'tag.created', 'entity', 'tag', 'entityID', g)
+		FROM generate_series(1, $1) AS g`, subscriberBuffer+1)
+
+	for {
+		n, err := hub.poll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	select {
+	case <-sub.dropped:
+	default:
+		t.Errorf("Expected a subscriber that fell %d events behind to be dropped", subscriberBuffer+1)
+	}
+}
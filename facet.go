@@ -0,0 +1,183 @@
+// facet.go
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// facetKeyPattern is what keys of key/value tags look like, so that they can
+// be used in query parameters such as ?tag.color=red and in filters.
+var facetKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// facetParamPrefix starts the query parameters selecting products by facet.
+const facetParamPrefix = "tag."
+
+// facet is a tag key with the values the products have for it.
+type facet struct {
+	Key    string       `json:"key"`
+	Values []facetValue `json:"values"`
+}
+
+// facetValue counts the products that have the tag standing for a value.
+type facetValue struct {
+	Value string `json:"value"`
+	TagID int    `json:"tagId"`
+	Count int    `json:"count"`
+}
+
+// checkFacet makes sure the key and value of t are either both empty or both
+// set, and that no other active tag stands for the same key and value.
+func (t *tag) checkFacet(db dbtx) error {
+	if t.Key == "" && t.Value == "" {
+		return nil
+	}
+
+	if !facetKeyPattern.MatchString(t.Key) {
+		return validationError("Tag key must be a lower-case letter followed by lower-case letters, digits or _")
+	}
+	if strings.TrimSpace(t.Value) == "" {
+		return validationError("Tag value must not be empty when the tag has a key")
+	}
+
+	var id int
+	err := db.QueryRow("SELECT id FROM tag WHERE key=$1 AND LOWER(value)=LOWER($2) AND id<>$3 AND deleted_at IS NULL",
+		t.Key, t.Value, t.ID).Scan(&id)
+	switch err {
+	case nil:
+		return validationError("Tag " + strconv.Itoa(id) + " already stands for " + t.Key + "=" + t.Value)
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return err
+	}
+}
+
+// parseFacetSelection turns the ?tag.<key>=<value> parameters into a filter:
+// a product must have one of the values given for each key.
+func parseFacetSelection(r *http.Request) (filterExpr, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for param := range r.Form {
+		if strings.HasPrefix(param, facetParamPrefix) {
+			keys = append(keys, param)
+		}
+	}
+	sort.Strings(keys)
+
+	var selection filterExpr
+	for _, param := range keys {
+		key := strings.TrimPrefix(param, facetParamPrefix)
+		if !facetKeyPattern.MatchString(key) {
+			return nil, errors.New("Invalid tag key " + strconv.Quote(key))
+		}
+
+		var anyValue filterExpr
+		for _, value := range r.Form[param] {
+			anyValue = joinFilters(anyValue, filterComparison{field: param, op: "=", value: value}, filterOrOf)
+		}
+		selection = joinFilters(selection, anyValue, filterAndOf)
+	}
+
+	return selection, nil
+}
+
+// parseProductFilterParams reads ?filter= and the facet parameters of the
+// request into one filter, which is nil if there are none. The error is fit
+// for the response.
+func parseProductFilterParams(r *http.Request) (filterExpr, error) {
+	var filter filterExpr
+	if input := r.FormValue("filter"); input != "" {
+		var err error
+		if filter, err = parseProductFilter(input); err != nil {
+			return nil, errors.New("Invalid filter: " + err.Error())
+		}
+	}
+
+	selection, err := parseFacetSelection(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return joinFilters(filter, selection, filterAndOf), nil
+}
+
+func filterAndOf(left, right filterExpr) filterExpr { return filterAnd{left, right} }
+func filterOrOf(left, right filterExpr) filterExpr  { return filterOr{left, right} }
+
+// joinFilters combines two filters either of which may be nil.
+func joinFilters(left, right filterExpr, join func(left, right filterExpr) filterExpr) filterExpr {
+	switch {
+	case left == nil:
+		return right
+	case right == nil:
+		return left
+	default:
+		return join(left, right)
+	}
+}
+
+// getProductFacets counts, for each value of each tag key, the active
+// products matching filter that have it. filter may be nil.
+func getProductFacets(db dbtx, filter filterExpr) ([]facet, error) {
+	args := []interface{}{}
+	condition := ""
+	if filter != nil {
+		condition = " AND " + filter.sql(&args)
+	}
+
+	rows, err := db.Query(`SELECT tag.key, tag.value, tag.id, COUNT(DISTINCT products.id) AS product_count
+		FROM products
+		JOIN productToTagAssignment pta ON pta.productID = products.id AND pta.deleted_at IS NULL
+		JOIN tag ON tag.id = pta.tagID AND tag.deleted_at IS NULL AND tag.key <> ''
+		WHERE products.deleted_at IS NULL`+condition+`
+		GROUP BY tag.id
+		ORDER BY tag.key, product_count DESC, tag.value`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	facets := []facet{}
+
+	for rows.Next() {
+		var key string
+		var v facetValue
+		if err := rows.Scan(&key, &v.Value, &v.TagID, &v.Count); err != nil {
+			return nil, err
+		}
+		if len(facets) == 0 || facets[len(facets)-1].Key != key {
+			facets = append(facets, facet{Key: key, Values: []facetValue{}})
+		}
+		last := &facets[len(facets)-1]
+		last.Values = append(last.Values, v)
+	}
+
+	return facets, rows.Err()
+}
+
+func (a *App) getProductFacets(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProductFilterParams(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	facets, err := getProductFacets(a.DB, filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, facets)
+}
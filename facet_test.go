@@ -0,0 +1,95 @@
+// facet_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func addFacetTag(name, key, value string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/tag", bytes.NewBufferString(`{"name":"`+name+`","key":"`+key+`","value":"`+value+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	return executeRequest(req)
+}
+
+func TestFacets(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addFacetTag("Red", "color", "red")
+	addFacetTag("Blue", "color", "blue")
+	addFacetTag("XL", "size", "XL")
+	addTagAssignment(1, 1)
+	addTagAssignment(2, 1)
+	addTagAssignment(3, 2)
+	addTagAssignment(1, 3)
+	addTagAssignment(3, 3)
+
+	req, _ := http.NewRequest("GET", "/products?tag.color=red&tag.size=XL", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var products []product
+	json.Unmarshal(response.Body.Bytes(), &products)
+	if len(products) != 1 || products[0].ID != 1 {
+		t.Errorf("Expected only product 1 to be red and XL. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/products?tag.color=red&tag.color=blue", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &products)
+	if len(products) != 3 {
+		t.Errorf("Expected the values of one key to match any product. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/products/facets?tag.size=XL", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var facets []facet
+	json.Unmarshal(response.Body.Bytes(), &facets)
+	if len(facets) != 2 || facets[0].Key != "color" || len(facets[0].Values) != 2 || facets[1].Values[0].Count != 2 {
+		t.Errorf("Expected one red and one blue XL product. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/products?tag.Color=red", nil)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+}
+
+func TestFacetTagValidation(t *testing.T) {
+	clearTable()
+
+	checkResponseCode(t, http.StatusCreated, addFacetTag("Red", "color", "red").Code)
+	checkResponseCode(t, http.StatusUnprocessableEntity, addFacetTag("Crimson", "color", "RED").Code)
+	checkResponseCode(t, http.StatusUnprocessableEntity, addFacetTag("Green", "Color", "green").Code)
+	checkResponseCode(t, http.StatusUnprocessableEntity, addFacetTag("Green", "color", "").Code)
+}
+
+func TestParseFacetSelection(t *testing.T) {
+	req := httptest.NewRequest("GET", "/products?tag.size=XL&tag.color=red&tag.color=blue&count=5", nil)
+
+	selection, err := parseFacetSelection(req)
+	if err != nil {
+		t.Fatalf("Expected the selection to parse. Got %v", err)
+	}
+
+	args := []interface{}{}
+	selection.sql(&args)
+	expected := []interface{}{"red", "color", "blue", "color", "XL", "size"}
+	if len(args) != len(expected) {
+		t.Fatalf("Expected args %v. Got %v", expected, args)
+	}
+	for i := range expected {
+		if args[i] != expected[i] {
+			t.Errorf("Expected %v at %d. Got %v", expected[i], i, args[i])
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/products?tag.bad-key=x", nil)
+	if _, err := parseFacetSelection(req); err == nil {
+		t.Errorf("Expected an invalid key to be rejected")
+	}
+}
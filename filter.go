@@ -0,0 +1,336 @@
+// filter.go
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Product filter expressions select products by their fields and tags, e.g.
+//
+//	price < 50 and (tag = "running" or name ~ "shoe") and not tag = "sale"
+//
+// Fields are id, name, price, tag and tag.<key>. Comparisons are =, !=, <,
+// <=, >, >= and ~ (name contains, ignoring case); tag only supports = and !=,
+// which test whether the product has a tag of that name or alias, and so
+// does tag.<key>, e.g. tag.color = "red", for the value of a key/value tag.
+// Strings are quoted with " or '. Keywords are case-insensitive.
+
+// filterExpr is a parsed filter expression. sql renders it as a condition on
+// the products table, appending the values it needs to args.
+type filterExpr interface {
+	sql(args *[]interface{}) string
+}
+
+type filterAnd struct{ left, right filterExpr }
+type filterOr struct{ left, right filterExpr }
+type filterNot struct{ expr filterExpr }
+
+type filterComparison struct {
+	field string
+	op    string
+	value interface{}
+	// handAssigned makes tag conditions ignore smart tags, see rules.go
+	handAssigned bool
+}
+
+func (e filterAnd) sql(args *[]interface{}) string {
+	return "(" + e.left.sql(args) + " AND " + e.right.sql(args) + ")"
+}
+
+func (e filterOr) sql(args *[]interface{}) string {
+	return "(" + e.left.sql(args) + " OR " + e.right.sql(args) + ")"
+}
+
+func (e filterNot) sql(args *[]interface{}) string {
+	return "NOT " + e.expr.sql(args)
+}
+
+func (e filterComparison) sql(args *[]interface{}) string {
+	*args = append(*args, e.value)
+	placeholder := "$" + strconv.Itoa(len(*args))
+	tagCondition := "ftag.deleted_at IS NULL"
+	if e.handAssigned {
+		tagCondition += " AND ftag.rule = ''"
+	}
+
+	switch {
+	case strings.HasPrefix(e.field, facetParamPrefix):
+		*args = append(*args, strings.TrimPrefix(e.field, facetParamPrefix))
+		exists := `EXISTS (SELECT 1 FROM productToTagAssignment fpta JOIN tag ftag ON ftag.id = fpta.tagID
+			WHERE fpta.productID = products.id AND fpta.deleted_at IS NULL AND ` + tagCondition + `
+			AND ftag.key = $` + strconv.Itoa(len(*args)) + ` AND LOWER(ftag.value) = LOWER(` + placeholder + `))`
+		if e.op == "!=" {
+			return "NOT " + exists
+		}
+		return exists
+	case e.field == "tag":
+		exists := `EXISTS (SELECT 1 FROM productToTagAssignment fpta JOIN tag ftag ON ftag.id = fpta.tagID
+			WHERE fpta.productID = products.id AND fpta.deleted_at IS NULL AND ` + tagCondition + `
+			AND (LOWER(ftag.name) = LOWER(` + placeholder + `) OR EXISTS (SELECT 1 FROM tag_alias falias
+				WHERE falias.tag_id = ftag.id AND LOWER(falias.alias) = LOWER(` + placeholder + `))))`
+		if e.op == "!=" {
+			return "NOT " + exists
+		}
+		return exists
+	case e.op == "~":
+		// the value is matched literally, wildcards included
+		(*args)[len(*args)-1] = likeEscaper.Replace(e.value.(string))
+		return "(products.name ILIKE '%' || " + placeholder + " || '%')"
+	case e.op == "!=":
+		return "(products." + e.field + " <> " + placeholder + ")"
+	default:
+		return "(products." + e.field + " " + e.op + " " + placeholder + ")"
+	}
+}
+
+// filterFields maps each field to the operators it supports and whether
+// its values are numbers.
+var filterFields = map[string]struct {
+	ops     []string
+	numeric bool
+}{
+	"id":    {ops: []string{"=", "!=", "<", "<=", ">", ">="}, numeric: true},
+	"price": {ops: []string{"=", "!=", "<", "<=", ">", ">="}, numeric: true},
+	"name":  {ops: []string{"=", "!=", "~"}},
+	"tag":   {ops: []string{"=", "!="}},
+}
+
+type filterTokenKind int
+
+const (
+	filterEOF filterTokenKind = iota
+	filterIdent
+	filterString
+	filterNumber
+	filterOperator
+	filterLParen
+	filterRParen
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int
+}
+
+func tokenizeFilter(input string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, filterToken{filterLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{filterRParen, ")", i})
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var b strings.Builder
+			for i < len(runes) && runes[i] != c {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			if i == len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, filterToken{filterString, b.String(), start})
+		case strings.ContainsRune("=!<>~", c):
+			start := i
+			i++
+			if i < len(runes) && runes[i] == '=' && c != '=' && c != '~' {
+				i++
+			}
+			op := string(runes[start:i])
+			if op == "!" {
+				return nil, fmt.Errorf("unknown operator ! at position %d", start)
+			}
+			tokens = append(tokens, filterToken{filterOperator, op, start})
+		case unicode.IsDigit(c) || c == '-' || c == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || (i == start && runes[i] == '-')) {
+				i++
+			}
+			tokens = append(tokens, filterToken{filterNumber, string(runes[start:i]), start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, filterToken{filterIdent, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+
+	return append(tokens, filterToken{filterEOF, "", len(runes)}), nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// parseProductFilter parses a filter expression. The error describes the
+// first problem found and where it is.
+func parseProductFilter(input string) (filterExpr, error) {
+	tokens, err := tokenizeFilter(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != filterEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+	}
+
+	return expr, nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.tokens[p.pos]
+	if t.kind != filterEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == filterIdent && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	if p.keyword("not") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{expr}, nil
+	}
+
+	if p.peek().kind == filterLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != filterRParen {
+			return nil, fmt.Errorf("expected ) at position %d", t.pos)
+		}
+		return expr, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterExpr, error) {
+	t := p.next()
+	if t.kind != filterIdent {
+		return nil, fmt.Errorf("expected a field at position %d", t.pos)
+	}
+
+	field := strings.ToLower(t.text)
+	spec, ok := filterFields[field]
+	if key := strings.TrimPrefix(field, facetParamPrefix); key != field && facetKeyPattern.MatchString(key) {
+		spec, ok = filterFields["tag"], true
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q at position %d, must be one of id, name, price, tag or tag.<key>", t.text, t.pos)
+	}
+
+	op := p.next()
+	if op.kind != filterOperator || !containsString(spec.ops, op.text) {
+		return nil, fmt.Errorf("expected one of %s after %s at position %d", strings.Join(spec.ops, " "), field, op.pos)
+	}
+
+	value := p.next()
+	switch {
+	case field == "id" && value.kind == filterNumber:
+		n, err := strconv.Atoi(value.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid product ID %q at position %d", value.text, value.pos)
+		}
+		return filterComparison{field: field, op: op.text, value: n}, nil
+	case spec.numeric && value.kind == filterNumber:
+		n, err := strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", value.text, value.pos)
+		}
+		return filterComparison{field: field, op: op.text, value: n}, nil
+	case !spec.numeric && value.kind == filterString:
+		return filterComparison{field: field, op: op.text, value: value.text}, nil
+	case spec.numeric:
+		return nil, fmt.Errorf("expected a number at position %d", value.pos)
+	default:
+		return nil, fmt.Errorf("expected a quoted string at position %d", value.pos)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+// filter_test.go
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProductFilter(t *testing.T) {
+	expr, err := parseProductFilter(`price < 50 AND (tag = "running" or name ~ 'shoe') and not id = 3`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := []interface{}{}
+	sql := strings.Join(strings.Fields(expr.sql(&args)), " ")
+
+	expected := []interface{}{50.0, "running", "shoe", 3}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected arguments %v. Got %v", expected, args)
+	}
+	for _, part := range []string{"(products.price < $1)", "LOWER(ftag.name) = LOWER($2)", "ILIKE '%' || $3 || '%'", "NOT (products.id = $4)"} {
+		if !strings.Contains(sql, part) {
+			t.Errorf("Expected %q in %s", part, sql)
+		}
+	}
+}
+
+func TestFilterContainsIsLiteral(t *testing.T) {
+	expr, _ := parseProductFilter(`name ~ "50%_off"`)
+
+	args := []interface{}{}
+	expr.sql(&args)
+	if len(args) != 1 || args[0] != `50\%\_off` {
+		t.Errorf("Expected the wildcards to be escaped. Got %v", args)
+	}
+}
+
+func TestParseProductFilterErrors(t *testing.T) {
+	invalid := map[string]string{
+		`color = "red"`:       "unknown field",
+		`price ~ 10`:          "expected one of",
+		`tag < "a"`:           "expected one of",
+		`name = 3`:            "expected a quoted string",
+		`price = "cheap"`:     "expected a number",
+		`id = 1.5`:            "invalid product ID",
+		`(price > 1`:          "expected )",
+		`name = "open`:        "unterminated string",
+		`price > 1 price < 2`: "unexpected",
+		`price > 1 and`:       "expected a field",
+		`name ! "x"`:          "unknown operator",
+		`tag.1st = "red"`:     "unknown field",
+		`tag.size < "XL"`:     "expected one of",
+	}
+
+	for input, message := range invalid {
+		_, err := parseProductFilter(input)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected %q to fail with %q. Got %v", input, message, err)
+		}
+	}
+}
@@ -4,5 +4,17 @@ go 1.22.2
 
 require (
 	github.com/gorilla/mux v1.8.1
+	github.com/graph-gophers/graphql-go v1.5.0
 	github.com/lib/pq v1.10.9
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/grpc v1.70.0
+	google.golang.org/protobuf v1.35.2
+)
+
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/net v0.32.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20241202173237-19429a94021a // indirect
 )
@@ -0,0 +1,1024 @@
+// graphql.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+type Query {
+	product(id: ID!): Product
+	products(first: Int, after: String, filter: String): ProductConnection!
+	tag(id: ID!): Tag
+	tags(first: Int, after: String): TagConnection!
+}
+
+type Mutation {
+	createProduct(input: ProductInput!): Product!
+	updateProduct(id: ID!, input: ProductInput!): Product!
+	deleteProduct(id: ID!): Boolean!
+	restoreProduct(id: ID!): Product!
+	createTag(input: TagInput!): Tag!
+	updateTag(id: ID!, input: TagInput!): Tag!
+	deleteTag(id: ID!): Boolean!
+	restoreTag(id: ID!): Tag!
+	assignTag(productID: ID!, tagID: ID!): Assignment!
+	unassignTag(productID: ID!, tagID: ID!): Boolean!
+	setProductTags(productID: ID!, tagIDs: [ID!]!): AssignmentDiff!
+}
+
+input ProductInput {
+	name: String!
+	price: Float!
+}
+
+input TagInput {
+	name: String!
+	parentID: ID
+	key: String
+	value: String
+	rule: String
+}
+
+type Product {
+	id: ID!
+	name: String!
+	price: Float!
+	tags: [Tag!]!
+}
+
+type Tag {
+	id: ID!
+	name: String!
+	parentID: ID
+	key: String
+	value: String
+	rule: String
+	products(first: Int, after: String): ProductConnection!
+}
+
+type Assignment {
+	id: ID!
+	product: Product!
+	tag: Tag!
+}
+
+type AssignmentDiff {
+	added: [ID!]!
+	removed: [ID!]!
+	unchanged: [ID!]!
+}
+
+type PageInfo {
+	hasNextPage: Boolean!
+	endCursor: String
+}
+
+type ProductConnection {
+	edges: [ProductEdge!]!
+	pageInfo: PageInfo!
+	totalCount: Int!
+}
+
+type ProductEdge {
+	cursor: String!
+	node: Product!
+}
+
+type TagConnection {
+	edges: [TagEdge!]!
+	pageInfo: PageInfo!
+	totalCount: Int!
+}
+
+type TagEdge {
+	cursor: String!
+	node: Tag!
+}
+`
+
+// maxGraphQLPageSize caps the first argument of connections.
+const maxGraphQLPageSize = 100
+
+func newGraphQLSchema(a *App) *graphql.Schema {
+	return graphql.MustParseSchema(graphqlSchema, &graphqlResolver{app: a}, graphql.MaxDepth(12))
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+func (a *App) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if strings.TrimSpace(req.Query) == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: query")
+		return
+	}
+
+	// errors of the query itself are reported in the response, as GraphQL
+	// clients expect
+	respondWithJSON(w, http.StatusOK, a.graphql.Exec(r.Context(), req.Query, req.OperationName, req.Variables))
+}
+
+// graphqlError is an error of a resolver. Its code tells clients what went
+// wrong, like the status code of a REST response.
+type graphqlError struct {
+	message string
+	code    string
+}
+
+func (e graphqlError) Error() string {
+	return e.message
+}
+
+func (e graphqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+func badUserInput(message string) error {
+	return graphqlError{message, "BAD_USER_INPUT"}
+}
+
+// graphqlMutationError maps the errors of a mutation like
+// respondWithMutationError does. notFound is the message used when the
+// affected row does not exist.
+func graphqlMutationError(err error, notFound string) error {
+	var invalid validationError
+	var missing notFoundError
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return graphqlError{notFound, "NOT_FOUND"}
+	case errors.As(err, &missing):
+		return graphqlError{err.Error(), "NOT_FOUND"}
+	case errors.As(err, &invalid):
+		return graphqlError{err.Error(), "VALIDATION_FAILED"}
+	}
+
+	return err
+}
+
+func parseGraphQLID(id graphql.ID, entity string) (int, error) {
+	n, err := strconv.Atoi(string(id))
+	if err != nil || n < 1 {
+		return 0, badUserInput("Invalid " + entity + " ID")
+	}
+
+	return n, nil
+}
+
+func graphqlID(id int) graphql.ID {
+	return graphql.ID(strconv.Itoa(id))
+}
+
+func graphqlIDs(ids []int) []graphql.ID {
+	out := make([]graphql.ID, len(ids))
+	for i, id := range ids {
+		out[i] = graphqlID(id)
+	}
+
+	return out
+}
+
+// Cursors are opaque to clients; they hold the ID of the last row of a
+// page, since connections are ordered by ID. The products of a tag come in
+// the order of the tag instead, so their cursors hold how many products the
+// page ends after.
+
+func encodeCursor(id int) string {
+	return base64.StdEncoding.EncodeToString([]byte("cursor:" + strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	data, err := base64.StdEncoding.DecodeString(cursor)
+	if err == nil && strings.HasPrefix(string(data), "cursor:") {
+		if id, err := strconv.Atoi(strings.TrimPrefix(string(data), "cursor:")); err == nil && id >= 0 {
+			return id, nil
+		}
+	}
+
+	return 0, badUserInput("Invalid cursor")
+}
+
+type pageArgs struct {
+	First *int32
+	After *string
+}
+
+// page returns the ID to start after and the page size of a connection.
+func (args pageArgs) page() (afterID, first int, err error) {
+	first = 10
+	if args.First != nil {
+		first = int(*args.First)
+	}
+	if first < 0 || first > maxGraphQLPageSize {
+		return 0, 0, badUserInput("first must be between 0 and " + strconv.Itoa(maxGraphQLPageSize))
+	}
+
+	if args.After != nil {
+		if afterID, err = decodeCursor(*args.After); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return afterID, first, nil
+}
+
+/*
+#######
+Loaders
+#######
+*/
+
+// Nested fields are resolved with loaders shared by all objects of a list,
+// so the tags of a page of products, or the products of a list of tags,
+// are loaded with one query instead of one per object.
+
+// tagsLoader loads the tags of a set of products the first time the tags
+// of any of them are asked for.
+type tagsLoader struct {
+	db         dbtx
+	productIDs []int
+
+	once sync.Once
+	tags map[int][]*tagResolver
+	err  error
+}
+
+func newTagsLoader(db dbtx, products []product) *tagsLoader {
+	ids := make([]int, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+
+	return &tagsLoader{db: db, productIDs: ids}
+}
+
+func (l *tagsLoader) load(productID int) ([]*tagResolver, error) {
+	l.once.Do(func() {
+		var tags map[int][]tag
+		if tags, l.err = getTagsOfProducts(l.db, l.productIDs); l.err != nil {
+			return
+		}
+
+		all := []tag{}
+		for _, id := range l.productIDs {
+			all = append(all, tags[id]...)
+		}
+		products := newProductsLoader(l.db, all)
+
+		l.tags = map[int][]*tagResolver{}
+		for productID, list := range tags {
+			for _, t := range list {
+				l.tags[productID] = append(l.tags[productID], &tagResolver{t, products})
+			}
+		}
+	})
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	if l.tags[productID] == nil {
+		return []*tagResolver{}, nil
+	}
+	return l.tags[productID], nil
+}
+
+// productsLoader loads a page of the products of a set of tags the first
+// time the products of any of them are asked for. Each distinct page, as
+// given by first and after, takes one query.
+type productsLoader struct {
+	db     dbtx
+	tagIDs []int
+
+	mu    sync.Mutex
+	pages map[[2]int]*productsPage
+}
+
+type productsPage struct {
+	once     sync.Once
+	products map[int][]product
+	totals   map[int]int
+	tags     *tagsLoader
+	err      error
+}
+
+func newProductsLoader(db dbtx, tags []tag) *productsLoader {
+	seen := map[int]bool{}
+	ids := []int{}
+	for _, t := range tags {
+		if !seen[t.ID] {
+			seen[t.ID] = true
+			ids = append(ids, t.ID)
+		}
+	}
+
+	return &productsLoader{db: db, tagIDs: ids, pages: map[[2]int]*productsPage{}}
+}
+
+func (l *productsLoader) load(tagID, offset, first int) (*productConnection, error) {
+	key := [2]int{offset, first}
+
+	l.mu.Lock()
+	page := l.pages[key]
+	if page == nil {
+		page = &productsPage{}
+		l.pages[key] = page
+	}
+	l.mu.Unlock()
+
+	page.once.Do(func() {
+		// one more than asked for tells whether there is a next page
+		page.products, page.totals, page.err = getProductsOfTags(l.db, l.tagIDs, offset, first+1)
+
+		all := []product{}
+		for _, id := range l.tagIDs {
+			all = append(all, page.products[id]...)
+		}
+		page.tags = newTagsLoader(l.db, all)
+	})
+	if page.err != nil {
+		return nil, page.err
+	}
+
+	total := page.totals[tagID]
+	return newOffsetProductConnection(page.tags, page.products[tagID], offset, first, func() (int, error) { return total, nil }), nil
+}
+
+/*
+#########
+Resolvers
+#########
+*/
+
+type graphqlResolver struct {
+	app *App
+}
+
+type productResolver struct {
+	p    product
+	tags *tagsLoader
+}
+
+func (r *productResolver) ID() graphql.ID {
+	return graphqlID(r.p.ID)
+}
+
+func (r *productResolver) Name() string {
+	return r.p.Name
+}
+
+func (r *productResolver) Price() float64 {
+	return r.p.Price
+}
+
+func (r *productResolver) Tags() ([]*tagResolver, error) {
+	return r.tags.load(r.p.ID)
+}
+
+type tagResolver struct {
+	t        tag
+	products *productsLoader
+}
+
+func (r *tagResolver) ID() graphql.ID {
+	return graphqlID(r.t.ID)
+}
+
+func (r *tagResolver) Name() string {
+	return r.t.Name
+}
+
+func (r *tagResolver) Key() *string {
+	if r.t.Key == "" {
+		return nil
+	}
+	return &r.t.Key
+}
+
+func (r *tagResolver) Value() *string {
+	if r.t.Value == "" {
+		return nil
+	}
+	return &r.t.Value
+}
+
+func (r *tagResolver) Rule() *string {
+	if r.t.Rule == "" {
+		return nil
+	}
+	return &r.t.Rule
+}
+
+func (r *tagResolver) ParentID() *graphql.ID {
+	if r.t.ParentID == nil {
+		return nil
+	}
+
+	id := graphqlID(*r.t.ParentID)
+	return &id
+}
+
+func (r *tagResolver) Products(args pageArgs) (*productConnection, error) {
+	offset, first, err := args.page()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.products.load(r.t.ID, offset, first)
+}
+
+// newProductResolvers resolves products which share a loader for their
+// tags. tags must cover all of them.
+func newProductResolvers(tags *tagsLoader, products []product) []*productResolver {
+	resolvers := make([]*productResolver, len(products))
+	for i, p := range products {
+		resolvers[i] = &productResolver{p, tags}
+	}
+
+	return resolvers
+}
+
+// newTagResolvers resolves tags which share a loader for their products.
+func newTagResolvers(db dbtx, tags []tag) []*tagResolver {
+	products := newProductsLoader(db, tags)
+
+	resolvers := make([]*tagResolver, len(tags))
+	for i, t := range tags {
+		resolvers[i] = &tagResolver{t, products}
+	}
+
+	return resolvers
+}
+
+// newProductResolver resolves a single product.
+func (r *graphqlResolver) newProductResolver(p product) *productResolver {
+	return &productResolver{p, newTagsLoader(r.app.DB, []product{p})}
+}
+
+type pageInfoResolver struct {
+	hasNextPage bool
+	endCursor   *string
+}
+
+func (r *pageInfoResolver) HasNextPage() bool {
+	return r.hasNextPage
+}
+
+func (r *pageInfoResolver) EndCursor() *string {
+	return r.endCursor
+}
+
+func newPageInfo(lastID int, hasNextPage bool) *pageInfoResolver {
+	info := &pageInfoResolver{hasNextPage: hasNextPage}
+	if lastID > 0 {
+		cursor := encodeCursor(lastID)
+		info.endCursor = &cursor
+	}
+
+	return info
+}
+
+type productConnection struct {
+	products []*productResolver
+	// cursors holds what the cursor of each product refers to
+	cursors  []int
+	pageInfo *pageInfoResolver
+	// total is only counted when totalCount is asked for
+	total func() (int, error)
+}
+
+// newProductConnection pages products, which are at most first+1 rows, the
+// last one telling that there is a next page.
+func newProductConnection(tags *tagsLoader, products []product, first int, total func() (int, error)) *productConnection {
+	return pageProducts(tags, products, first, total, func(i int) int { return products[i].ID })
+}
+
+// newOffsetProductConnection pages products like newProductConnection, for
+// the products of a tag, which follow offset others.
+func newOffsetProductConnection(tags *tagsLoader, products []product, offset, first int, total func() (int, error)) *productConnection {
+	return pageProducts(tags, products, first, total, func(i int) int { return offset + i + 1 })
+}
+
+// pageProducts pages products, the cursor of the i-th one referring to
+// cursor(i).
+func pageProducts(tags *tagsLoader, products []product, first int, total func() (int, error), cursor func(i int) int) *productConnection {
+	hasNextPage := len(products) > first
+	if hasNextPage {
+		products = products[:first]
+	}
+
+	cursors := make([]int, len(products))
+	for i := range products {
+		cursors[i] = cursor(i)
+	}
+
+	last := 0
+	if len(products) > 0 {
+		last = cursors[len(cursors)-1]
+	}
+
+	return &productConnection{newProductResolvers(tags, products), cursors, newPageInfo(last, hasNextPage), total}
+}
+
+type productEdge struct {
+	node   *productResolver
+	cursor int
+}
+
+func (e *productEdge) Cursor() string {
+	return encodeCursor(e.cursor)
+}
+
+func (e *productEdge) Node() *productResolver {
+	return e.node
+}
+
+func (c *productConnection) Edges() []*productEdge {
+	edges := make([]*productEdge, len(c.products))
+	for i, p := range c.products {
+		edges[i] = &productEdge{p, c.cursors[i]}
+	}
+
+	return edges
+}
+
+func (c *productConnection) PageInfo() *pageInfoResolver {
+	return c.pageInfo
+}
+
+func (c *productConnection) TotalCount() (int32, error) {
+	total, err := c.total()
+	return int32(total), err
+}
+
+type tagConnection struct {
+	tags     []*tagResolver
+	pageInfo *pageInfoResolver
+	total    func() (int, error)
+}
+
+type tagEdge struct {
+	node *tagResolver
+}
+
+func (e *tagEdge) Cursor() string {
+	return encodeCursor(e.node.t.ID)
+}
+
+func (e *tagEdge) Node() *tagResolver {
+	return e.node
+}
+
+func (c *tagConnection) Edges() []*tagEdge {
+	edges := make([]*tagEdge, len(c.tags))
+	for i, t := range c.tags {
+		edges[i] = &tagEdge{t}
+	}
+
+	return edges
+}
+
+func (c *tagConnection) PageInfo() *pageInfoResolver {
+	return c.pageInfo
+}
+
+func (c *tagConnection) TotalCount() (int32, error) {
+	total, err := c.total()
+	return int32(total), err
+}
+
+type assignmentResolver struct {
+	pta     productToTagAssignment
+	product *productResolver
+	tag     *tagResolver
+}
+
+func (r *assignmentResolver) ID() graphql.ID {
+	return graphqlID(r.pta.ID)
+}
+
+func (r *assignmentResolver) Product() *productResolver {
+	return r.product
+}
+
+func (r *assignmentResolver) Tag() *tagResolver {
+	return r.tag
+}
+
+type assignmentDiffResolver struct {
+	diff assignmentDiff
+}
+
+func (r *assignmentDiffResolver) Added() []graphql.ID {
+	return graphqlIDs(r.diff.Added)
+}
+
+func (r *assignmentDiffResolver) Removed() []graphql.ID {
+	return graphqlIDs(r.diff.Removed)
+}
+
+func (r *assignmentDiffResolver) Unchanged() []graphql.ID {
+	return graphqlIDs(r.diff.Unchanged)
+}
+
+/*
+#######
+Queries
+#######
+*/
+
+func (r *graphqlResolver) Product(args struct{ ID graphql.ID }) (*productResolver, error) {
+	id, err := parseGraphQLID(args.ID, "product")
+	if err != nil {
+		return nil, err
+	}
+
+	p := product{ID: id}
+	if err := p.getProduct(r.app.DB); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return r.newProductResolver(p), nil
+}
+
+func (r *graphqlResolver) Products(args struct {
+	First  *int32
+	After  *string
+	Filter *string
+}) (*productConnection, error) {
+	afterID, first, err := pageArgs{args.First, args.After}.page()
+	if err != nil {
+		return nil, err
+	}
+
+	var filter filterExpr
+	if args.Filter != nil && *args.Filter != "" {
+		if filter, err = parseProductFilter(*args.Filter); err != nil {
+			return nil, badUserInput("Invalid filter: " + err.Error())
+		}
+	}
+
+	products, err := getProductsAfter(r.app.DB, afterID, first+1, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProductConnection(newTagsLoader(r.app.DB, products), products, first, func() (int, error) {
+		return countProducts(r.app.DB, filter)
+	}), nil
+}
+
+func (r *graphqlResolver) Tag(args struct{ ID graphql.ID }) (*tagResolver, error) {
+	id, err := parseGraphQLID(args.ID, "tag")
+	if err != nil {
+		return nil, err
+	}
+
+	t := tag{ID: id}
+	if err := t.getTag(r.app.DB); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return newTagResolvers(r.app.DB, []tag{t})[0], nil
+}
+
+func (r *graphqlResolver) Tags(args pageArgs) (*tagConnection, error) {
+	afterID, first, err := args.page()
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := getTagsAfter(r.app.DB, afterID, first+1)
+	if err != nil {
+		return nil, err
+	}
+
+	hasNextPage := len(tags) > first
+	if hasNextPage {
+		tags = tags[:first]
+	}
+	lastID := 0
+	if len(tags) > 0 {
+		lastID = tags[len(tags)-1].ID
+	}
+
+	return &tagConnection{newTagResolvers(r.app.DB, tags), newPageInfo(lastID, hasNextPage), func() (int, error) {
+		return countTags(r.app.DB)
+	}}, nil
+}
+
+/*
+#########
+Mutations
+#########
+*/
+
+type productInputArgs struct {
+	Name  string
+	Price float64
+}
+
+type tagInputArgs struct {
+	Name     string
+	ParentID *graphql.ID
+	Key      *string
+	Value    *string
+	Rule     *string
+}
+
+// facet returns the optional key and value of the input.
+func (in tagInputArgs) facet() (key, value string) {
+	if in.Key != nil {
+		key = *in.Key
+	}
+	if in.Value != nil {
+		value = *in.Value
+	}
+	return key, value
+}
+
+// parentID converts the optional parent of the input.
+func (in tagInputArgs) parentID() (*int, error) {
+	if in.ParentID == nil {
+		return nil, nil
+	}
+
+	id, err := parseGraphQLID(*in.ParentID, "parent tag")
+	if err != nil {
+		return nil, err
+	}
+
+	return &id, nil
+}
+
+type idArgs struct {
+	ID graphql.ID
+}
+
+type assignmentArgs struct {
+	ProductID graphql.ID
+	TagID     graphql.ID
+}
+
+// ids parses the product and tag ID of an assignment.
+func (args assignmentArgs) ids() (productToTagAssignment, error) {
+	productID, err := parseGraphQLID(args.ProductID, "product")
+	if err != nil {
+		return productToTagAssignment{}, err
+	}
+	tagID, err := parseGraphQLID(args.TagID, "tag")
+	if err != nil {
+		return productToTagAssignment{}, err
+	}
+
+	return productToTagAssignment{ProductID: productID, TagID: tagID}, nil
+}
+
+func (r *graphqlResolver) CreateProduct(ctx context.Context, args struct{ Input productInputArgs }) (*productResolver, error) {
+	p := product{Name: args.Input.Name, Price: args.Input.Price}
+	err := r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return createProductTx(tx, cs, &p)
+	})
+	if err != nil {
+		return nil, graphqlMutationError(err, "")
+	}
+
+	return r.newProductResolver(p), nil
+}
+
+func (r *graphqlResolver) UpdateProduct(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input productInputArgs
+}) (*productResolver, error) {
+	id, err := parseGraphQLID(args.ID, "product")
+	if err != nil {
+		return nil, err
+	}
+
+	p := product{ID: id, Name: args.Input.Name, Price: args.Input.Price}
+	err = r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return updateProductTx(tx, cs, p)
+	})
+	if err != nil {
+		return nil, graphqlMutationError(err, "Product not found")
+	}
+
+	return r.newProductResolver(p), nil
+}
+
+func (r *graphqlResolver) DeleteProduct(ctx context.Context, args idArgs) (bool, error) {
+	id, err := parseGraphQLID(args.ID, "product")
+	if err != nil {
+		return false, err
+	}
+
+	err = r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return deleteProductTx(tx, cs, id)
+	})
+	if err != nil {
+		return false, graphqlMutationError(err, "Product not found")
+	}
+
+	return true, nil
+}
+
+func (r *graphqlResolver) RestoreProduct(ctx context.Context, args idArgs) (*productResolver, error) {
+	id, err := parseGraphQLID(args.ID, "product")
+	if err != nil {
+		return nil, err
+	}
+
+	p := product{ID: id}
+	err = r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return restoreProductTx(tx, cs, &p)
+	})
+	if err != nil {
+		return nil, graphqlMutationError(err, "Deleted product not found")
+	}
+
+	return r.newProductResolver(p), nil
+}
+
+func (r *graphqlResolver) CreateTag(ctx context.Context, args struct{ Input tagInputArgs }) (*tagResolver, error) {
+	parentID, err := args.Input.parentID()
+	if err != nil {
+		return nil, err
+	}
+
+	t := tag{Name: args.Input.Name, ParentID: parentID}
+	t.Key, t.Value = args.Input.facet()
+	if args.Input.Rule != nil {
+		t.Rule = *args.Input.Rule
+	}
+	err = r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return createTagTx(tx, cs, &t)
+	})
+	if err != nil {
+		return nil, graphqlMutationError(err, "")
+	}
+
+	return newTagResolvers(r.app.DB, []tag{t})[0], nil
+}
+
+func (r *graphqlResolver) UpdateTag(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input tagInputArgs
+}) (*tagResolver, error) {
+	id, err := parseGraphQLID(args.ID, "tag")
+	if err != nil {
+		return nil, err
+	}
+
+	parentID, err := args.Input.parentID()
+	if err != nil {
+		return nil, err
+	}
+
+	t := tag{ID: id, Name: args.Input.Name, ParentID: parentID}
+	t.Key, t.Value = args.Input.facet()
+	if args.Input.Rule != nil {
+		t.Rule = *args.Input.Rule
+	}
+	err = r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return updateTagTx(tx, cs, t)
+	})
+	if err != nil {
+		return nil, graphqlMutationError(err, "Tag not found")
+	}
+
+	return newTagResolvers(r.app.DB, []tag{t})[0], nil
+}
+
+func (r *graphqlResolver) DeleteTag(ctx context.Context, args idArgs) (bool, error) {
+	id, err := parseGraphQLID(args.ID, "tag")
+	if err != nil {
+		return false, err
+	}
+
+	err = r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return deleteTagTx(tx, cs, id)
+	})
+	if err != nil {
+		return false, graphqlMutationError(err, "Tag not found")
+	}
+
+	return true, nil
+}
+
+func (r *graphqlResolver) RestoreTag(ctx context.Context, args idArgs) (*tagResolver, error) {
+	id, err := parseGraphQLID(args.ID, "tag")
+	if err != nil {
+		return nil, err
+	}
+
+	t := tag{ID: id}
+	err = r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return restoreTagTx(tx, cs, &t)
+	})
+	if err != nil {
+		return nil, graphqlMutationError(err, "Deleted tag not found")
+	}
+
+	return newTagResolvers(r.app.DB, []tag{t})[0], nil
+}
+
+func (r *graphqlResolver) AssignTag(ctx context.Context, args assignmentArgs) (*assignmentResolver, error) {
+	pta, err := args.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return assignTagTx(tx, cs, &pta)
+	})
+	if err != nil {
+		return nil, graphqlMutationError(err, "Product or tag not found")
+	}
+
+	p := product{ID: pta.ProductID}
+	if err := p.getProduct(r.app.DB); err != nil {
+		return nil, graphqlMutationError(err, "Product not found")
+	}
+	t := tag{ID: pta.TagID}
+	if err := t.getTag(r.app.DB); err != nil {
+		return nil, graphqlMutationError(err, "Tag not found")
+	}
+
+	return &assignmentResolver{pta, r.newProductResolver(p), newTagResolvers(r.app.DB, []tag{t})[0]}, nil
+}
+
+func (r *graphqlResolver) UnassignTag(ctx context.Context, args assignmentArgs) (bool, error) {
+	pta, err := args.ids()
+	if err != nil {
+		return false, err
+	}
+
+	err = r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return unassignTagTx(tx, cs, pta)
+	})
+	if err != nil {
+		return false, graphqlMutationError(err, "Tag assignment to product not found")
+	}
+
+	return true, nil
+}
+
+func (r *graphqlResolver) SetProductTags(ctx context.Context, args struct {
+	ProductID graphql.ID
+	TagIDs    []graphql.ID
+}) (*assignmentDiffResolver, error) {
+	productID, err := parseGraphQLID(args.ProductID, "product")
+	if err != nil {
+		return nil, err
+	}
+	tagIDs := make([]int, len(args.TagIDs))
+	for i, id := range args.TagIDs {
+		if tagIDs[i], err = parseGraphQLID(id, "tag"); err != nil {
+			return nil, err
+		}
+	}
+
+	var diff assignmentDiff
+	err = r.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		var err error
+		diff, err = replaceTagsOfProductTx(tx, cs, productID, tagIDs)
+		return err
+	})
+	if err != nil {
+		return nil, graphqlMutationError(err, "Product not found")
+	}
+
+	return &assignmentDiffResolver{diff}, nil
+}
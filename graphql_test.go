@@ -0,0 +1,221 @@
+// graphql_test.go
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type graphqlResult struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func executeGraphQL(t *testing.T, query string, variables map[string]interface{}) graphqlResult {
+	body, _ := json.Marshal(graphqlRequest{Query: query, Variables: variables})
+	req, _ := http.NewRequest("POST", "/graphql", bytes.NewBuffer(body))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var result graphqlResult
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Expected a GraphQL response. Got %s", response.Body.String())
+	}
+
+	return result
+}
+
+// countingDB counts the queries run on the test database.
+type countingDB struct {
+	db      dbtx
+	queries int
+}
+
+func (c *countingDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	c.queries++
+	return c.db.Exec(query, args...)
+}
+
+func (c *countingDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	c.queries++
+	return c.db.Query(query, args...)
+}
+
+func (c *countingDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	c.queries++
+	return c.db.QueryRow(query, args...)
+}
+
+func TestGraphQLProductsWithTags(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addTags(2)
+	addTagAssignment(1, 1)
+	addTagAssignment(1, 2)
+	addTagAssignment(3, 2)
+
+	result := executeGraphQL(t, `{
+		products(first: 2) {
+			totalCount
+			pageInfo { hasNextPage endCursor }
+			edges { node { name tags { name products { totalCount edges { node { id } } } } } }
+		}
+	}`, nil)
+	if len(result.Errors) > 0 {
+		t.Fatalf("Expected no errors. Got %+v", result.Errors)
+	}
+
+	data, _ := json.Marshal(result.Data)
+	expected := `{"products":{"edges":[` +
+		`{"node":{"name":"Product 0","tags":[` +
+		`{"name":"Tag 0","products":{"edges":[{"node":{"id":"1"}}],"totalCount":1}},` +
+		`{"name":"Tag 1","products":{"edges":[{"node":{"id":"1"}},{"node":{"id":"3"}}],"totalCount":2}}]}},` +
+		`{"node":{"name":"Product 1","tags":[]}}],` +
+		`"pageInfo":{"endCursor":"` + encodeCursor(2) + `","hasNextPage":true},"totalCount":3}}`
+	if string(data) != expected {
+		t.Errorf("Expected %s. Got %s", expected, data)
+	}
+
+	result = executeGraphQL(t, `query($after: String) { products(after: $after) { edges { node { id } } pageInfo { hasNextPage } } }`,
+		map[string]interface{}{"after": encodeCursor(2)})
+	data, _ = json.Marshal(result.Data)
+	if string(data) != `{"products":{"edges":[{"node":{"id":"3"}}],"pageInfo":{"hasNextPage":false}}}` {
+		t.Errorf("Expected the second page. Got %s", data)
+	}
+}
+
+func TestGraphQLBatchesNestedTags(t *testing.T) {
+	clearTable()
+	addProducts(5)
+	addTags(2)
+	for i := 1; i <= 5; i++ {
+		addTagAssignment(i, 1)
+		addTagAssignment(i, 2)
+	}
+
+	products, _ := getProductsAfter(a.DB, 0, 5, nil)
+	db := &countingDB{db: a.DB}
+	resolvers := newProductResolvers(newTagsLoader(db, products), products)
+
+	for _, p := range resolvers {
+		tags, err := p.Tags()
+		if err != nil || len(tags) != 2 {
+			t.Fatalf("Expected two tags of product %d. Got %v %v", p.p.ID, tags, err)
+		}
+		for _, tr := range tags {
+			if _, err := tr.Products(pageArgs{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// one query for the tags of all products, one for the products of all
+	// tags
+	if db.queries != 2 {
+		t.Errorf("Expected 2 queries. Got %d", db.queries)
+	}
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	clearTable()
+
+	result := executeGraphQL(t, `mutation {
+		p: createProduct(input: {name: "Lamp", price: 19.99}) { id name }
+		t: createTag(input: {name: "light"}) { id }
+	}`, nil)
+	data, _ := json.Marshal(result.Data)
+	if string(data) != `{"p":{"id":"1","name":"Lamp"},"t":{"id":"1"}}` {
+		t.Fatalf("Expected the product and tag to be created. Got %s %+v", data, result.Errors)
+	}
+
+	result = executeGraphQL(t, `mutation { assignTag(productID: 1, tagID: 1) { product { name tags { name } } } }`, nil)
+	data, _ = json.Marshal(result.Data)
+	if string(data) != `{"assignTag":{"product":{"name":"Lamp","tags":[{"name":"light"}]}}}` {
+		t.Errorf("Expected the tag to be assigned. Got %s %+v", data, result.Errors)
+	}
+
+	result = executeGraphQL(t, `mutation { setProductTags(productID: 1, tagIDs: []) { removed } }`, nil)
+	data, _ = json.Marshal(result.Data)
+	if string(data) != `{"setProductTags":{"removed":["1"]}}` {
+		t.Errorf("Expected the tag to be removed. Got %s %+v", data, result.Errors)
+	}
+
+	result = executeGraphQL(t, `mutation { updateProduct(id: 1, input: {name: " ", price: 1}) { id } }`, nil)
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != "VALIDATION_FAILED" {
+		t.Errorf("Expected a validation error. Got %+v", result.Errors)
+	}
+
+	result = executeGraphQL(t, `mutation { createProduct(input: {name: "", price: -5}) { id } }`, nil)
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != "VALIDATION_FAILED" {
+		t.Errorf("Expected creates to be validated like updates. Got %+v", result.Errors)
+	}
+
+	result = executeGraphQL(t, `mutation { updateTag(id: 9, input: {name: "x"}) { id } }`, nil)
+	if len(result.Errors) != 1 || result.Errors[0].Message != "Tag not found" || result.Errors[0].Extensions["code"] != "NOT_FOUND" {
+		t.Errorf("Expected the tag to be missing. Got %+v", result.Errors)
+	}
+
+	executeGraphQL(t, `mutation { createTag(input: {name: "cheap", rule: "price < 5"}) { id } }`, nil)
+	result = executeGraphQL(t, `mutation { unassignTag(productID: 1, tagID: 2) }`, nil)
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != "VALIDATION_FAILED" {
+		t.Errorf("Expected removing a smart tag by hand to fail validation. Got %+v", result.Errors)
+	}
+
+	executeGraphQL(t, `mutation { deleteProduct(id: 1) }`, nil)
+	result = executeGraphQL(t, `{ product(id: 1) { id } }`, nil)
+	if result.Data["product"] != nil {
+		t.Errorf("Expected the product to be deleted. Got %v", result.Data)
+	}
+
+	entries, _ := getAuditLog(a.DB, auditFilter{Entity: "product"}, 0, 10)
+	if len(entries) != 2 {
+		t.Errorf("Expected the mutations to be audited like REST requests. Got %d entries", len(entries))
+	}
+}
+
+func TestGraphQLRejectsInvalidRequests(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/graphql", bytes.NewBufferString(`{"variables": {}}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	result := executeGraphQL(t, `{ products(first: 1000) { totalCount } }`, nil)
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != "BAD_USER_INPUT" {
+		t.Errorf("Expected the page size to be rejected. Got %+v", result.Errors)
+	}
+
+	result = executeGraphQL(t, `{ products(after: "nope") { totalCount } }`, nil)
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Message, "Invalid cursor") {
+		t.Errorf("Expected the cursor to be rejected. Got %+v", result.Errors)
+	}
+}
+
+func TestCursors(t *testing.T) {
+	id, err := decodeCursor(encodeCursor(42))
+	if err != nil || id != 42 {
+		t.Errorf("Expected the cursor to round trip. Got %d %v", id, err)
+	}
+
+	for _, cursor := range []string{"", "42", encodeCursor(-1)} {
+		if _, err := decodeCursor(cursor); err == nil {
+			t.Errorf("Expected %q to be rejected", cursor)
+		}
+	}
+}
+
+func TestGraphQLSchema(t *testing.T) {
+	schema := newGraphQLSchema(&App{})
+	if errs := schema.Validate(`{ products { edges { node { tags { products { totalCount } } } } } }`); len(errs) > 0 {
+		t.Errorf("Expected the query to be valid. Got %v", errs)
+	}
+	if errs := schema.Validate(`{ products { nope } }`); len(errs) == 0 {
+		t.Errorf("Expected an unknown field to be rejected")
+	}
+}
@@ -0,0 +1,548 @@
+// grpc.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/Rockensc20/cicd-microservices/catalogpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer implements the CatalogService of catalogpb on the same model
+// layer and mutations as the REST handlers.
+type grpcServer struct {
+	catalogpb.UnimplementedCatalogServiceServer
+	app *App
+}
+
+// newGRPCServer returns a server for the CatalogService together with gRPC
+// health checking and reflection, and the health server reporting for it.
+func (a *App) newGRPCServer() (*grpc.Server, *health.Server) {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcUnaryContext),
+		grpc.ChainStreamInterceptor(grpcStreamContext))
+
+	catalogpb.RegisterCatalogServiceServer(server, &grpcServer{app: a})
+
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+
+	return server, healthServer
+}
+
+// RunGRPC serves the gRPC API on addr, next to the HTTP API of Run.
+func (a *App) RunGRPC(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server, healthServer := a.newGRPCServer()
+	a.reportHealth(healthServer, 10*time.Second)
+
+	log.Fatal(server.Serve(listener))
+}
+
+// reportHealth marks the service as serving while the database answers,
+// checking once every interval.
+func (a *App) reportHealth(healthServer *health.Server, interval time.Duration) {
+	check := func() {
+		serving := healthpb.HealthCheckResponse_SERVING
+		if err := a.DB.Ping(); err != nil {
+			log.Printf("health check: %v", err)
+			serving = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+
+		healthServer.SetServingStatus("", serving)
+		healthServer.SetServingStatus(catalogpb.CatalogService_ServiceDesc.ServiceName, serving)
+	}
+
+	check()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			check()
+		}
+	}()
+}
+
+// grpcContext stores the actor and request ID of a call in its context,
+// like requestContextMiddleware does for HTTP requests. They are read from
+// the x-actor and x-request-id metadata.
+func grpcContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	ctx, requestID := withRequestContext(ctx, first("x-request-id"), first("x-actor"))
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", requestID))
+
+	return ctx
+}
+
+func grpcUnaryContext(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(grpcContext(ctx), req)
+}
+
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcStreamContext(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, contextStream{ss, grpcContext(ss.Context())})
+}
+
+// grpcError maps the errors of the model layer to a status like
+// respondWithMutationError maps them to a status code. notFound is the
+// message used when the affected row does not exist.
+func grpcError(err error, notFound string) error {
+	var invalid validationError
+	var missing notFoundError
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return status.Error(codes.NotFound, notFound)
+	case errors.As(err, &missing):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.As(err, &invalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// grpcPage returns the ID to start after and the page size of a list.
+// Page tokens are the cursors of the GraphQL connections.
+func grpcPage(pageSize int32, pageToken string) (afterID, size int, err error) {
+	if pageSize == 0 {
+		pageSize = 10
+	}
+
+	args := pageArgs{First: &pageSize}
+	if pageToken != "" {
+		args.After = &pageToken
+	}
+
+	afterID, size, err = args.page()
+	if err != nil {
+		return 0, 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return afterID, size, nil
+}
+
+// nextPageToken returns the token of the page after one with lastID as
+// last row, or "" when there is none.
+func nextPageToken(lastID int, hasNextPage bool) string {
+	if !hasNextPage {
+		return ""
+	}
+
+	return encodeCursor(lastID)
+}
+
+func toProductPB(p product) *catalogpb.Product {
+	pb := &catalogpb.Product{Id: int32(p.ID), Name: p.Name, Price: p.Price}
+	if p.DeletedAt != nil {
+		pb.DeletedAt = timestamppb.New(*p.DeletedAt)
+	}
+
+	return pb
+}
+
+func toProductsPB(products []product) []*catalogpb.Product {
+	pbs := make([]*catalogpb.Product, len(products))
+	for i, p := range products {
+		pbs[i] = toProductPB(p)
+	}
+
+	return pbs
+}
+
+func toTagPB(t tag) *catalogpb.Tag {
+	pb := &catalogpb.Tag{Id: int32(t.ID), Name: t.Name, Key: t.Key, Value: t.Value, Rule: t.Rule}
+	if t.DeletedAt != nil {
+		pb.DeletedAt = timestamppb.New(*t.DeletedAt)
+	}
+	if t.ParentID != nil {
+		parentID := int32(*t.ParentID)
+		pb.ParentId = &parentID
+	}
+
+	return pb
+}
+
+// fromOptionalID converts an optional ID field of a request.
+func fromOptionalID(id *int32) *int {
+	if id == nil {
+		return nil
+	}
+
+	value := int(*id)
+	return &value
+}
+
+func toTagsPB(tags []tag) []*catalogpb.Tag {
+	pbs := make([]*catalogpb.Tag, len(tags))
+	for i, t := range tags {
+		pbs[i] = toTagPB(t)
+	}
+
+	return pbs
+}
+
+func toInt32s(ids []int) []int32 {
+	out := make([]int32, len(ids))
+	for i, id := range ids {
+		out[i] = int32(id)
+	}
+
+	return out
+}
+
+func toDeletedFilter(deleted catalogpb.DeletedFilter) deletedFilter {
+	switch deleted {
+	case catalogpb.DeletedFilter_INCLUDE_DELETED:
+		return includeDeleted
+	case catalogpb.DeletedFilter_ONLY_DELETED:
+		return onlyDeleted
+	}
+
+	return excludeDeleted
+}
+
+/*
+########
+Products
+########
+*/
+
+func (s *grpcServer) GetProduct(ctx context.Context, req *catalogpb.GetProductRequest) (*catalogpb.Product, error) {
+	p := product{ID: int(req.Id)}
+	if err := p.getProduct(s.app.DB); err != nil {
+		return nil, grpcError(err, "Product not found")
+	}
+
+	return toProductPB(p), nil
+}
+
+func (s *grpcServer) ListProducts(ctx context.Context, req *catalogpb.ListProductsRequest) (*catalogpb.ListProductsResponse, error) {
+	afterID, size, err := grpcPage(req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter filterExpr
+	if req.Filter != "" {
+		if filter, err = parseProductFilter(req.Filter); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Invalid filter: "+err.Error())
+		}
+	}
+
+	products, err := getProductsAfter(s.app.DB, afterID, size+1, filter)
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+	total, err := countProducts(s.app.DB, filter)
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+
+	hasNextPage := len(products) > size
+	if hasNextPage {
+		products = products[:size]
+	}
+
+	resp := &catalogpb.ListProductsResponse{Products: toProductsPB(products), TotalSize: int32(total)}
+	if len(products) > 0 {
+		resp.NextPageToken = nextPageToken(products[len(products)-1].ID, hasNextPage)
+	}
+
+	return resp, nil
+}
+
+func (s *grpcServer) StreamProducts(req *catalogpb.StreamProductsRequest, stream catalogpb.CatalogService_StreamProductsServer) error {
+	err := s.app.streamRows(stream.Context(), streamProductsQuery(toDeletedFilter(req.Deleted)), scanStreamedProduct,
+		func(v interface{}) error {
+			return stream.Send(toProductPB(v.(product)))
+		},
+		func() {})
+	if err != nil {
+		return grpcError(err, "")
+	}
+
+	return nil
+}
+
+func (s *grpcServer) CreateProduct(ctx context.Context, req *catalogpb.CreateProductRequest) (*catalogpb.Product, error) {
+	p := product{Name: req.Name, Price: req.Price}
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return createProductTx(tx, cs, &p)
+	})
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+
+	return toProductPB(p), nil
+}
+
+func (s *grpcServer) UpdateProduct(ctx context.Context, req *catalogpb.UpdateProductRequest) (*catalogpb.Product, error) {
+	p := product{ID: int(req.Id), Name: req.Name, Price: req.Price}
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return updateProductTx(tx, cs, p)
+	})
+	if err != nil {
+		return nil, grpcError(err, "Product not found")
+	}
+
+	return toProductPB(p), nil
+}
+
+func (s *grpcServer) DeleteProduct(ctx context.Context, req *catalogpb.DeleteProductRequest) (*emptypb.Empty, error) {
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return deleteProductTx(tx, cs, int(req.Id))
+	})
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *grpcServer) RestoreProduct(ctx context.Context, req *catalogpb.RestoreProductRequest) (*catalogpb.Product, error) {
+	p := product{ID: int(req.Id)}
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return restoreProductTx(tx, cs, &p)
+	})
+	if err != nil {
+		return nil, grpcError(err, "Deleted product not found")
+	}
+
+	return toProductPB(p), nil
+}
+
+/*
+####
+Tags
+####
+*/
+
+func (s *grpcServer) GetTag(ctx context.Context, req *catalogpb.GetTagRequest) (*catalogpb.Tag, error) {
+	t := tag{ID: int(req.Id)}
+	if err := t.getTag(s.app.DB); err != nil {
+		return nil, grpcError(err, "Tag not found")
+	}
+
+	return toTagPB(t), nil
+}
+
+func (s *grpcServer) ListTags(ctx context.Context, req *catalogpb.ListTagsRequest) (*catalogpb.ListTagsResponse, error) {
+	afterID, size, err := grpcPage(req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := getTagsAfter(s.app.DB, afterID, size+1)
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+	total, err := countTags(s.app.DB)
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+
+	hasNextPage := len(tags) > size
+	if hasNextPage {
+		tags = tags[:size]
+	}
+
+	resp := &catalogpb.ListTagsResponse{Tags: toTagsPB(tags), TotalSize: int32(total)}
+	if len(tags) > 0 {
+		resp.NextPageToken = nextPageToken(tags[len(tags)-1].ID, hasNextPage)
+	}
+
+	return resp, nil
+}
+
+func (s *grpcServer) StreamTags(req *catalogpb.StreamTagsRequest, stream catalogpb.CatalogService_StreamTagsServer) error {
+	err := s.app.streamRows(stream.Context(), streamTagsQuery(toDeletedFilter(req.Deleted)), scanStreamedTag,
+		func(v interface{}) error {
+			return stream.Send(toTagPB(v.(tag)))
+		},
+		func() {})
+	if err != nil {
+		return grpcError(err, "")
+	}
+
+	return nil
+}
+
+func (s *grpcServer) CreateTag(ctx context.Context, req *catalogpb.CreateTagRequest) (*catalogpb.Tag, error) {
+	t := tag{Name: req.Name, ParentID: fromOptionalID(req.ParentId), Key: req.Key, Value: req.Value, Rule: req.Rule}
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return createTagTx(tx, cs, &t)
+	})
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+
+	return toTagPB(t), nil
+}
+
+func (s *grpcServer) UpdateTag(ctx context.Context, req *catalogpb.UpdateTagRequest) (*catalogpb.Tag, error) {
+	t := tag{ID: int(req.Id), Name: req.Name, ParentID: fromOptionalID(req.ParentId), Key: req.Key, Value: req.Value, Rule: req.Rule}
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return updateTagTx(tx, cs, t)
+	})
+	if err != nil {
+		return nil, grpcError(err, "Tag not found")
+	}
+
+	return toTagPB(t), nil
+}
+
+func (s *grpcServer) DeleteTag(ctx context.Context, req *catalogpb.DeleteTagRequest) (*emptypb.Empty, error) {
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return deleteTagTx(tx, cs, int(req.Id))
+	})
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *grpcServer) RestoreTag(ctx context.Context, req *catalogpb.RestoreTagRequest) (*catalogpb.Tag, error) {
+	t := tag{ID: int(req.Id)}
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return restoreTagTx(tx, cs, &t)
+	})
+	if err != nil {
+		return nil, grpcError(err, "Deleted tag not found")
+	}
+
+	return toTagPB(t), nil
+}
+
+/*
+###########
+Assignments
+###########
+*/
+
+func (s *grpcServer) ListTagsOfProduct(ctx context.Context, req *catalogpb.ListTagsOfProductRequest) (*catalogpb.ListTagsResponse, error) {
+	p := product{ID: int(req.ProductId)}
+	if err := p.getProduct(s.app.DB); err != nil {
+		return nil, grpcError(err, "Product not found")
+	}
+
+	tags, err := getTagsOfProducts(s.app.DB, []int{p.ID})
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+
+	return &catalogpb.ListTagsResponse{Tags: toTagsPB(tags[p.ID]), TotalSize: int32(len(tags[p.ID]))}, nil
+}
+
+func (s *grpcServer) ListProductsWithTag(ctx context.Context, req *catalogpb.ListProductsWithTagRequest) (*catalogpb.ListProductsResponse, error) {
+	// the products come in the order of the tag, so the page token holds
+	// how many of them the page starts after
+	offset, size, err := grpcPage(req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	t := tag{ID: int(req.TagId)}
+	if err := t.getTag(s.app.DB); err != nil {
+		return nil, grpcError(err, "Tag not found")
+	}
+
+	pages, totals, err := getProductsOfTags(s.app.DB, []int{t.ID}, offset, size+1)
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+
+	products := pages[t.ID]
+	hasNextPage := len(products) > size
+	if hasNextPage {
+		products = products[:size]
+	}
+
+	resp := &catalogpb.ListProductsResponse{Products: toProductsPB(products), TotalSize: int32(totals[t.ID])}
+	if len(products) > 0 {
+		resp.NextPageToken = nextPageToken(offset+len(products), hasNextPage)
+	}
+
+	return resp, nil
+}
+
+func (s *grpcServer) AssignTag(ctx context.Context, req *catalogpb.AssignTagRequest) (*catalogpb.Assignment, error) {
+	pta := productToTagAssignment{ProductID: int(req.ProductId), TagID: int(req.TagId)}
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return assignTagTx(tx, cs, &pta)
+	})
+	if err != nil {
+		return nil, grpcError(err, "Product or tag not found")
+	}
+
+	return &catalogpb.Assignment{Id: int32(pta.ID), ProductId: int32(pta.ProductID), TagId: int32(pta.TagID)}, nil
+}
+
+func (s *grpcServer) UnassignTag(ctx context.Context, req *catalogpb.UnassignTagRequest) (*emptypb.Empty, error) {
+	pta := productToTagAssignment{ProductID: int(req.ProductId), TagID: int(req.TagId)}
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		return unassignTagTx(tx, cs, pta)
+	})
+	if err != nil {
+		return nil, grpcError(err, "")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *grpcServer) SetProductTags(ctx context.Context, req *catalogpb.SetProductTagsRequest) (*catalogpb.AssignmentDiff, error) {
+	tagIDs := make([]int, len(req.TagIds))
+	for i, id := range req.TagIds {
+		tagIDs[i] = int(id)
+	}
+
+	var diff assignmentDiff
+	err := s.app.inTx(ctx, func(tx *sql.Tx, cs *changeSet) error {
+		var err error
+		diff, err = replaceTagsOfProductTx(tx, cs, int(req.ProductId), tagIDs)
+		return err
+	})
+	if err != nil {
+		return nil, grpcError(err, "Product not found")
+	}
+
+	return &catalogpb.AssignmentDiff{Added: toInt32s(diff.Added), Removed: toInt32s(diff.Removed), Unchanged: toInt32s(diff.Unchanged)}, nil
+}
@@ -0,0 +1,199 @@
+// grpc_test.go
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Rockensc20/cicd-microservices/catalogpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialGRPC serves the gRPC API of app in memory and returns a connection to
+// it.
+func dialGRPC(t *testing.T, app *App) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 20)
+	server, _ := app.newGRPCServer()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestGRPCProducts(t *testing.T) {
+	clearTable()
+	addProducts(3)
+
+	client := catalogpb.NewCatalogServiceClient(dialGRPC(t, &a))
+	ctx := context.Background()
+
+	page, err := client.ListProducts(ctx, &catalogpb.ListProductsRequest{PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Products) != 2 || page.TotalSize != 3 || page.NextPageToken == "" {
+		t.Errorf("Expected the first two of three products. Got %v", page)
+	}
+
+	page, _ = client.ListProducts(ctx, &catalogpb.ListProductsRequest{PageSize: 2, PageToken: page.NextPageToken})
+	if len(page.Products) != 1 || page.Products[0].Name != "Product 2" || page.NextPageToken != "" {
+		t.Errorf("Expected the last product. Got %v", page)
+	}
+
+	page, _ = client.ListProducts(ctx, &catalogpb.ListProductsRequest{Filter: "price > 15"})
+	if len(page.Products) != 2 || page.TotalSize != 2 {
+		t.Errorf("Expected the filter to apply. Got %v", page)
+	}
+
+	_, err = client.ListProducts(ctx, &catalogpb.ListProductsRequest{Filter: "price >"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected an invalid filter to be rejected. Got %v", err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-actor", "grpc-test")
+	p, err := client.UpdateProduct(ctx, &catalogpb.UpdateProductRequest{Id: 1, Name: "renamed", Price: 5})
+	if err != nil || p.Name != "renamed" {
+		t.Errorf("Expected the product to be updated. Got %v %v", p, err)
+	}
+
+	entries, _ := getAuditLog(a.DB, auditFilter{Actor: "grpc-test"}, 0, 10)
+	if len(entries) != 1 {
+		t.Errorf("Expected the update to be audited with the actor. Got %v", entries)
+	}
+
+	_, err = client.UpdateProduct(ctx, &catalogpb.UpdateProductRequest{Id: 1, Name: "", Price: 5})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected a validation error. Got %v", err)
+	}
+
+	if _, err := client.DeleteProduct(ctx, &catalogpb.DeleteProductRequest{Id: 2}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetProduct(ctx, &catalogpb.GetProductRequest{Id: 2})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected the deleted product to be missing. Got %v", err)
+	}
+
+	stream, err := client.StreamProducts(ctx, &catalogpb.StreamProductsRequest{Deleted: catalogpb.DeletedFilter_INCLUDE_DELETED})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed := 0
+	for {
+		p, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Id == 2 && p.DeletedAt == nil {
+			t.Errorf("Expected the deleted product to carry deleted_at")
+		}
+		streamed++
+	}
+	if streamed != 3 {
+		t.Errorf("Expected 3 streamed products. Got %d", streamed)
+	}
+}
+
+func TestGRPCAssignments(t *testing.T) {
+	clearTable()
+	addProducts(2)
+	addTags(2)
+
+	client := catalogpb.NewCatalogServiceClient(dialGRPC(t, &a))
+	ctx := context.Background()
+
+	if _, err := client.AssignTag(ctx, &catalogpb.AssignTagRequest{ProductId: 1, TagId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	client.AssignTag(ctx, &catalogpb.AssignTagRequest{ProductId: 2, TagId: 1})
+
+	_, err := client.AssignTag(ctx, &catalogpb.AssignTagRequest{ProductId: 1, TagId: 9})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected an unknown tag to be missing. Got %v", err)
+	}
+
+	products, _ := client.ListProductsWithTag(ctx, &catalogpb.ListProductsWithTagRequest{TagId: 1, PageSize: 1})
+	if len(products.Products) != 1 || products.TotalSize != 2 || products.NextPageToken == "" {
+		t.Errorf("Expected a page of the tagged products. Got %v", products)
+	}
+
+	diff, err := client.SetProductTags(ctx, &catalogpb.SetProductTagsRequest{ProductId: 1, TagIds: []int32{2}})
+	if err != nil || len(diff.Added) != 1 || len(diff.Removed) != 1 {
+		t.Errorf("Expected tag 1 to be replaced by tag 2. Got %v %v", diff, err)
+	}
+
+	tags, _ := client.ListTagsOfProduct(ctx, &catalogpb.ListTagsOfProductRequest{ProductId: 1})
+	if len(tags.Tags) != 1 || tags.Tags[0].Id != 2 {
+		t.Errorf("Expected only tag 2. Got %v", tags)
+	}
+}
+
+func TestGRPCHealthAndReflection(t *testing.T) {
+	conn := dialGRPC(t, &App{})
+	ctx := context.Background()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected the server to be serving. Got %v %v", resp, err)
+	}
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{}})
+	reply, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, service := range reply.GetListServicesResponse().GetService() {
+		if service.Name == catalogpb.CatalogService_ServiceDesc.ServiceName {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected reflection to list the catalog service. Got %v", reply)
+	}
+}
+
+func TestGRPCPage(t *testing.T) {
+	afterID, size, err := grpcPage(0, "")
+	if err != nil || afterID != 0 || size != 10 {
+		t.Errorf("Expected the first page of 10. Got %d %d %v", afterID, size, err)
+	}
+
+	afterID, size, _ = grpcPage(5, nextPageToken(7, true))
+	if afterID != 7 || size != 5 {
+		t.Errorf("Expected to continue after 7. Got %d %d", afterID, size)
+	}
+
+	if _, _, err := grpcPage(500, ""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected the page size to be rejected. Got %v", err)
+	}
+	if nextPageToken(7, false) != "" {
+		t.Errorf("Expected no token on the last page")
+	}
+}
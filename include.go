@@ -0,0 +1,92 @@
+// include.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// includedProductsLimit caps how many products ?include=products embeds in
+// a tag, since a tag may have any number of them. productCount tells how
+// many there are in total.
+const includedProductsLimit = 50
+
+// productWithTags is a product with its tags embedded, see ?include=tags.
+type productWithTags struct {
+	product
+	Tags []tag `json:"tags"`
+}
+
+// tagWithProducts is a tag with its first products embedded, see
+// ?include=products.
+type tagWithProducts struct {
+	tag
+	Products     []product `json:"products"`
+	ProductCount int       `json:"productCount"`
+}
+
+// parseInclude reads the comma separated relations of ?include=. allowed
+// are the relations the endpoint can embed.
+func parseInclude(r *http.Request, allowed ...string) (map[string]bool, error) {
+	include := map[string]bool{}
+
+	value := r.FormValue("include")
+	if value == "" {
+		return include, nil
+	}
+
+	for _, relation := range strings.Split(value, ",") {
+		relation = strings.TrimSpace(relation)
+		known := false
+		for _, a := range allowed {
+			known = known || relation == a
+		}
+		if !known {
+			return nil, errors.New("include must be one of " + strings.Join(allowed, ", "))
+		}
+		include[relation] = true
+	}
+
+	return include, nil
+}
+
+// withTags embeds their tags in products, loading them with one query.
+func withTags(db dbtx, products []product) ([]productWithTags, error) {
+	ids := make([]int, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+
+	tags, err := getTagsOfProducts(db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	embedded := make([]productWithTags, len(products))
+	for i, p := range products {
+		embedded[i] = productWithTags{p, tags[p.ID]}
+		if embedded[i].Tags == nil {
+			embedded[i].Tags = []tag{}
+		}
+	}
+
+	return embedded, nil
+}
+
+// withProducts embeds up to includedProductsLimit of its products in a tag,
+// in the order of the tag.
+func withProducts(db dbtx, t tag) (tagWithProducts, error) {
+	products, totals, err := getProductsOfTags(db, []int{t.ID}, 0, includedProductsLimit)
+	if err != nil {
+		return tagWithProducts{}, err
+	}
+
+	embedded := tagWithProducts{t, products[t.ID], totals[t.ID]}
+	if embedded.Products == nil {
+		embedded.Products = []product{}
+	}
+
+	return embedded, nil
+}
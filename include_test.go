@@ -0,0 +1,105 @@
+// include_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetProductIncludeTags(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addTags(2)
+	addTagAssignment(1, 1)
+	addTagAssignment(1, 2)
+
+	req, _ := http.NewRequest("GET", "/product/1?include=tags", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var p productWithTags
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Name != "Product 0" || len(p.Tags) != 2 || p.Tags[0].Name != "Tag 0" {
+		t.Errorf("Expected the product with both tags. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	response = executeRequest(req)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if _, ok := m["tags"]; ok {
+		t.Errorf("Expected no tags without include. Got %s", response.Body.String())
+	}
+}
+
+func TestGetProductsIncludeTags(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addTags(1)
+	addTagAssignment(2, 1)
+
+	req, _ := http.NewRequest("GET", "/products?include=tags", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var products []productWithTags
+	json.Unmarshal(response.Body.Bytes(), &products)
+	if len(products) != 3 || len(products[0].Tags) != 0 || len(products[1].Tags) != 1 || len(products[2].Tags) != 0 {
+		t.Errorf("Expected only the second product to be tagged. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/products?include=tags&format=ndjson", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestGetTagIncludeProducts(t *testing.T) {
+	clearTable()
+	addProducts(includedProductsLimit + 2)
+	addTags(1)
+	for i := 1; i <= includedProductsLimit+2; i++ {
+		addTagAssignment(i, 1)
+	}
+
+	req, _ := http.NewRequest("GET", "/tag/1?include=products", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var tg tagWithProducts
+	json.Unmarshal(response.Body.Bytes(), &tg)
+	if tg.Name != "Tag 0" || len(tg.Products) != includedProductsLimit || tg.ProductCount != includedProductsLimit+2 {
+		t.Errorf("Expected %d of %d products. Got %d of %d", includedProductsLimit, includedProductsLimit+2,
+			len(tg.Products), tg.ProductCount)
+	}
+}
+
+func TestGetIncludeRejectsUnknownRelations(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addTags(1)
+
+	for _, url := range []string{"/product/1?include=products", "/products?include=nope", "/tag/1?include=tags"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+	}
+}
+
+func TestParseInclude(t *testing.T) {
+	include, err := parseInclude(httptest.NewRequest("GET", "/products?include=tags,%20tags", nil), "tags")
+	if err != nil || !include["tags"] || len(include) != 1 {
+		t.Errorf("Expected tags to be included. Got %v %v", include, err)
+	}
+
+	include, err = parseInclude(httptest.NewRequest("GET", "/products", nil), "tags")
+	if err != nil || len(include) != 0 {
+		t.Errorf("Expected nothing to be included. Got %v %v", include, err)
+	}
+
+	if _, err := parseInclude(httptest.NewRequest("GET", "/products?include=tags,owner", nil), "tags"); err == nil {
+		t.Errorf("Expected an unknown relation to be rejected")
+	}
+}
@@ -2,9 +2,17 @@
 
 package main
 
-import "os"
+import (
+	"log"
+	"os"
+	"time"
+)
 
 func main() {
+	if args, ok := cliArgs(os.Args); ok {
+		os.Exit(runCLI(args, os.Stdin, os.Stdout, os.Stderr, appFromEnv))
+	}
+
 	a := App{}
 
 	a.Initialize(
@@ -14,6 +22,54 @@ func main() {
 		os.Getenv("APP_DB_HOST"),
 		os.Getenv("APP_DB_NAME"))
 
+	a.StartPurgeJob(durationFromEnv("APP_TRASH_RETENTION", 30*24*time.Hour), time.Hour)
+	a.StartWebhookWorker(durationFromEnv("APP_WEBHOOK_POLL_INTERVAL", 10*time.Second))
+	a.StartTagRuleJob(durationFromEnv("APP_TAG_RULE_INTERVAL", time.Hour))
+
+	if spec := os.Getenv("APP_OUTBOX_SINK"); spec != "" {
+		sink, err := newEventSink(spec)
+		if err != nil {
+			log.Fatalf("APP_OUTBOX_SINK: %v", err)
+		}
+		a.StartOutboxRelay(sink, durationFromEnv("APP_OUTBOX_POLL_INTERVAL", 5*time.Second))
+	}
+
+	grpcAddr := os.Getenv("APP_GRPC_ADDR")
+	if grpcAddr == "" {
+		grpcAddr = ":8889"
+	}
+	go a.RunGRPC(grpcAddr)
+
 	a.Run(":8888")
 
 }
+
+// appFromEnv connects to the database configured in the environment, for
+// the admin tool.
+func appFromEnv() (*App, error) {
+	a := &App{}
+	a.Initialize(
+		os.Getenv("APP_DB_USERNAME"),
+		os.Getenv("APP_DB_PASSWORD"),
+		os.Getenv("APP_DB_PORT"),
+		os.Getenv("APP_DB_HOST"),
+		os.Getenv("APP_DB_NAME"))
+
+	return a, a.DB.Ping()
+}
+
+// durationFromEnv reads a duration such as "720h" from the environment,
+// falling back to def when the variable is unset.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+
+	return d
+}
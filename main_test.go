@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"time"
 )
 
 var a App
@@ -46,6 +47,12 @@ func clearTable() {
 	a.DB.Exec("ALTER SEQUENCE tag_id_seq RESTART WITH 1")
 	a.DB.Exec("DELETE FROM productToTagAssignment")
 	a.DB.Exec("ALTER SEQUENCE productToTagAssignment_id_seq RESTART WITH 1")
+	// the append-only trigger does not fire on TRUNCATE
+	a.DB.Exec("TRUNCATE audit_log RESTART IDENTITY")
+	a.DB.Exec("TRUNCATE webhook_subscription, webhook_delivery RESTART IDENTITY")
+	a.DB.Exec("TRUNCATE outbox, outbox_cursor RESTART IDENTITY")
+	a.DB.Exec("TRUNCATE product_import RESTART IDENTITY")
+	a.DB.Exec("TRUNCATE tag_alias RESTART IDENTITY")
 }
 
 const tableCreationQuery = `CREATE TABLE IF NOT EXISTS products
@@ -73,6 +80,160 @@ CREATE TABLE IF NOT EXISTS productToTagAssignment
 	CONSTRAINT tag_fkey FOREIGN KEY (tagID) REFERENCES tag (id) ON DELETE CASCADE
 ); 
 
+ALTER TABLE products ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE tag ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE productToTagAssignment ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS audit_log
+(
+    id BIGSERIAL,
+    entity TEXT NOT NULL,
+    entity_id integer NOT NULL,
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    request_id TEXT NOT NULL,
+    before JSONB,
+    after JSONB,
+    diff JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT audit_log_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity, entity_id);
+
+-- the audit log is append-only: rows can be inserted but never changed
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TABLE IF NOT EXISTS webhook_subscription
+(
+    id SERIAL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    event_types TEXT[] NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT webhook_subscription_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_delivery
+(
+    id BIGSERIAL,
+    subscription_id integer NOT NULL,
+    event_type TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    last_error TEXT,
+    response_code integer,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered_at TIMESTAMPTZ,
+    CONSTRAINT webhook_delivery_pkey PRIMARY KEY (id),
+    CONSTRAINT subscription_fkey FOREIGN KEY (subscription_id) REFERENCES webhook_subscription (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS webhook_delivery_due_idx ON webhook_delivery (next_attempt_at) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS outbox
+(
+    seq BIGSERIAL,
+    event_type TEXT NOT NULL,
+    entity TEXT NOT NULL,
+    entity_id integer NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT outbox_pkey PRIMARY KEY (seq)
+);
+
+CREATE TABLE IF NOT EXISTS outbox_cursor
+(
+    sink TEXT NOT NULL,
+    last_seq BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT outbox_cursor_pkey PRIMARY KEY (sink)
+);
+
+CREATE TABLE IF NOT EXISTS product_import
+(
+    id SERIAL,
+    actor TEXT NOT NULL,
+    dry_run BOOLEAN NOT NULL,
+    created integer NOT NULL,
+    updated integer NOT NULL,
+    unchanged integer NOT NULL,
+    rejected integer NOT NULL,
+    tags_created integer NOT NULL,
+    error_report TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT product_import_pkey PRIMARY KEY (id)
+);
+
+-- tags form a hierarchy, e.g. Clothing > Shoes > Running
+ALTER TABLE tag ADD COLUMN IF NOT EXISTS parent_id integer REFERENCES tag (id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS tag_parent_idx ON tag (parent_id);
+
+-- other names of a tag, e.g. "tee" for "T-Shirt"; lookups by alias find the tag
+CREATE TABLE IF NOT EXISTS tag_alias
+(
+    id SERIAL,
+    alias TEXT NOT NULL,
+    tag_id integer NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT tag_alias_pkey PRIMARY KEY (id),
+    CONSTRAINT tag_fkey FOREIGN KEY (tag_id) REFERENCES tag (id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS tag_alias_name_idx ON tag_alias (LOWER(alias));
+CREATE INDEX IF NOT EXISTS tag_alias_tag_idx ON tag_alias (tag_id);
+
+-- tag suggestions match name prefixes ignoring case and accents
+CREATE EXTENSION IF NOT EXISTS unaccent;
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- unaccent is only stable because its dictionary may change; naming the
+-- dictionary makes the key usable in indexes
+CREATE OR REPLACE FUNCTION tag_search_key(text) RETURNS text AS $$
+    SELECT lower(public.unaccent('public.unaccent'::regdictionary, $1))
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+CREATE INDEX IF NOT EXISTS tag_search_idx ON tag USING gin (tag_search_key(name) gin_trgm_ops) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS tag_alias_search_idx ON tag_alias USING gin (tag_search_key(alias) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS productToTagAssignment_tag_idx ON productToTagAssignment (tagID) WHERE deleted_at IS NULL;
+
+-- key/value tags such as color=red, which products can be filtered and
+-- counted by; plain tags leave both empty
+ALTER TABLE tag ADD COLUMN IF NOT EXISTS key TEXT NOT NULL DEFAULT '';
+ALTER TABLE tag ADD COLUMN IF NOT EXISTS value TEXT NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX IF NOT EXISTS tag_facet_idx ON tag (key, LOWER(value)) WHERE key <> '' AND deleted_at IS NULL;
+
+-- when tags were created, so the cleanup of unused tags spares new ones;
+-- tags that existed before count from the migration
+ALTER TABLE tag ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- related products are found through the assignments of the tags of a
+-- product and the tag counts of the products found that way, both read
+-- from these indexes alone
+CREATE INDEX IF NOT EXISTS productToTagAssignment_tag_product_idx ON productToTagAssignment (tagID, productID) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS productToTagAssignment_product_tag_idx ON productToTagAssignment (productID, tagID) WHERE deleted_at IS NULL;
+
+-- smart tags select their products with a filter expression; plain tags
+-- leave it empty. Every transaction looks the smart tags up.
+ALTER TABLE tag ADD COLUMN IF NOT EXISTS rule TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS tag_rule_idx ON tag (id) WHERE rule <> '' AND deleted_at IS NULL;
+
+-- the position of an assignment among the tags of its product and among
+-- the products of its tag; unordered assignments come last
+ALTER TABLE productToTagAssignment ADD COLUMN IF NOT EXISTS position_in_product INTEGER;
+ALTER TABLE productToTagAssignment ADD COLUMN IF NOT EXISTS position_in_tag INTEGER;
+
 `
 
 func TestEmptyTable(t *testing.T) {
@@ -449,3 +610,270 @@ func TestGetAllTagsAssignedToProduct(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, response.Code)
 
 }
+
+func TestUpdateProductRequiresAllFields(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	var jsonStr = []byte(`{"price": 5}`)
+	req, _ := http.NewRequest("PUT", "/product/1", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	response = executeRequest(req)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["name"] != "Product 0" {
+		t.Errorf("Expected the name to remain 'Product 0'. Got '%v'", m["name"])
+	}
+}
+
+func TestMergePatchProduct(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	var jsonStr = []byte(`{"price": 5}`)
+	req, _ := http.NewRequest("PATCH", "/product/1", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["name"] != "Product 0" {
+		t.Errorf("Expected the name to remain 'Product 0'. Got '%v'", m["name"])
+	}
+
+	if m["price"] != 5.0 {
+		t.Errorf("Expected the price to be '5'. Got '%v'", m["price"])
+	}
+}
+
+func TestJSONPatchProduct(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	var jsonStr = []byte(`[{"op":"test","path":"/price","value":10},{"op":"replace","path":"/name","value":"patched"}]`)
+	req, _ := http.NewRequest("PATCH", "/product/1", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json-patch+json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["name"] != "patched" {
+		t.Errorf("Expected the name to be 'patched'. Got '%v'", m["name"])
+	}
+
+	jsonStr = []byte(`[{"op":"test","path":"/price","value":99},{"op":"replace","path":"/name","value":"other"}]`)
+	req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json-patch+json")
+
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+}
+
+func TestCreateValidation(t *testing.T) {
+	clearTable()
+
+	for url, body := range map[string]string{
+		"/product": `{"name":"", "price": -5}`,
+		"/tag":     `{"name":" "}`,
+	} {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		if response := executeRequest(req); response.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected %s to reject %s. Got %d", url, body, response.Code)
+		}
+	}
+}
+
+func TestPatchProductValidation(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	var jsonStr = []byte(`{"name": null}`)
+	req, _ := http.NewRequest("PATCH", "/product/1", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBuffer([]byte(`{"price": 5}`)))
+	req.Header.Set("Content-Type", "application/json")
+
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnsupportedMediaType, response.Code)
+
+	req, _ = http.NewRequest("PATCH", "/product/99", bytes.NewBuffer([]byte(`{"price": 5}`)))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	// removing the price is rejected instead of setting it to zero
+	for contentType, patch := range map[string]string{
+		"application/merge-patch+json": `{"price": null}`,
+		"application/json-patch+json":  `[{"op": "remove", "path": "/price"}]`,
+	} {
+		req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBufferString(patch))
+		req.Header.Set("Content-Type", contentType)
+		if response := executeRequest(req); response.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected %s to be rejected. Got %d", patch, response.Code)
+		}
+	}
+
+	p := product{ID: 1}
+	if err := p.getProduct(a.DB); err != nil || p.Price == 0 {
+		t.Errorf("Expected the price to be kept. Got %v %v", p, err)
+	}
+}
+
+func TestMergePatchTag(t *testing.T) {
+	clearTable()
+	addTags(1)
+
+	var jsonStr = []byte(`{"name": "patched tag"}`)
+	req, _ := http.NewRequest("PATCH", "/tag/1", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["name"] != "patched tag" {
+		t.Errorf("Expected the name to be 'patched tag'. Got '%v'", m["name"])
+	}
+}
+
+func TestListDeletedProducts(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("DELETE", "/product/1", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	response = executeRequest(req)
+
+	var products []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &products)
+	if len(products) != 1 || products[0]["id"] != 2.0 {
+		t.Errorf("Expected only product 2 to be listed. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/products?deleted=only", nil)
+	response = executeRequest(req)
+
+	json.Unmarshal(response.Body.Bytes(), &products)
+	if len(products) != 1 || products[0]["id"] != 1.0 || products[0]["deletedAt"] == nil {
+		t.Errorf("Expected only the deleted product 1 to be listed. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/products?deleted=maybe", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestRestoreProductWithAssignments(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addTags(2)
+	addTagAssignment(1, 1)
+	addTagAssignment(1, 2)
+
+	// removed before the product is deleted, so it must stay removed
+	req, _ := http.NewRequest("DELETE", "/product/1/tag/2", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/product/1", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("POST", "/product/1/restore", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1/tag/1", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1/tag/2", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("POST", "/product/1/restore", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestRestoreTag(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addTags(1)
+	addTagAssignment(1, 1)
+
+	req, _ := http.NewRequest("DELETE", "/tag/1", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1/tags", nil)
+	response = executeRequest(req)
+	if body := response.Body.String(); body != "[]" {
+		t.Errorf("Expected no tags on the product. Got %s", body)
+	}
+
+	req, _ = http.NewRequest("POST", "/tag/1/restore", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1/tag/1", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	clearTable()
+	addProducts(2)
+	addTags(1)
+	addTagAssignment(1, 1)
+
+	req, _ := http.NewRequest("DELETE", "/product/1", nil)
+	executeRequest(req)
+
+	if _, err := purgeDeleted(a.DB, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ = http.NewRequest("POST", "/product/1/restore", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/product/1", nil)
+	executeRequest(req)
+
+	if _, err := purgeDeleted(a.DB, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ = http.NewRequest("POST", "/product/1/restore", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	var remaining int
+	a.DB.QueryRow("SELECT COUNT(*) FROM productToTagAssignment").Scan(&remaining)
+	if remaining != 0 {
+		t.Errorf("Expected the assignments of the purged product to be gone. Got %d", remaining)
+	}
+}
@@ -4,34 +4,221 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx, so the model functions can
+// run on their own or as part of a larger transaction.
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// deletedFilter selects which rows a list query returns with regard to
+// soft deletion. The zero value hides deleted rows.
+type deletedFilter string
+
+const (
+	excludeDeleted deletedFilter = ""
+	onlyDeleted    deletedFilter = "only"
+	includeDeleted deletedFilter = "include"
 )
 
+func parseDeletedFilter(value string) (deletedFilter, error) {
+	switch f := deletedFilter(value); f {
+	case excludeDeleted, onlyDeleted, includeDeleted:
+		return f, nil
+	case "exclude":
+		return excludeDeleted, nil
+	default:
+		return "", errors.New("deleted must be one of exclude, include or only")
+	}
+}
+
+// condition returns the WHERE condition implementing the filter for the
+// deleted_at column of the given table.
+func (f deletedFilter) condition(table string) string {
+	switch f {
+	case onlyDeleted:
+		return table + ".deleted_at IS NOT NULL"
+	case includeDeleted:
+		return "TRUE"
+	default:
+		return table + ".deleted_at IS NULL"
+	}
+}
+
+// validationError reports input that is well-formed but breaks a rule of
+// the catalog. Handlers answer it with 422 Unprocessable Entity.
+type validationError string
+
+func (e validationError) Error() string {
+	return string(e)
+}
+
+// notFoundError names rows a request refers to that do not exist. Handlers
+// answer it with 404 Not Found.
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return string(e)
+}
+
+func missingIDsError(entity string, ids []int) error {
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = strconv.Itoa(id)
+	}
+
+	return notFoundError(entity + " not found: " + strings.Join(list, ", "))
+}
+
+// maxPrice is the largest value that fits into the NUMERIC(10,2) price column.
+const maxPrice = 99999999.99
+
 type product struct {
-	ID    int     `json:"id"`
-	Name  string  `json:"name"`
-	Price float64 `json:"price"`
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Price     float64    `json:"price"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// productInput is the body of a PUT request. Pointer fields tell a missing
+// field apart from its zero value, since PUT replaces the whole product.
+type productInput struct {
+	Name  *string  `json:"name"`
+	Price *float64 `json:"price"`
+}
+
+func (in productInput) missingFields() []string {
+	missing := []string{}
+	if in.Name == nil {
+		missing = append(missing, "name")
+	}
+	if in.Price == nil {
+		missing = append(missing, "price")
+	}
+
+	return missing
+}
+
+func (p *product) getProduct(db dbtx) error {
+	return db.QueryRow("SELECT name, price FROM products WHERE id=$1 AND deleted_at IS NULL",
+		p.ID).Scan(&p.Name, &p.Price)
 }
 
-func (p *product) getProduct(db *sql.DB) error {
-	return db.QueryRow("SELECT name, price FROM products WHERE id=$1",
+// getProductForUpdate loads the product and locks its row until the
+// surrounding transaction ends.
+func (p *product) getProductForUpdate(tx *sql.Tx) error {
+	return tx.QueryRow("SELECT name, price FROM products WHERE id=$1 AND deleted_at IS NULL FOR UPDATE",
 		p.ID).Scan(&p.Name, &p.Price)
 }
 
-func (p *product) updateProduct(db *sql.DB) error {
-	_, err :=
-		db.Exec("UPDATE products SET name=$1, price=$2 WHERE id=$3",
+// getProductsByNameForUpdate loads and locks the active products with the
+// given name, ignoring case. At most two are returned, which is enough to
+// tell whether the name is ambiguous.
+func getProductsByNameForUpdate(tx *sql.Tx, name string) ([]product, error) {
+	rows, err := tx.Query("SELECT id, name, price FROM products WHERE LOWER(name)=LOWER($1) AND deleted_at IS NULL ORDER BY id LIMIT 2 FOR UPDATE",
+		name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	products := []product{}
+
+	for rows.Next() {
+		var p product
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price); err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	return products, rows.Err()
+}
+
+func (p *product) updateProduct(db dbtx) error {
+	res, err :=
+		db.Exec("UPDATE products SET name=$1, price=$2 WHERE id=$3 AND deleted_at IS NULL",
 			p.Name, p.Price, p.ID)
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	return expectRowsAffected(res)
 }
 
-func (p *product) deleteProduct(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM products WHERE id=$1", p.ID)
+func (p *product) validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return validationError("Product name must not be empty")
+	}
+	if p.Price < 0 || p.Price > maxPrice {
+		return validationError("Product price must be between 0 and 99999999.99")
+	}
 
-	return err
+	return nil
+}
+
+// deleteProduct moves the product to the trash. Its tag assignments are
+// trashed along with it, stamped with the same time so restoreProduct can
+// tell them apart from assignments that were removed earlier. The trashed
+// assignments are returned.
+func (p *product) deleteProduct(db dbtx) ([]productToTagAssignment, error) {
+	rows, err := db.Query(`WITH trashed AS (
+			UPDATE products SET deleted_at = now() WHERE id=$1 AND deleted_at IS NULL RETURNING id, deleted_at
+		)
+		UPDATE productToTagAssignment SET deleted_at = trashed.deleted_at
+		FROM trashed WHERE productID = trashed.id AND productToTagAssignment.deleted_at IS NULL
+		RETURNING productToTagAssignment.id, productID, tagID`, p.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAssignments(rows)
+}
+
+// restoreProduct takes the product out of the trash together with the
+// assignments that were trashed with it, as long as their tag still exists.
+// The restored assignments are returned.
+func (p *product) restoreProduct(db dbtx) ([]productToTagAssignment, error) {
+	var deletedAt time.Time
+	err := db.QueryRow(`UPDATE products SET deleted_at = NULL
+		FROM (SELECT id, deleted_at FROM products WHERE id=$1 FOR UPDATE) old
+		WHERE products.id = old.id AND old.deleted_at IS NOT NULL
+		RETURNING products.name, products.price, old.deleted_at`, p.ID).Scan(&p.Name, &p.Price, &deletedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`UPDATE productToTagAssignment pta SET deleted_at = NULL
+		WHERE pta.productID=$1 AND pta.deleted_at=$2
+		AND EXISTS (SELECT 1 FROM tag WHERE tag.id = pta.tagID AND tag.deleted_at IS NULL)
+		AND NOT EXISTS (SELECT 1 FROM productToTagAssignment active
+			WHERE active.productID = pta.productID AND active.tagID = pta.tagID AND active.deleted_at IS NULL)
+		RETURNING pta.id, pta.productID, pta.tagID`,
+		p.ID, deletedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAssignments(rows)
 }
 
-func (p *product) createProduct(db *sql.DB) error {
+func (p *product) createProduct(db dbtx) error {
 	err := db.QueryRow(
 		"INSERT INTO products(name, price) VALUES($1, $2) RETURNING id",
 		p.Name, p.Price).Scan(&p.ID)
@@ -43,10 +230,17 @@ func (p *product) createProduct(db *sql.DB) error {
 	return nil
 }
 
-func getProducts(db *sql.DB, start, count int) ([]product, error) {
+// getProducts returns a page of products. filter may be nil.
+func getProducts(db dbtx, start, count int, deleted deletedFilter, filter filterExpr) ([]product, error) {
+	args := []interface{}{count, start}
+	condition := deleted.condition("products")
+	if filter != nil {
+		condition += " AND " + filter.sql(&args)
+	}
+
 	rows, err := db.Query(
-		"SELECT id, name,  price FROM products LIMIT $1 OFFSET $2",
-		count, start)
+		"SELECT id, name,  price, deleted_at FROM products WHERE "+condition+" LIMIT $1 OFFSET $2",
+		args...)
 
 	if err != nil {
 		return nil, err
@@ -58,7 +252,7 @@ func getProducts(db *sql.DB, start, count int) ([]product, error) {
 
 	for rows.Next() {
 		var p product
-		if err := rows.Scan(&p.ID, &p.Name, &p.Price); err != nil {
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.DeletedAt); err != nil {
 			return nil, err
 		}
 		products = append(products, p)
@@ -67,42 +261,242 @@ func getProducts(db *sql.DB, start, count int) ([]product, error) {
 	return products, nil
 }
 
+// createProducts inserts all products with a single statement and sets
+// their IDs. The IDs are drawn from the sequence up front so they follow
+// the order of products; products that have an ID already keep it, see
+// reserveIDs.
+func createProducts(db dbtx, products []product) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	unnumbered := []*product{}
+	for i := range products {
+		if products[i].ID == 0 {
+			unnumbered = append(unnumbered, &products[i])
+		}
+	}
+
+	rows, err := db.Query("SELECT nextval(pg_get_serial_sequence('products', 'id')) FROM generate_series(1, $1) ORDER BY 1", len(unnumbered))
+	if err != nil {
+		return err
+	}
+	for i := 0; rows.Next(); i++ {
+		if err := rows.Scan(&unnumbered[i].ID); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	records, err := json.Marshal(products)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO products(id, name, price)
+		SELECT id, name, price FROM jsonb_to_recordset($1::jsonb) AS (id integer, name TEXT, price NUMERIC(10,2))`,
+		string(records))
+
+	return err
+}
+
+// getProductsForUpdate loads and locks the active products among ids. IDs
+// that are missing or in the trash are left out of the result.
+func getProductsForUpdate(tx *sql.Tx, ids []int) (map[int]product, error) {
+	rows, err := tx.Query("SELECT id, name, price FROM products WHERE id = ANY($1) AND deleted_at IS NULL ORDER BY id FOR UPDATE",
+		pq.Array(ids))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	products := map[int]product{}
+
+	for rows.Next() {
+		var p product
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price); err != nil {
+			return nil, err
+		}
+		products[p.ID] = p
+	}
+
+	return products, rows.Err()
+}
+
+// updateProducts writes the name and price of all products with a single
+// statement. The products must have been locked with getProductsForUpdate.
+func updateProducts(db dbtx, products []product) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	records, err := json.Marshal(products)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE products SET name = u.name, price = u.price
+		FROM jsonb_to_recordset($1::jsonb) AS u(id integer, name TEXT, price NUMERIC(10,2))
+		WHERE products.id = u.id AND products.deleted_at IS NULL`,
+		string(records))
+
+	return err
+}
+
+// deleteProducts moves the active products among ids to the trash, like
+// deleteProduct does for a single one, and returns the trashed assignments.
+func deleteProducts(db dbtx, ids []int) ([]productToTagAssignment, error) {
+	rows, err := db.Query(`WITH trashed AS (
+			UPDATE products SET deleted_at = now() WHERE id = ANY($1) AND deleted_at IS NULL RETURNING id, deleted_at
+		)
+		UPDATE productToTagAssignment SET deleted_at = trashed.deleted_at
+		FROM trashed WHERE productID = trashed.id AND productToTagAssignment.deleted_at IS NULL
+		RETURNING productToTagAssignment.id, productID, tagID`, pq.Array(ids))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAssignments(rows)
+}
+
 //###########################################################
 
 type tag struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentID *int   `json:"parentId,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Value    string `json:"value,omitempty"`
+	// Rule is the filter expression selecting the products of a smart tag,
+	// see rules.go
+	Rule      string     `json:"rule,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// tagInput is the body of a PUT request for a tag. Leaving out parentId makes
+// the tag a top-level one, leaving out key and value a plain one and leaving
+// out rule one that is assigned by hand.
+type tagInput struct {
+	Name     *string `json:"name"`
+	ParentID *int    `json:"parentId"`
+	Key      string  `json:"key"`
+	Value    string  `json:"value"`
+	Rule     string  `json:"rule"`
+}
+
+func (in tagInput) missingFields() []string {
+	missing := []string{}
+	if in.Name == nil {
+		missing = append(missing, "name")
+	}
+
+	return missing
+}
+
+func (t *tag) getTag(db dbtx) error {
+	return db.QueryRow("SELECT name, parent_id, key, value, rule FROM tag WHERE id=$1 AND deleted_at IS NULL",
+		t.ID).Scan(&t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule)
 }
 
-func (t *tag) getTag(db *sql.DB) error {
-	return db.QueryRow("SELECT name FROM tag WHERE id=$1",
-		t.ID).Scan(&t.Name)
+// getTagForUpdate loads the tag and locks its row until the surrounding
+// transaction ends.
+func (t *tag) getTagForUpdate(tx *sql.Tx) error {
+	return tx.QueryRow("SELECT name, parent_id, key, value, rule FROM tag WHERE id=$1 AND deleted_at IS NULL FOR UPDATE",
+		t.ID).Scan(&t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule)
 }
 
 // Additional way to retrieve categories, plus check to avoid duplicate names (setting the column to unqiue in the actual database is also possible)
-func (t *tag) getTagByName(db *sql.DB) error {
-	return db.QueryRow("SELECT id FROM tag WHERE LOWER(name)=LOWER($1)",
+// A name that is an alias finds the tag it stands for.
+func (t *tag) getTagByName(db dbtx) error {
+	return db.QueryRow(`SELECT id FROM (
+			SELECT id, 0 AS rank FROM tag WHERE LOWER(name)=LOWER($1) AND deleted_at IS NULL
+			UNION ALL
+			SELECT tag.id, 1 FROM tag_alias JOIN tag ON tag.id = tag_alias.tag_id
+			WHERE LOWER(tag_alias.alias)=LOWER($1) AND tag.deleted_at IS NULL
+		) named ORDER BY rank, id LIMIT 1`,
 		t.Name).Scan(&t.ID)
 }
 
-func (t *tag) updateTag(db *sql.DB) error {
-	_, err :=
-		db.Exec("UPDATE tag SET name=$1 WHERE id=$2",
-			t.Name, t.ID)
+func (t *tag) updateTag(db dbtx) error {
+	res, err :=
+		db.Exec("UPDATE tag SET name=$1, parent_id=$2, key=$3, value=$4, rule=$5 WHERE id=$6 AND deleted_at IS NULL",
+			t.Name, t.ParentID, t.Key, t.Value, t.Rule, t.ID)
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	return expectRowsAffected(res)
+}
+
+func (t *tag) validate() error {
+	if strings.TrimSpace(t.Name) == "" {
+		return validationError("Tag name must not be empty")
+	}
+	if strings.Contains(t.Name, tagSeparator) {
+		return validationError("Tag name must not contain " + strconv.Quote(tagSeparator))
+	}
+
+	return nil
 }
 
-func (t *tag) deleteTag(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM tag WHERE id=$1", t.ID)
+// deleteTag moves the tag and its assignments to the trash, see deleteProduct.
+func (t *tag) deleteTag(db dbtx) ([]productToTagAssignment, error) {
+	rows, err := db.Query(`WITH trashed AS (
+			UPDATE tag SET deleted_at = now() WHERE id=$1 AND deleted_at IS NULL RETURNING id, deleted_at
+		)
+		UPDATE productToTagAssignment SET deleted_at = trashed.deleted_at
+		FROM trashed WHERE tagID = trashed.id AND productToTagAssignment.deleted_at IS NULL
+		RETURNING productToTagAssignment.id, productID, tagID`, t.ID)
 
-	return err
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAssignments(rows)
+}
+
+// restoreTag takes the tag out of the trash together with the assignments
+// that were trashed with it, as long as their product still exists.
+func (t *tag) restoreTag(db dbtx) ([]productToTagAssignment, error) {
+	var deletedAt time.Time
+	err := db.QueryRow(`UPDATE tag SET deleted_at = NULL
+		FROM (SELECT id, deleted_at FROM tag WHERE id=$1 FOR UPDATE) old
+		WHERE tag.id = old.id AND old.deleted_at IS NOT NULL
+		RETURNING tag.name, tag.parent_id, tag.key, tag.value, tag.rule, old.deleted_at`, t.ID).Scan(&t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule, &deletedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`UPDATE productToTagAssignment pta SET deleted_at = NULL
+		WHERE pta.tagID=$1 AND pta.deleted_at=$2
+		AND EXISTS (SELECT 1 FROM products WHERE products.id = pta.productID AND products.deleted_at IS NULL)
+		AND NOT EXISTS (SELECT 1 FROM productToTagAssignment active
+			WHERE active.productID = pta.productID AND active.tagID = pta.tagID AND active.deleted_at IS NULL)
+		RETURNING pta.id, pta.productID, pta.tagID`,
+		t.ID, deletedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAssignments(rows)
 }
 
-func (c *tag) createTag(db *sql.DB) error {
+// createTag inserts the tag under a new ID, or under c.ID if it is set, see
+// reserveIDs.
+func (c *tag) createTag(db dbtx) error {
 	err := db.QueryRow(
-		"INSERT INTO tag(name) VALUES($1) RETURNING id",
-		c.Name).Scan(&c.ID)
+		"INSERT INTO tag(id, name, parent_id, key, value, rule) VALUES(COALESCE(NULLIF($1, 0), nextval(pg_get_serial_sequence('tag', 'id'))), $2, $3, $4, $5, $6) RETURNING id",
+		c.ID, c.Name, c.ParentID, c.Key, c.Value, c.Rule).Scan(&c.ID)
 
 	if err != nil {
 		return err
@@ -111,9 +505,9 @@ func (c *tag) createTag(db *sql.DB) error {
 	return nil
 }
 
-func getTags(db *sql.DB, start, count int) ([]tag, error) {
+func getTags(db dbtx, start, count int, deleted deletedFilter) ([]tag, error) {
 	rows, err := db.Query(
-		"SELECT id, name FROM tag LIMIT $1 OFFSET $2",
+		"SELECT id, name, parent_id, key, value, rule, deleted_at FROM tag WHERE "+deleted.condition("tag")+" LIMIT $1 OFFSET $2",
 		count, start)
 
 	if err != nil {
@@ -126,7 +520,7 @@ func getTags(db *sql.DB, start, count int) ([]tag, error) {
 
 	for rows.Next() {
 		var t tag
-		if err := rows.Scan(&t.ID, &t.Name); err != nil {
+		if err := rows.Scan(&t.ID, &t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule, &t.DeletedAt); err != nil {
 			return nil, err
 		}
 		tags = append(tags, t)
@@ -135,25 +529,58 @@ func getTags(db *sql.DB, start, count int) ([]tag, error) {
 	return tags, nil
 }
 
+// expectRowsAffected turns an update that matched no row into sql.ErrNoRows,
+// so handlers can answer with 404 the same way they do for lookups.
+func expectRowsAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
 type productToTagAssignment struct {
 	ID        int `json:"id"`
 	ProductID int `json:"productID"`
 	TagID     int `json:"tagID"`
 }
 
-func (pta *productToTagAssignment) getProductToTagAssignment(db *sql.DB) error {
-	return db.QueryRow("SELECT id, productID, tagID FROM productToTagAssignment WHERE productID=$1 AND tagID=$2", pta.ProductID, pta.TagID).Scan(&pta.ID, &pta.ProductID, &pta.TagID)
+func scanAssignments(rows *sql.Rows) ([]productToTagAssignment, error) {
+	defer rows.Close()
+
+	assignments := []productToTagAssignment{}
+
+	for rows.Next() {
+		var pta productToTagAssignment
+		if err := rows.Scan(&pta.ID, &pta.ProductID, &pta.TagID); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, pta)
+	}
+
+	return assignments, rows.Err()
+}
+
+func (pta *productToTagAssignment) getProductToTagAssignment(db dbtx) error {
+	return db.QueryRow("SELECT id, productID, tagID FROM productToTagAssignment WHERE productID=$1 AND tagID=$2 AND deleted_at IS NULL", pta.ProductID, pta.TagID).Scan(&pta.ID, &pta.ProductID, &pta.TagID)
 }
 
-func (pta *productToTagAssignment) deleteProductToTagAssignmentByProductAndTag(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM productToTagAssignment WHERE productID=$1 AND tagID=$2", pta.ProductID, pta.TagID)
+func (pta *productToTagAssignment) deleteProductToTagAssignmentByProductAndTag(db dbtx) error {
+	_, err := db.Exec("DELETE FROM productToTagAssignment WHERE productID=$1 AND tagID=$2 AND deleted_at IS NULL", pta.ProductID, pta.TagID)
 
 	return err
 }
 
-func (pta *productToTagAssignment) createProductToTagAssignment(db *sql.DB) error {
+func (pta *productToTagAssignment) createProductToTagAssignment(db dbtx) error {
+	// Trashed products and tags cannot be tagged; sql.ErrNoRows reports that.
 	err := db.QueryRow(
-		"INSERT INTO productToTagAssignment(productID,tagID) VALUES($1,$2) RETURNING id",
+		`INSERT INTO productToTagAssignment(productID,tagID) SELECT $1,$2
+		WHERE EXISTS (SELECT 1 FROM products WHERE id=$1 AND deleted_at IS NULL)
+		AND EXISTS (SELECT 1 FROM tag WHERE id=$2 AND deleted_at IS NULL) RETURNING id`,
 		pta.ProductID, pta.TagID).Scan(&pta.ID)
 
 	if err != nil {
@@ -163,9 +590,140 @@ func (pta *productToTagAssignment) createProductToTagAssignment(db *sql.DB) erro
 	return nil
 }
 
-func getTagsAssignedToProduct(db *sql.DB, productID, start, count int) ([]tag, error) {
+// lockActiveIDs returns which of ids belong to active rows of table and
+// keeps those rows from being deleted until the transaction ends.
+func lockActiveIDs(tx *sql.Tx, table string, ids []int) (map[int]bool, error) {
+	rows, err := tx.Query("SELECT id FROM "+table+" WHERE id = ANY($1) AND deleted_at IS NULL FOR SHARE", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	found := map[int]bool{}
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		found[id] = true
+	}
+
+	return found, rows.Err()
+}
+
+// lockIDs locks the rows of table with the given IDs, whether they are in
+// the trash or not, and tells for each one found whether it is.
+func lockIDs(tx *sql.Tx, table string, ids []int) (map[int]bool, error) {
+	rows, err := tx.Query("SELECT id, deleted_at IS NOT NULL FROM "+table+" WHERE id = ANY($1) FOR UPDATE", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	trashed := map[int]bool{}
+
+	for rows.Next() {
+		var id int
+		var deleted bool
+		if err := rows.Scan(&id, &deleted); err != nil {
+			return nil, err
+		}
+		trashed[id] = deleted
+	}
+
+	return trashed, rows.Err()
+}
+
+// reserveIDs moves the ID sequence of table past id before rows are
+// inserted with IDs of their own, so the sequence does not hand them out
+// again.
+func reserveIDs(db dbtx, table string, id int) error {
+	_, err := db.Exec("SELECT setval(pg_get_serial_sequence($1, 'id'), GREATEST($2::bigint, nextval(pg_get_serial_sequence($1, 'id'))))", table, id)
+	return err
+}
+
+// getAssignmentsOf returns the active assignments of a product or a tag,
+// depending on whether column is productID or tagID.
+func getAssignmentsOf(db dbtx, column string, id int) ([]productToTagAssignment, error) {
+	rows, err := db.Query("SELECT id, productID, tagID FROM productToTagAssignment WHERE "+column+"=$1 AND deleted_at IS NULL ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAssignments(rows)
+}
+
+// createAssignments inserts all assignments with a single statement and
+// returns them with their IDs, in order.
+func createAssignments(db dbtx, assignments []productToTagAssignment) ([]productToTagAssignment, error) {
+	if len(assignments) == 0 {
+		return []productToTagAssignment{}, nil
+	}
+
+	records, err := json.Marshal(assignments)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`INSERT INTO productToTagAssignment(productID, tagID)
+		SELECT productID, tagID
+		FROM ROWS FROM (jsonb_to_recordset($1::jsonb) AS ("productID" integer, "tagID" integer))
+		WITH ORDINALITY AS x(productID, tagID, n)
+		ORDER BY n
+		RETURNING id, productID, tagID`, string(records))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAssignments(rows)
+}
+
+func deleteAssignments(db dbtx, assignments []productToTagAssignment) error {
+	if len(assignments) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(assignments))
+	for i, pta := range assignments {
+		ids[i] = pta.ID
+	}
+
+	_, err := db.Exec("DELETE FROM productToTagAssignment WHERE id = ANY($1) AND deleted_at IS NULL", pq.Array(ids))
+
+	return err
+}
+
+// getProductIDsMatching returns the IDs of the active products matching a
+// filter expression.
+func getProductIDsMatching(db dbtx, filter filterExpr) ([]int, error) {
+	args := []interface{}{}
+	rows, err := db.Query("SELECT products.id FROM products WHERE products.deleted_at IS NULL AND "+filter.sql(&args)+" ORDER BY products.id", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ids := []int{}
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func getTagsAssignedToProduct(db dbtx, productID, start, count int) ([]tag, error) {
 	rows, err := db.Query(
-		"SELECT tag.id, tag.name FROM tag INNER JOIN productToTagAssignment ON tag.id = tagID WHERE productID=$1 LIMIT $2 OFFSET $3",
+		"SELECT tag.id, tag.name, tag.parent_id, tag.key, tag.value, tag.rule FROM tag INNER JOIN productToTagAssignment ON tag.id = tagID WHERE productID=$1 AND productToTagAssignment.deleted_at IS NULL AND tag.deleted_at IS NULL ORDER BY position_in_product NULLS LAST, productToTagAssignment.id LIMIT $2 OFFSET $3",
 		productID, count, start)
 
 	if err != nil {
@@ -178,7 +736,7 @@ func getTagsAssignedToProduct(db *sql.DB, productID, start, count int) ([]tag, e
 
 	for rows.Next() {
 		var t tag
-		if err := rows.Scan(&t.ID, &t.Name); err != nil {
+		if err := rows.Scan(&t.ID, &t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule); err != nil {
 			return nil, err
 		}
 		tagsAssignedToProduct = append(tagsAssignedToProduct, t)
@@ -187,10 +745,25 @@ func getTagsAssignedToProduct(db *sql.DB, productID, start, count int) ([]tag, e
 	return tagsAssignedToProduct, nil
 }
 
-func getProductsWithTagAssigned(db *sql.DB, tagID, start, count int) ([]product, error) {
-	rows, err := db.Query(
-		"SELECT products.id, products.name, products.price FROM products INNER JOIN productToTagAssignment ON products.id = productID WHERE tagID=$1 LIMIT $2 OFFSET $3",
-		tagID, count, start)
+// getProductsWithTagAssigned returns a page of the products with the tag, in
+// the order of the tag.
+// With descendants it also returns, once each and ordered by ID, the products
+// with any tag below it in the hierarchy.
+func getProductsWithTagAssigned(db dbtx, tagID, start, count int, descendants bool) ([]product, error) {
+	query := "SELECT products.id, products.name, products.price FROM products INNER JOIN productToTagAssignment ON products.id = productID WHERE tagID=$1 AND productToTagAssignment.deleted_at IS NULL AND products.deleted_at IS NULL ORDER BY position_in_tag NULLS LAST, productToTagAssignment.id LIMIT $2 OFFSET $3"
+	if descendants {
+		query = `WITH RECURSIVE subtree(id) AS (
+				SELECT $1::integer
+				UNION
+				SELECT tag.id FROM tag JOIN subtree ON tag.parent_id = subtree.id WHERE tag.deleted_at IS NULL
+			)
+			SELECT products.id, products.name, products.price FROM products
+			WHERE products.deleted_at IS NULL AND EXISTS (SELECT 1 FROM productToTagAssignment pta
+				WHERE pta.productID = products.id AND pta.tagID IN (SELECT id FROM subtree) AND pta.deleted_at IS NULL)
+			ORDER BY products.id LIMIT $2 OFFSET $3`
+	}
+
+	rows, err := db.Query(query, tagID, count, start)
 
 	if err != nil {
 		return nil, err
@@ -210,3 +783,187 @@ func getProductsWithTagAssigned(db *sql.DB, tagID, start, count int) ([]product,
 
 	return productsWithTagAssigned, nil
 }
+
+// getProductsAfter returns up to limit active products with an ID above
+// afterID, ordered by ID. filter may be nil.
+func getProductsAfter(db dbtx, afterID, limit int, filter filterExpr) ([]product, error) {
+	args := []interface{}{limit, afterID}
+	condition := "products.deleted_at IS NULL AND products.id > $2"
+	if filter != nil {
+		condition += " AND " + filter.sql(&args)
+	}
+
+	rows, err := db.Query("SELECT id, name, price FROM products WHERE "+condition+" ORDER BY id LIMIT $1", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	products := []product{}
+
+	for rows.Next() {
+		var p product
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price); err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	return products, rows.Err()
+}
+
+// countProducts counts the active products matching filter, which may be nil.
+func countProducts(db dbtx, filter filterExpr) (int, error) {
+	args := []interface{}{}
+	condition := "products.deleted_at IS NULL"
+	if filter != nil {
+		condition += " AND " + filter.sql(&args)
+	}
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM products WHERE "+condition, args...).Scan(&count)
+
+	return count, err
+}
+
+// getTagsAfter returns up to limit active tags with an ID above afterID,
+// ordered by ID.
+func getTagsAfter(db dbtx, afterID, limit int) ([]tag, error) {
+	rows, err := db.Query("SELECT id, name, parent_id, key, value, rule FROM tag WHERE deleted_at IS NULL AND id > $2 ORDER BY id LIMIT $1", limit, afterID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tags := []tag{}
+
+	for rows.Next() {
+		var t tag
+		if err := rows.Scan(&t.ID, &t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+
+	return tags, rows.Err()
+}
+
+func countTags(db dbtx) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM tag WHERE deleted_at IS NULL").Scan(&count)
+
+	return count, err
+}
+
+// getTagsOfProducts returns the active tags of each of the products with a
+// single query, in the order of the product. A tag assigned twice is
+// returned once.
+func getTagsOfProducts(db dbtx, productIDs []int) (map[int][]tag, error) {
+	rows, err := db.Query(`SELECT pta.productID, tag.id, tag.name, tag.parent_id, tag.key, tag.value, tag.rule
+		FROM productToTagAssignment pta JOIN tag ON tag.id = pta.tagID
+		WHERE pta.productID = ANY($1) AND pta.deleted_at IS NULL AND tag.deleted_at IS NULL
+		GROUP BY pta.productID, tag.id
+		ORDER BY pta.productID, MIN(pta.position_in_product) NULLS LAST, MIN(pta.id)`, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tags := map[int][]tag{}
+
+	for rows.Next() {
+		var productID int
+		var t tag
+		if err := rows.Scan(&productID, &t.ID, &t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule); err != nil {
+			return nil, err
+		}
+		tags[productID] = append(tags[productID], t)
+	}
+
+	return tags, rows.Err()
+}
+
+// getProductsOfTags returns, with a single query, a page of the active
+// products of each of the tags: up to limit products after the first offset
+// ones, in the order of the tag. It also returns how many products each tag
+// has in total.
+func getProductsOfTags(db dbtx, tagIDs []int, offset, limit int) (map[int][]product, map[int]int, error) {
+	rows, err := db.Query(`SELECT ids.tagID, counts.total, page.id, page.name, page.price
+		FROM unnest($1::integer[]) AS ids(tagID)
+		CROSS JOIN LATERAL (
+			SELECT COUNT(DISTINCT products.id) AS total
+			FROM productToTagAssignment pta JOIN products ON products.id = pta.productID
+			WHERE pta.tagID = ids.tagID AND pta.deleted_at IS NULL AND products.deleted_at IS NULL
+		) counts
+		LEFT JOIN LATERAL (
+			SELECT * FROM (
+				SELECT DISTINCT ON (products.id) products.id, products.name, products.price,
+					pta.position_in_tag, pta.id AS assignment_id
+				FROM productToTagAssignment pta JOIN products ON products.id = pta.productID
+				WHERE pta.tagID = ids.tagID AND pta.deleted_at IS NULL AND products.deleted_at IS NULL
+				ORDER BY products.id, pta.position_in_tag NULLS LAST, pta.id
+			) tagged
+			ORDER BY position_in_tag NULLS LAST, assignment_id OFFSET $2 LIMIT $3
+		) page ON true
+		ORDER BY ids.tagID, page.position_in_tag NULLS LAST, page.assignment_id`, pq.Array(tagIDs), offset, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	products := map[int][]product{}
+	totals := map[int]int{}
+
+	for rows.Next() {
+		var tagID, total int
+		var id sql.NullInt64
+		var name sql.NullString
+		var price sql.NullFloat64
+		if err := rows.Scan(&tagID, &total, &id, &name, &price); err != nil {
+			return nil, nil, err
+		}
+		totals[tagID] = total
+		if id.Valid {
+			products[tagID] = append(products[tagID], product{ID: int(id.Int64), Name: name.String, Price: price.Float64})
+		}
+	}
+
+	return products, totals, rows.Err()
+}
+
+// purgeDeleted permanently removes products, tags and assignments that were
+// moved to the trash before cutoff. It returns the purged IDs per entity.
+func purgeDeleted(db dbtx, cutoff time.Time) (map[string][]int, error) {
+	purged := map[string][]int{}
+
+	for _, entity := range []struct{ name, table string }{
+		{"assignment", "productToTagAssignment"},
+		{"product", "products"},
+		{"tag", "tag"},
+	} {
+		rows, err := db.Query("DELETE FROM "+entity.table+" WHERE deleted_at < $1 RETURNING id", cutoff)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			purged[entity.name] = append(purged[entity.name], id)
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return purged, nil
+}
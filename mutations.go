@@ -0,0 +1,223 @@
+// mutations.go
+
+package main
+
+import (
+	"database/sql"
+)
+
+// The mutations below run inside a transaction of inTx and record their
+// changes, so the REST handlers and the GraphQL resolvers change the catalog
+// in exactly the same way.
+
+func createProductTx(tx *sql.Tx, cs *changeSet, p *product) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if err := p.createProduct(tx); err != nil {
+		return err
+	}
+
+	cs.record("product", p.ID, "created", nil, *p)
+	return nil
+}
+
+// updateProductTx replaces the name and price of product p.ID.
+func updateProductTx(tx *sql.Tx, cs *changeSet, p product) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	current := product{ID: p.ID}
+	if err := current.getProductForUpdate(tx); err != nil {
+		return err
+	}
+	if err := p.updateProduct(tx); err != nil {
+		return err
+	}
+
+	cs.record("product", p.ID, "updated", current, p)
+	return nil
+}
+
+// deleteProductTx moves a product and its assignments to the trash.
+// Deleting a product that does not exist is not an error.
+func deleteProductTx(tx *sql.Tx, cs *changeSet, id int) error {
+	p := product{ID: id}
+	if err := p.getProductForUpdate(tx); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	trashed, err := p.deleteProduct(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, pta := range trashed {
+		cs.record("assignment", pta.ID, "deleted", pta, nil)
+	}
+	cs.record("product", id, "deleted", p, nil)
+	return nil
+}
+
+func restoreProductTx(tx *sql.Tx, cs *changeSet, p *product) error {
+	restored, err := p.restoreProduct(tx)
+	if err != nil {
+		return err
+	}
+
+	cs.record("product", p.ID, "restored", nil, *p)
+	for _, pta := range restored {
+		cs.record("assignment", pta.ID, "restored", nil, pta)
+	}
+	return nil
+}
+
+func createTagTx(tx *sql.Tx, cs *changeSet, t *tag) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if err := t.checkParent(tx); err != nil {
+		return err
+	}
+	if err := t.checkFacet(tx); err != nil {
+		return err
+	}
+	if err := t.checkRule(); err != nil {
+		return err
+	}
+	if err := t.createTag(tx); err != nil {
+		return err
+	}
+
+	cs.record("tag", t.ID, "created", nil, *t)
+	return nil
+}
+
+// updateTagTx replaces the name, parent, key, value and rule of tag t.ID.
+func updateTagTx(tx *sql.Tx, cs *changeSet, t tag) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	current := tag{ID: t.ID}
+	if err := current.getTagForUpdate(tx); err != nil {
+		return err
+	}
+	if err := t.checkParent(tx); err != nil {
+		return err
+	}
+	if err := t.checkFacet(tx); err != nil {
+		return err
+	}
+	if err := t.checkRule(); err != nil {
+		return err
+	}
+	if err := t.updateTag(tx); err != nil {
+		return err
+	}
+
+	cs.record("tag", t.ID, "updated", current, t)
+	return nil
+}
+
+// deleteTagTx moves a tag and its assignments to the trash. Deleting a tag
+// that does not exist is not an error.
+func deleteTagTx(tx *sql.Tx, cs *changeSet, id int) error {
+	t := tag{ID: id}
+	if err := t.getTagForUpdate(tx); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	trashed, err := t.deleteTag(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, pta := range trashed {
+		cs.record("assignment", pta.ID, "deleted", pta, nil)
+	}
+	cs.record("tag", id, "deleted", t, nil)
+	return nil
+}
+
+func restoreTagTx(tx *sql.Tx, cs *changeSet, t *tag) error {
+	restored, err := t.restoreTag(tx)
+	if err != nil {
+		return err
+	}
+
+	cs.record("tag", t.ID, "restored", nil, *t)
+	for _, pta := range restored {
+		cs.record("assignment", pta.ID, "restored", nil, pta)
+	}
+	return nil
+}
+
+// assignTagTx assigns tag pta.TagID to product pta.ProductID. Both must be
+// active, otherwise sql.ErrNoRows is returned, and the tag must not be a
+// smart one.
+func assignTagTx(tx *sql.Tx, cs *changeSet, pta *productToTagAssignment) error {
+	if err := checkHandAssigned(tx, pta.TagID); err != nil {
+		return err
+	}
+	if err := pta.createProductToTagAssignment(tx); err != nil {
+		return err
+	}
+
+	cs.record("assignment", pta.ID, "created", nil, *pta)
+	return nil
+}
+
+// unassignTagTx removes tag pta.TagID from product pta.ProductID. Removing
+// a tag that is not assigned is not an error, removing a smart tag is.
+func unassignTagTx(tx *sql.Tx, cs *changeSet, pta productToTagAssignment) error {
+	if err := checkHandAssigned(tx, pta.TagID); err != nil {
+		return err
+	}
+	if err := pta.getProductToTagAssignment(tx); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	if err := pta.deleteProductToTagAssignmentByProductAndTag(tx); err != nil {
+		return err
+	}
+
+	cs.record("assignment", pta.ID, "deleted", pta, nil)
+	return nil
+}
+
+// replaceTagsOfProductTx makes tagIDs the exact set of tags of a product.
+// Unknown tags make the whole mutation fail.
+func replaceTagsOfProductTx(tx *sql.Tx, cs *changeSet, productID int, tagIDs []int) (assignmentDiff, error) {
+	p := product{ID: productID}
+	if err := p.getProductForUpdate(tx); err != nil {
+		return newAssignmentDiff(), err
+	}
+
+	tagIDs = uniqueIDs(tagIDs)
+	found, err := lockActiveIDs(tx, "tag", tagIDs)
+	if err != nil {
+		return newAssignmentDiff(), err
+	}
+	missingTags := []int{}
+	for _, id := range tagIDs {
+		if !found[id] {
+			missingTags = append(missingTags, id)
+		}
+	}
+	if len(missingTags) > 0 {
+		return newAssignmentDiff(), missingIDsError("Tags", missingTags)
+	}
+
+	return setTagsOfProduct(tx, cs, productID, tagIDs)
+}
@@ -0,0 +1,344 @@
+// ndjson.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	ndjsonMediaType = "application/x-ndjson"
+	// ndjsonFetchSize is how many rows are fetched from the cursor, and
+	// ingested per transaction, at a time.
+	ndjsonFetchSize = 500
+)
+
+// ingestSummary is the response of the NDJSON ingest endpoints. It only
+// counts results, so ingesting keeps using the same memory however long the
+// stream is; the first failures are listed.
+type ingestSummary struct {
+	Received int           `json:"received"`
+	Created  int           `json:"created"`
+	Updated  int           `json:"updated"`
+	Failed   int           `json:"failed"`
+	Error    string        `json:"error,omitempty"`
+	Errors   []importError `json:"errors"`
+}
+
+func (s *ingestSummary) add(results []bulkResult) {
+	s.Received += len(results)
+
+	for _, r := range results {
+		switch {
+		case r.failed():
+			s.Failed++
+			if len(s.Errors) < importErrorsShown {
+				s.Errors = append(s.Errors, importError{Line: r.Index + 1, Error: r.Error})
+			}
+		case r.Status == http.StatusCreated:
+			s.Created++
+		default:
+			s.Updated++
+		}
+	}
+}
+
+// wantsNDJSON tells whether the client asked for or sent NDJSON.
+func wantsNDJSON(r *http.Request) bool {
+	return r.FormValue("format") == "ndjson" || strings.HasPrefix(r.Header.Get("Content-Type"), ndjsonMediaType)
+}
+
+// streamRows calls emit for every row of query. The rows are read through a
+// server-side cursor in a read-only snapshot, so the stream is consistent
+// and only ndjsonFetchSize rows are held at a time; flush is called after
+// each batch. query must not take parameters.
+func (a *App) streamRows(ctx context.Context, query string, scan func(*sql.Rows) (interface{}, error), emit func(interface{}) error, flush func()) error {
+	tx, err := a.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DECLARE row_stream NO SCROLL CURSOR FOR " + query); err != nil {
+		return err
+	}
+
+	for {
+		rows, err := tx.Query("FETCH FORWARD " + strconv.Itoa(ndjsonFetchSize) + " FROM row_stream")
+		if err != nil {
+			return err
+		}
+
+		n := 0
+		for rows.Next() {
+			v, err := scan(rows)
+			if err == nil {
+				err = emit(v)
+			}
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		flush()
+		if n < ndjsonFetchSize {
+			return nil
+		}
+	}
+}
+
+// streamNDJSON writes every row of query as a line of JSON, see streamRows.
+func (a *App) streamNDJSON(w http.ResponseWriter, r *http.Request, query string, scan func(*sql.Rows) (interface{}, error)) {
+	started := false
+	start := func() {
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", ndjsonMediaType)
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	err := a.streamRows(r.Context(), query, scan,
+		func(v interface{}) error {
+			start()
+			return encoder.Encode(v)
+		},
+		func() {
+			start()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+	if err != nil {
+		if !started {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// the status line is already sent, all we can do is cut the stream short
+		log.Printf("streaming NDJSON: %v", err)
+	}
+}
+
+func streamProductsQuery(deleted deletedFilter) string {
+	return "SELECT id, name, price, deleted_at FROM products WHERE " + deleted.condition("products") + " ORDER BY id"
+}
+
+func scanStreamedProduct(rows *sql.Rows) (interface{}, error) {
+	var p product
+	err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.DeletedAt)
+	return p, err
+}
+
+func streamTagsQuery(deleted deletedFilter) string {
+	return "SELECT id, name, parent_id, key, value, rule, deleted_at FROM tag WHERE " + deleted.condition("tag") + " ORDER BY id"
+}
+
+func scanStreamedTag(rows *sql.Rows) (interface{}, error) {
+	var t tag
+	err := rows.Scan(&t.ID, &t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule, &t.DeletedAt)
+	return t, err
+}
+
+func (a *App) streamProducts(w http.ResponseWriter, r *http.Request, deleted deletedFilter) {
+	a.streamNDJSON(w, r, streamProductsQuery(deleted), scanStreamedProduct)
+}
+
+func (a *App) streamTags(w http.ResponseWriter, r *http.Request, deleted deletedFilter) {
+	a.streamNDJSON(w, r, streamTagsQuery(deleted), scanStreamedTag)
+}
+
+// ingestNDJSON reads the request body line by line and applies every
+// ndjsonFetchSize lines in a transaction of their own. Lines without an id
+// create a row; lines with one are upserts, which update that row or
+// create it under that id, so an exported stream can be ingested into an
+// empty catalog.
+func (a *App) ingestNDJSON(w http.ResponseWriter, r *http.Request, apply func(tx *sql.Tx, cs *changeSet, ops []bulkOperation, results []bulkResult) error) {
+	if !wantsNDJSON(r) {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Send the rows as "+ndjsonMediaType)
+		return
+	}
+
+	reader, err := newBulkReader(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	summary := ingestSummary{Errors: []importError{}}
+
+	for {
+		// the lines read before a malformed one are still applied
+		ops, results, readErr := reader.next(ndjsonFetchSize)
+		if len(ops) > 0 {
+			for i := range ops {
+				ops[i].Op = "create"
+				if ops[i].ID != 0 {
+					ops[i].Op = "upsert"
+				}
+				results[i].Op = ops[i].Op
+			}
+
+			err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+				return apply(tx, cs, ops, results)
+			})
+			if err != nil {
+				// the batch was rolled back, so none of its lines took effect
+				for i := range results {
+					results[i].Status, results[i].Error = http.StatusInternalServerError, err.Error()
+				}
+			}
+			summary.add(results)
+		}
+
+		if readErr != nil {
+			summary.Error = readErr.Error()
+			break
+		}
+		if len(ops) == 0 {
+			break
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, summary)
+}
+
+func (a *App) ingestProducts(w http.ResponseWriter, r *http.Request) {
+	a.ingestNDJSON(w, r, applyProductIngestBatch)
+}
+
+func (a *App) ingestTags(w http.ResponseWriter, r *http.Request) {
+	a.ingestNDJSON(w, r, applyTagBatch)
+}
+
+// resolveUpserts turns the upserts of a batch into updates of the active
+// rows of table and creates keeping their id for the others. Rows in the
+// trash have to be restored first.
+func resolveUpserts(tx *sql.Tx, table, entity string, ops []bulkOperation, results []bulkResult) error {
+	ids := []int{}
+	for i, op := range ops {
+		if op.Op == "upsert" && !results[i].failed() {
+			ids = append(ids, op.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	trashed, err := lockIDs(tx, table, ids)
+	if err != nil {
+		return err
+	}
+
+	highest := 0
+	for i := range ops {
+		if ops[i].Op != "upsert" || results[i].failed() {
+			continue
+		}
+
+		inTrash, found := trashed[ops[i].ID]
+		switch {
+		case ops[i].ID < 1:
+			results[i].Status, results[i].Error = http.StatusBadRequest, "Invalid "+strings.ToLower(entity)+" ID"
+		case inTrash:
+			results[i].Status, results[i].Error = http.StatusConflict, entity+" "+strconv.Itoa(ops[i].ID)+" is in the trash, restore it first"
+		case found:
+			ops[i].Op = "update"
+		default:
+			ops[i].Op, ops[i].keepID = "create", true
+			// a later line with the same id updates it
+			trashed[ops[i].ID] = false
+			if ops[i].ID > highest {
+				highest = ops[i].ID
+			}
+		}
+		results[i].Op = ops[i].Op
+	}
+
+	if highest == 0 {
+		return nil
+	}
+	return reserveIDs(tx, table, highest)
+}
+
+// applyProductIngestBatch applies an ingest batch of products like a bulk
+// request, once its upserts are resolved.
+func applyProductIngestBatch(tx *sql.Tx, cs *changeSet, ops []bulkOperation, results []bulkResult) error {
+	if err := resolveUpserts(tx, "products", "Product", ops, results); err != nil {
+		return err
+	}
+
+	return applyBulkBatch(tx, cs, ops, results)
+}
+
+// applyTagBatch creates and updates the tags of an ingest batch one by one;
+// tags are few and small compared to products. Lines are read like the
+// tags of an export: fields left out of an update keep their value.
+func applyTagBatch(tx *sql.Tx, cs *changeSet, ops []bulkOperation, results []bulkResult) error {
+	if err := resolveUpserts(tx, "tag", "Tag", ops, results); err != nil {
+		return err
+	}
+
+	for i, op := range ops {
+		if results[i].failed() {
+			continue
+		}
+		if op.Name == nil {
+			results[i].Status, results[i].Error = http.StatusBadRequest, "Missing required fields: name"
+			continue
+		}
+
+		t := tag{ID: op.ID}
+		if op.Op == "update" {
+			if err := t.getTagForUpdate(tx); err != nil && err != sql.ErrNoRows {
+				return err
+			}
+		}
+		if err := json.Unmarshal(op.raw, &t); err != nil {
+			results[i].Status, results[i].Error = http.StatusBadRequest, "Invalid operation payload"
+			continue
+		}
+		// ingesting does not move tags in or out of the trash
+		t.DeletedAt = nil
+
+		var err error
+		if op.Op == "update" {
+			err = updateTagTx(tx, cs, t)
+			results[i].Status = http.StatusOK
+		} else {
+			err = createTagTx(tx, cs, &t)
+			results[i].ID, results[i].Status = t.ID, http.StatusCreated
+		}
+
+		var invalid validationError
+		var missing notFoundError
+		switch {
+		case errors.As(err, &invalid):
+			results[i].Status, results[i].Error = http.StatusUnprocessableEntity, err.Error()
+		case err == sql.ErrNoRows:
+			results[i].Status, results[i].Error = http.StatusNotFound, "Tag not found"
+		case errors.As(err, &missing):
+			results[i].Status, results[i].Error = http.StatusNotFound, err.Error()
+		case err != nil:
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+// ndjson_test.go
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStreamProductsNDJSON(t *testing.T) {
+	clearTable()
+	addProducts(ndjsonFetchSize + 20)
+
+	req, _ := http.NewRequest("GET", "/products?format=ndjson", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if ct := response.Header().Get("Content-Type"); ct != ndjsonMediaType {
+		t.Errorf("Expected content type %s. Got %s", ndjsonMediaType, ct)
+	}
+
+	n := 0
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		var p product
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if p.ID != n {
+			t.Fatalf("Expected product %d on line %d. Got %s", n, n, scanner.Text())
+		}
+	}
+	if n != ndjsonFetchSize+20 {
+		t.Errorf("Expected all %d products beyond the page size. Got %d", ndjsonFetchSize+20, n)
+	}
+}
+
+func TestStreamTagsNDJSON(t *testing.T) {
+	clearTable()
+	addTags(12)
+
+	req, _ := http.NewRequest("DELETE", "/tag/12", nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("GET", "/tags?format=ndjson", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if lines := strings.Count(response.Body.String(), "\n"); lines != 11 {
+		t.Errorf("Expected the 11 active tags. Got %d lines", lines)
+	}
+}
+
+func TestIngestProductsNDJSON(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	body := strings.Join([]string{
+		`{"name":"ingested", "price": 5}`,
+		`{"id": 1, "name":"synced", "price": 7}`,
+		`{"id": 5, "name":"upserted", "price": 1}`,
+		`{"name":"", "price": 1}`,
+	}, "\n")
+
+	req, _ := http.NewRequest("POST", "/products", strings.NewReader(body))
+	req.Header.Set("Content-Type", ndjsonMediaType)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var summary ingestSummary
+	json.Unmarshal(response.Body.Bytes(), &summary)
+	if summary.Received != 4 || summary.Created != 2 || summary.Updated != 1 || summary.Failed != 1 {
+		t.Fatalf("Expected 2 created, 1 updated and 1 failed line. Got %s", response.Body.String())
+	}
+	if summary.Errors[0].Line != 4 {
+		t.Errorf("Expected line 4 to fail. Got %+v", summary.Errors)
+	}
+
+	p := product{ID: 5}
+	if err := p.getProduct(a.DB); err != nil || p.Name != "upserted" {
+		t.Errorf("Expected product 5 to be created under its id. Got %+v %v", p, err)
+	}
+
+	req, _ = http.NewRequest("POST", "/products", strings.NewReader(body))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnsupportedMediaType, response.Code)
+}
+
+func TestIngestStopsAtMalformedLine(t *testing.T) {
+	clearTable()
+
+	// the malformed line sits in the middle of the first batch
+	body := strings.Join([]string{
+		`{"name":"first", "price": 1}`,
+		`{"name":"second", "price": 2}`,
+		`{"name": nope}`,
+		`{"name":"never read", "price": 3}`,
+	}, "\n")
+
+	req, _ := http.NewRequest("POST", "/products", strings.NewReader(body))
+	req.Header.Set("Content-Type", ndjsonMediaType)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var summary ingestSummary
+	json.Unmarshal(response.Body.Bytes(), &summary)
+	if summary.Received != 2 || summary.Created != 2 || summary.Error == "" {
+		t.Errorf("Expected the two lines before the malformed one to be created. Got %s", response.Body.String())
+	}
+
+	products, _ := getProductsAfter(a.DB, 0, 10, nil)
+	if len(products) != 2 {
+		t.Errorf("Expected two products. Got %v", products)
+	}
+}
+
+func TestIngestTagsNDJSON(t *testing.T) {
+	clearTable()
+	addTags(1)
+
+	req, _ := http.NewRequest("POST", "/tags?format=ndjson", strings.NewReader("{\"id\":1,\"name\":\"renamed\"}\n{\"name\":\"new\"}\n"))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var summary ingestSummary
+	json.Unmarshal(response.Body.Bytes(), &summary)
+	if summary.Created != 1 || summary.Updated != 1 || summary.Failed != 0 {
+		t.Errorf("Expected one created and one updated tag. Got %s", response.Body.String())
+	}
+}
+
+func TestIngestExportedNDJSON(t *testing.T) {
+	clearTable()
+	addProducts(2)
+	addTags(2)
+	req, _ := http.NewRequest("PUT", "/tag/2", strings.NewReader(`{"name":"red","parentId":1,"key":"color","value":"red"}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	exported := map[string]string{}
+	for _, path := range []string{"/tags", "/products"} {
+		req, _ := http.NewRequest("GET", path+"?format=ndjson", nil)
+		exported[path] = executeRequest(req).Body.String()
+	}
+
+	clearTable()
+	for _, path := range []string{"/tags", "/products"} {
+		req, _ := http.NewRequest("POST", path, strings.NewReader(exported[path]))
+		req.Header.Set("Content-Type", ndjsonMediaType)
+		response := executeRequest(req)
+
+		var summary ingestSummary
+		json.Unmarshal(response.Body.Bytes(), &summary)
+		if summary.Created != 2 || summary.Failed != 0 {
+			t.Errorf("Expected the export of %s to be created again. Got %s", path, response.Body.String())
+		}
+	}
+
+	tg := tag{ID: 2}
+	if err := tg.getTag(a.DB); err != nil || tg.ParentID == nil || *tg.ParentID != 1 || tg.Key != "color" {
+		t.Errorf("Expected tag 2 to keep its parent and facet. Got %+v %v", tg, err)
+	}
+
+	// new rows get IDs after the ingested ones
+	req, _ = http.NewRequest("POST", "/product", strings.NewReader(`{"name":"new","price":1}`))
+	response := executeRequest(req)
+	var p product
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.ID != 3 {
+		t.Errorf("Expected the new product to get ID 3. Got %s", response.Body.String())
+	}
+}
@@ -0,0 +1,239 @@
+// negotiate.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// responseEncoder serialises the payloads handlers pass to respondWithJSON.
+type responseEncoder struct {
+	format    string
+	mediaType string
+	encode    func(payload interface{}) ([]byte, error)
+}
+
+var jsonEncoder = &responseEncoder{format: "json", mediaType: "application/json", encode: json.Marshal}
+
+// responseEncoders is the registry of response formats, selected with
+// ?format= or by the Accept header. The first one is the default.
+var responseEncoders = []*responseEncoder{
+	jsonEncoder,
+	{format: "xml", mediaType: "application/xml", encode: encodeXML},
+	{format: "csv", mediaType: "text/csv", encode: encodeCSV},
+	{format: "msgpack", mediaType: "application/msgpack", encode: encodeMsgpack},
+}
+
+// encoderAliases are further media types accepted for a format.
+var encoderAliases = map[string]string{
+	"text/xml":                "xml",
+	"application/x-msgpack":   "msgpack",
+	"application/vnd.msgpack": "msgpack",
+}
+
+// streamingFormats are produced by the handlers themselves, e.g. the event
+// stream, so the negotiation leaves the response alone when they are asked
+// for.
+var streamingFormats = map[string]string{
+	"ndjson": ndjsonMediaType,
+	"sse":    "text/event-stream",
+}
+
+// requestDecoders turn request bodies into JSON, so handlers only ever
+// decode JSON. Media types that handlers read themselves, like CSV uploads
+// and patch documents, are passed through.
+var requestDecoders = map[string]func(body []byte) ([]byte, error){
+	"application/xml":         decodeXML,
+	"text/xml":                decodeXML,
+	"application/msgpack":     decodeMsgpack,
+	"application/x-msgpack":   decodeMsgpack,
+	"application/vnd.msgpack": decodeMsgpack,
+}
+
+var passThroughBodies = map[string]bool{
+	"":                                  true,
+	"application/json":                  true,
+	mergePatchMediaType:                 true,
+	jsonPatchMediaType:                  true,
+	ndjsonMediaType:                     true,
+	"text/csv":                          true,
+	"text/plain":                        true,
+	"application/x-www-form-urlencoded": true,
+}
+
+func encoderFor(name string) *responseEncoder {
+	if alias, ok := encoderAliases[name]; ok {
+		name = alias
+	}
+	for _, e := range responseEncoders {
+		if e.format == name || e.mediaType == name {
+			return e
+		}
+	}
+
+	return nil
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns the media ranges of an Accept header, most preferred
+// first. Ranges with q=0 are left out.
+func parseAccept(header string) []acceptRange {
+	ranges := []acceptRange{}
+
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, acceptRange{mediaType, q})
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	return ranges
+}
+
+// negotiateEncoder picks the encoder for a request. It returns nil and true
+// when a streaming format was asked for, and false when nothing the client
+// accepts can be produced.
+func negotiateEncoder(r *http.Request) (*responseEncoder, bool) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := streamingFormats[format]; ok {
+			return nil, true
+		}
+		e := encoderFor(format)
+		return e, e != nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return jsonEncoder, true
+	}
+
+	for _, ar := range parseAccept(accept) {
+		for _, mediaType := range streamingFormats {
+			if ar.mediaType == mediaType {
+				return nil, true
+			}
+		}
+
+		switch {
+		case ar.mediaType == "*/*", ar.mediaType == "application/*":
+			return jsonEncoder, true
+		case strings.HasSuffix(ar.mediaType, "/*"):
+			prefix := strings.TrimSuffix(ar.mediaType, "*")
+			for _, e := range responseEncoders {
+				if strings.HasPrefix(e.mediaType, prefix) {
+					return e, true
+				}
+			}
+		default:
+			if e := encoderFor(ar.mediaType); e != nil {
+				return e, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// encodingResponseWriter carries the negotiated encoder to respondWithJSON.
+type encodingResponseWriter struct {
+	http.ResponseWriter
+	encoder *responseEncoder
+}
+
+func (w *encodingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// fixedFormatPaths are left out of negotiation: the requests and responses
+// of the document and of GraphQL are JSON by specification, and the docs
+// page and its assets have formats of their own.
+var fixedFormatPaths = map[string]bool{
+	"/openapi.json": true,
+	"/graphql":      true,
+	"/docs":         true,
+}
+
+// negotiationMiddleware answers 406 when no response format the client
+// accepts is available and 415 for request bodies it cannot decode. Bodies
+// in a format other than JSON are converted to JSON before the handler runs.
+func negotiationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fixedFormatPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, docsAssetsPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept")
+
+		encoder, ok := negotiateEncoder(r)
+		if !ok {
+			respondWithError(w, http.StatusNotAcceptable, "Acceptable formats are "+supportedFormats())
+			return
+		}
+		if encoder != nil {
+			w = &encodingResponseWriter{ResponseWriter: w, encoder: encoder}
+		}
+
+		contentType := r.Header.Get("Content-Type")
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if contentType == "" || err != nil {
+			mediaType = contentType
+		}
+
+		if decode, ok := requestDecoders[mediaType]; ok {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err == nil {
+				body, err = decode(body)
+			}
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid request payload: "+err.Error())
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Set("Content-Type", "application/json")
+		} else if !passThroughBodies[mediaType] {
+			respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported content type "+contentType)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func supportedFormats() string {
+	formats := []string{}
+	for _, e := range responseEncoders {
+		formats = append(formats, e.mediaType)
+	}
+
+	return strings.Join(formats, ", ")
+}
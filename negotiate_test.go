@@ -0,0 +1,226 @@
+// negotiate_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNegotiateEncoder(t *testing.T) {
+	cases := []struct {
+		url, accept string
+		format      string
+	}{
+		{"/products", "", "json"},
+		{"/products", "*/*", "json"},
+		{"/products", "text/html, application/xml;q=0.9, */*;q=0.8", "xml"},
+		{"/products", "application/json;q=0.5, text/csv", "csv"},
+		{"/products", "application/x-msgpack", "msgpack"},
+		{"/products", "text/*", "csv"},
+		{"/products?format=xml", "application/json", "xml"},
+		{"/products", "image/png", ""},
+		{"/products", "application/xml;q=0", ""},
+		{"/products?format=pdf", "", ""},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		req.Header.Set("Accept", c.accept)
+
+		e, ok := negotiateEncoder(req)
+		format := ""
+		if e != nil {
+			format = e.format
+		}
+		if format != c.format || ok != (c.format != "") {
+			t.Errorf("Expected %q for %s with Accept %q. Got %q", c.format, c.url, c.accept, format)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	if e, ok := negotiateEncoder(req); e != nil || !ok {
+		t.Errorf("Expected the event stream to be left to the handler")
+	}
+}
+
+func TestEncodeXML(t *testing.T) {
+	body, err := encodeXML([]interface{}{
+		product{ID: 1, Name: "Tom & Jerry", Price: 9.5},
+		map[string]interface{}{"1": true, "tags": nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := xmlHeader() + `<response type="array">` +
+		`<item type="object"><id type="number">1</id><name>Tom &amp; Jerry</name><price type="number">9.5</price></item>` +
+		`<item type="object"><member name="1" type="boolean">true</member><tags type="null"></tags></item>` +
+		`</response>`
+	if string(body) != expected {
+		t.Errorf("Expected %s. Got %s", expected, body)
+	}
+
+	decoded, err := decodeXML(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(decoded); s != `[{"id":1,"name":"Tom \u0026 Jerry","price":9.5},{"1":true,"tags":null}]` {
+		t.Errorf("Expected the document to read back. Got %s", s)
+	}
+}
+
+func xmlHeader() string {
+	return "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"
+}
+
+func TestDecodeXML(t *testing.T) {
+	decoded, err := decodeXML([]byte(`<product><name type="string">42</name><price>12.5</price>` +
+		`<tag>a</tag><tag>b</tag><tag>c</tag><ids><item>1</item><item>2</item></ids><active>true</active></product>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"name":"42","price":12.5,"tag":["a","b","c"],"ids":[1,2],"active":true}`
+	if string(decoded) != expected {
+		t.Errorf("Expected %s. Got %s", expected, decoded)
+	}
+
+	if _, err := decodeXML([]byte(`<price type="number">cheap</price>`)); err == nil {
+		t.Errorf("Expected an error for a mistyped number")
+	}
+}
+
+func TestEncodeCSV(t *testing.T) {
+	body, err := encodeCSV([]interface{}{
+		product{ID: 1, Name: "a, b", Price: 10},
+		map[string]interface{}{"id": 2, "tags": []string{"x"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "id,name,price,tags\n1,\"a, b\",10,\n2,,,\"[\"\"x\"\"]\"\n"
+	if string(body) != expected {
+		t.Errorf("Expected %q. Got %q", expected, body)
+	}
+
+	body, _ = encodeCSV(map[string]string{"error": "Product not found"})
+	if string(body) != "error\nProduct not found\n" {
+		t.Errorf("Expected a single row for an object. Got %q", body)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	body, err := encodeMsgpack(product{ID: 3, Name: "packed", Price: 1.25})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p map[string]interface{}
+	if err := msgpack.Unmarshal(body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p["id"] != int8(3) || p["name"] != "packed" || p["price"] != 1.25 {
+		t.Errorf("Expected the product fields. Got %v", p)
+	}
+
+	decoded, err := decodeMsgpack(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(decoded); s != `{"id":3,"name":"packed","price":1.25}` {
+		t.Errorf("Expected the product as JSON. Got %s", s)
+	}
+}
+
+func TestNegotiationMiddleware(t *testing.T) {
+	var got []byte
+	handler := negotiationMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		buf.ReadFrom(r.Body)
+		got = buf.Bytes()
+		respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+
+	req, _ := http.NewRequest("POST", "/product", strings.NewReader(`<product><name>x</name><price>1</price></product>`))
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Accept", "application/xml")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	if string(got) != `{"name":"x","price":1}` {
+		t.Errorf("Expected the handler to read JSON. Got %s", got)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/xml" {
+		t.Errorf("Expected an XML response. Got %s", ct)
+	}
+
+	req, _ = http.NewRequest("POST", "/product", strings.NewReader("x"))
+	req.Header.Set("Content-Type", "application/pdf")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusUnsupportedMediaType, rr.Code)
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	req.Header.Set("Accept", "image/png")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusNotAcceptable, rr.Code)
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected the error as JSON. Got %s", ct)
+	}
+
+	for _, path := range []string{"/openapi.json", "/graphql"} {
+		req, _ = http.NewRequest("GET", path, strings.NewReader(""))
+		req.Header.Set("Accept", "application/xml")
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if ct := rr.Header().Get("Content-Type"); rr.Code != http.StatusOK || ct != "application/json" {
+			t.Errorf("Expected %s to answer in JSON. Got %d %s", path, rr.Code, ct)
+		}
+	}
+}
+
+func TestGetProductAsXML(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("Accept", "application/xml")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if !strings.Contains(response.Body.String(), `<name>Product 0</name>`) {
+		t.Errorf("Expected the product as XML. Got %s", response.Body.String())
+	}
+}
+
+func TestCreateProductFromMsgpack(t *testing.T) {
+	clearTable()
+
+	body, _ := msgpack.Marshal(map[string]interface{}{"name": "packed", "price": 11.22})
+	req, _ := http.NewRequest("POST", "/product?format=csv", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/msgpack")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	if s := response.Body.String(); s != "id,name,price\n1,packed,11.22\n" {
+		t.Errorf("Expected the created product as CSV. Got %q", s)
+	}
+
+	var p product
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	json.Unmarshal(executeRequest(req).Body.Bytes(), &p)
+	if p.Name != "packed" {
+		t.Errorf("Expected the product to be stored. Got %+v", p)
+	}
+}
@@ -0,0 +1,577 @@
+// openapi.go
+
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// apiOperation documents one route of initializeRoutes. The OpenAPI document
+// is built from these and from the model types, and a test checks that they
+// match the routes actually registered.
+type apiOperation struct {
+	method  string
+	path    string
+	id      string
+	group   string
+	summary string
+	// query lists keys of apiParameters
+	query []string
+	// body and response name a schema: a component, "[]" followed by a
+	// component for an array of them, alternatives separated by "|", or ""
+	// for none
+	body     string
+	response string
+	// bodyMedia and responseMedia default to the negotiated formats
+	bodyMedia     string
+	responseMedia string
+	// status defaults to 200
+	status int
+}
+
+const patchMedia = "patch"
+
+var apiOperations = []apiOperation{
+	{method: "GET", path: "/products", id: "listProducts", group: "products", summary: "List products",
+		query: []string{"start", "count10", "deleted", "filter", "facet", "includeTags", "format"}, response: "[]Product|[]ProductWithTags", responseMedia: ndjsonMediaType},
+	{method: "POST", path: "/products", id: "ingestProducts", group: "products", summary: "Create and update products from NDJSON, lines with an id update or create that product",
+		query: []string{"format"}, body: "BulkOperation", bodyMedia: ndjsonMediaType, response: "IngestSummary"},
+	{method: "POST", path: "/products/bulk", id: "bulkProducts", group: "products", summary: "Create, update and delete products in bulk",
+		query: []string{"mode"}, body: "[]BulkOperation", response: "BulkResponse"},
+	{method: "GET", path: "/products/export", id: "exportProducts", group: "products", summary: "Export all active products as CSV",
+		query: []string{"format"}, responseMedia: "text/csv"},
+	{method: "POST", path: "/products/import", id: "importProducts", group: "products", summary: "Import products from CSV",
+		query: []string{"dryRun", "match", "map"}, bodyMedia: "text/csv", response: "ProductImport"},
+	{method: "GET", path: "/products/import/{id}/errors", id: "getImportErrors", group: "products", summary: "Download the rejected rows of an import",
+		responseMedia: "text/csv"},
+	{method: "POST", path: "/product", id: "createProduct", group: "products", summary: "Create a product",
+		body: "ProductInput", response: "Product", status: http.StatusCreated},
+	{method: "GET", path: "/products/facets", id: "listProductFacets", group: "products", summary: "Count the products matching a filter per value of each tag key",
+		query: []string{"filter", "facet"}, response: "[]Facet"},
+	{method: "GET", path: "/product/{id}", id: "getProduct", group: "products", summary: "Get a product",
+		query: []string{"includeTags"}, response: "Product|ProductWithTags"},
+	{method: "PUT", path: "/product/{id}", id: "updateProduct", group: "products", summary: "Replace a product",
+		body: "ProductInput", response: "Product"},
+	{method: "PATCH", path: "/product/{id}", id: "patchProduct", group: "products", summary: "Patch a product",
+		body: "Product", bodyMedia: patchMedia, response: "Product"},
+	{method: "DELETE", path: "/product/{id}", id: "deleteProduct", group: "products", summary: "Delete a product and its tag assignments",
+		response: "Result"},
+	{method: "POST", path: "/product/{id}/restore", id: "restoreProduct", group: "products", summary: "Restore a deleted product",
+		response: "Product"},
+	{method: "GET", path: "/product/{id}/related", id: "listRelatedProducts", group: "products", summary: "List the products sharing tags with a product",
+		query: []string{"start", "count10", "rank", "minShared"}, response: "[]RelatedProduct"},
+
+	{method: "GET", path: "/tags", id: "listTags", group: "tags", summary: "List tags",
+		query: []string{"start", "count10", "deleted", "includeUsage", "sort", "unused", "format"}, response: "[]Tag|[]TagWithUsage", responseMedia: ndjsonMediaType},
+	{method: "POST", path: "/tags", id: "ingestTags", group: "tags", summary: "Create and update tags from NDJSON, lines with an id update or create that tag",
+		query: []string{"format"}, body: "BulkOperation", bodyMedia: ndjsonMediaType, response: "IngestSummary"},
+	{method: "POST", path: "/tag", id: "createTag", group: "tags", summary: "Create a tag",
+		body: "TagInput", response: "Tag", status: http.StatusCreated},
+	{method: "GET", path: "/tag/{id}", id: "getTag", group: "tags", summary: "Get a tag",
+		query: []string{"includeProducts"}, response: "Tag|TagWithProducts|TagWithUsage"},
+	{method: "PUT", path: "/tag/{id}", id: "updateTag", group: "tags", summary: "Replace a tag",
+		body: "TagInput", response: "Tag"},
+	{method: "PATCH", path: "/tag/{id}", id: "patchTag", group: "tags", summary: "Patch a tag",
+		body: "Tag", bodyMedia: patchMedia, response: "Tag"},
+	{method: "DELETE", path: "/tag/{id}", id: "deleteTag", group: "tags", summary: "Delete a tag and its assignments",
+		response: "Result"},
+	{method: "POST", path: "/tag/{id}/restore", id: "restoreTag", group: "tags", summary: "Restore a deleted tag",
+		response: "Tag"},
+	{method: "GET", path: "/tag/{id}/children", id: "listTagChildren", group: "tags", summary: "List the tags directly below a tag",
+		query: []string{"start", "count10"}, response: "[]Tag"},
+	{method: "GET", path: "/tag/{id}/ancestors", id: "listTagAncestors", group: "tags", summary: "List the tags above a tag, the top-level one first",
+		response: "[]Tag"},
+	{method: "GET", path: "/tag/{id}/breadcrumb", id: "getTagBreadcrumb", group: "tags", summary: "Get the path from the top-level tag down to a tag",
+		response: "Breadcrumb"},
+	{method: "GET", path: "/tags/lookup", id: "lookupTag", group: "tags", summary: "Find a tag by its name or one of its aliases",
+		query: []string{"name"}, response: "Tag"},
+	{method: "GET", path: "/tags/suggest", id: "suggestTags", group: "tags", summary: "Suggest the most used tags starting with a prefix, ignoring case and accents",
+		query: []string{"prefix", "count25"}, response: "[]TagSuggestion"},
+	{method: "POST", path: "/tags/cleanup", id: "cleanupTags", group: "tags", summary: "Move the tags no product has to the trash",
+		query: []string{"olderThan", "dryRunCleanup"}, response: "TagCleanup"},
+	{method: "GET", path: "/tag/{id}/aliases", id: "listTagAliases", group: "tags", summary: "List the aliases of a tag",
+		response: "[]TagAlias"},
+	{method: "POST", path: "/tag/{id}/aliases", id: "createTagAlias", group: "tags", summary: "Add an alias to a tag",
+		body: "TagAliasInput", response: "TagAlias", status: http.StatusCreated},
+	{method: "DELETE", path: "/tag/{id}/alias/{aliasID}", id: "deleteTagAlias", group: "tags", summary: "Remove an alias from a tag",
+		response: "Result"},
+	{method: "POST", path: "/tag/{id}/merge", id: "mergeTag", group: "tags", summary: "Merge a tag into another one, keeping its name as an alias",
+		query: []string{"into"}, response: "TagMerge"},
+
+	{method: "GET", path: "/product/{productID}/tags", id: "listTagsOfProduct", group: "assignments", summary: "List the tags of a product",
+		query: []string{"start", "count10"}, response: "[]Tag"},
+	{method: "PUT", path: "/product/{productID}/tags", id: "replaceTagsOfProduct", group: "assignments", summary: "Set the tags of a product",
+		body: "TagIDs", response: "AssignmentDiff"},
+	{method: "PUT", path: "/product/{productID}/tags/order", id: "reorderTagsOfProduct", group: "assignments", summary: "Put the given tags of a product first, in this order",
+		body: "TagOrder", response: "TagOrder"},
+	{method: "GET", path: "/product/{productID}/tag/{tagID}", id: "getAssignment", group: "assignments", summary: "Get the assignment of a tag to a product",
+		response: "Assignment"},
+	{method: "POST", path: "/product/{productID}/tag/{tagID}", id: "createAssignment", group: "assignments", summary: "Assign a tag to a product",
+		response: "Assignment", status: http.StatusCreated},
+	{method: "DELETE", path: "/product/{productID}/tag/{tagID}", id: "deleteAssignment", group: "assignments", summary: "Remove a tag from a product",
+		response: "Result"},
+	{method: "POST", path: "/product/{productID}/tag/{tagID}/move", id: "moveTagOfProduct", group: "assignments", summary: "Move a tag of a product before or after another one of its tags",
+		query: []string{"moveBefore", "moveAfter"}, response: "TagOrder"},
+	{method: "GET", path: "/tag/{id}/products", id: "listProductsWithTag", group: "assignments", summary: "List the products that have a tag",
+		query: []string{"start", "count10", "descendants"}, response: "[]Product"},
+	{method: "POST", path: "/tag/{id}/products", id: "assignTagToProducts", group: "assignments", summary: "Assign a tag to products given by ID or filter",
+		body: "ProductSelection", response: "AssignmentDiff"},
+	{method: "DELETE", path: "/tag/{id}/products", id: "unassignTagFromProducts", group: "assignments", summary: "Remove a tag from products given by ID or filter",
+		body: "ProductSelection", response: "AssignmentDiff"},
+	{method: "PUT", path: "/tag/{id}/products/order", id: "reorderProductsOfTag", group: "assignments", summary: "Put the given products of a tag first, in this order",
+		body: "ProductOrder", response: "ProductOrder"},
+	{method: "POST", path: "/tag/{id}/product/{productID}/move", id: "moveProductInTag", group: "assignments", summary: "Move a product of a tag before or after another one of its products",
+		query: []string{"moveBefore", "moveAfter"}, response: "ProductOrder"},
+
+	{method: "GET", path: "/audit", id: "listAuditEntries", group: "changes", summary: "List the audit log, newest first",
+		query: []string{"start", "count100", "entity", "entityID", "action", "actor", "requestID", "since", "until"}, response: "[]AuditEntry"},
+	{method: "GET", path: "/outbox", id: "listOutboxEvents", group: "changes", summary: "Read catalog events in order",
+		query: []string{"after", "count1000"}, response: "[]CatalogEvent"},
+	{method: "GET", path: "/events", id: "streamEvents", group: "changes", summary: "Stream catalog events as Server-Sent Events",
+		query: []string{"entity", "tag", "lastEventId"}, responseMedia: "text/event-stream"},
+
+	{method: "GET", path: "/webhooks", id: "listWebhooks", group: "webhooks", summary: "List webhook subscriptions",
+		query: []string{"start", "count10"}, response: "[]WebhookSubscription"},
+	{method: "GET", path: "/webhooks/deadletters", id: "listDeadLetters", group: "webhooks", summary: "List deliveries that ran out of attempts",
+		query: []string{"start", "count100"}, response: "[]WebhookDelivery"},
+	{method: "POST", path: "/webhook", id: "createWebhook", group: "webhooks", summary: "Subscribe to catalog events",
+		body: "WebhookSubscriptionInput", response: "WebhookSubscription", status: http.StatusCreated},
+	{method: "GET", path: "/webhook/{id}", id: "getWebhook", group: "webhooks", summary: "Get a webhook subscription",
+		response: "WebhookSubscription"},
+	{method: "PUT", path: "/webhook/{id}", id: "updateWebhook", group: "webhooks", summary: "Update a webhook subscription",
+		body: "WebhookSubscriptionInput", response: "WebhookSubscription"},
+	{method: "DELETE", path: "/webhook/{id}", id: "deleteWebhook", group: "webhooks", summary: "Delete a webhook subscription",
+		response: "Result"},
+	{method: "GET", path: "/webhook/{id}/deliveries", id: "listWebhookDeliveries", group: "webhooks", summary: "List the deliveries of a subscription",
+		query: []string{"status", "start", "count100"}, response: "[]WebhookDelivery"},
+	{method: "POST", path: "/webhook/delivery/{id}/retry", id: "retryWebhookDelivery", group: "webhooks", summary: "Retry a delivery",
+		response: "Result"},
+
+	{method: "POST", path: "/graphql", id: "graphql", group: "graphql", summary: "Run a GraphQL query or mutation; errors of the query are reported in the response",
+		body: "GraphQLRequest", response: "GraphQLResponse"},
+
+	{method: "GET", path: "/openapi.json", id: "getOpenAPI", group: "documentation", summary: "This document",
+		responseMedia: "application/json"},
+	{method: "GET", path: "/docs", id: "getDocs", group: "documentation", summary: "Interactive documentation",
+		responseMedia: "text/html"},
+}
+
+type apiParameter struct {
+	name        string
+	description string
+	schema      map[string]interface{}
+}
+
+func integerSchema() map[string]interface{} { return map[string]interface{}{"type": "integer"} }
+func stringSchema() map[string]interface{}  { return map[string]interface{}{"type": "string"} }
+
+func enumSchema(values ...string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "enum": values}
+}
+
+func pageSizeParameter(max int) apiParameter {
+	return apiParameter{"count", "Page size", map[string]interface{}{"type": "integer", "minimum": 1, "maximum": max}}
+}
+
+var apiParameters = map[string]apiParameter{
+	"start":         {"start", "Offset of the first item", map[string]interface{}{"type": "integer", "minimum": 0}},
+	"count10":       pageSizeParameter(10),
+	"count25":       pageSizeParameter(maxSuggestions),
+	"count100":      pageSizeParameter(100),
+	"count1000":     pageSizeParameter(1000),
+	"deleted":       {"deleted", "Whether to list active, deleted or all rows", enumSchema("exclude", "include", "only")},
+	"format":        {"format", "Response format, overriding the Accept header", enumSchema("json", "xml", "csv", "msgpack", "ndjson")},
+	"mode":          {"mode", "atomic applies all operations or none, partial applies what it can", enumSchema("atomic", "partial")},
+	"dryRun":        {"dryRun", "Check the rows without importing them", map[string]interface{}{"type": "boolean"}},
+	"dryRunCleanup": {"dryRun", "List the tags without removing them", map[string]interface{}{"type": "boolean"}},
+	"olderThan": {"olderThan", "Only tags created longer ago than this duration, such as 720h; by default " + defaultCleanupAge.String(),
+		stringSchema()},
+	"rank":        {"rank", "Rank by the number of shared tags or by their Jaccard similarity", enumSchema("shared", "jaccard")},
+	"minShared":   {"minShared", "Only products sharing at least this many tags", integerSchema()},
+	"moveBefore":  {"before", "ID of the item to move it right before; give either before or after", integerSchema()},
+	"moveAfter":   {"after", "ID of the item to move it right after", integerSchema()},
+	"sort":        {"sort", "Order of the tags, by ID or by the number of products with them", enumSchema("id", "usage", "-usage")},
+	"unused":      {"unused", "Only tags no active product has", map[string]interface{}{"type": "boolean"}},
+	"match":       {"match", "Column that matches rows to existing products", enumSchema("id", "name")},
+	"filter":      {"filter", `Only products matching an expression such as price < 10 and tag = "sale"`, stringSchema()},
+	"map":         {"map", "Maps CSV headers to fields, e.g. Title:name,Cost:price", stringSchema()},
+	"entity":      {"entity", "Only changes of this kind of entity: product, tag, assignment, alias, tag_order or product_order", stringSchema()},
+	"entityID":    {"id", "Only changes of the entity with this ID", integerSchema()},
+	"action":      {"action", "Only changes with this action", enumSchema("created", "updated", "deleted", "restored", "purged", "merged")},
+	"actor":       {"actor", "Only changes made by this actor", stringSchema()},
+	"requestID":   {"requestID", "Only changes made by this request", stringSchema()},
+	"since":       {"since", "Only changes at or after this RFC 3339 timestamp", map[string]interface{}{"type": "string", "format": "date-time"}},
+	"until":       {"until", "Only changes before this RFC 3339 timestamp", map[string]interface{}{"type": "string", "format": "date-time"}},
+	"after":       {"after", "Only events with a greater seq", integerSchema()},
+	"tag":         {"tag", "Only events of this tag and of products that have it", integerSchema()},
+	"lastEventId": {"lastEventId", "Replay the events after this one, like the Last-Event-ID header", stringSchema()},
+	"status":      {"status", "Only deliveries with this status", stringSchema()},
+	"name":        {"name", "Name or alias of the tag", stringSchema()},
+	"facet": {"tag.{key}", "Only products with a key/value tag such as tag.color=red; repeating a key matches any of its values",
+		map[string]interface{}{"type": "array", "items": stringSchema()}},
+	"prefix":      {"prefix", "What the user typed so far", stringSchema()},
+	"into":        {"into", "ID of the tag to merge into", integerSchema()},
+	"descendants": {"descendants", "Also list the products of the tags below this one", map[string]interface{}{"type": "boolean"}},
+	"includeTags": {"include", "Embed the tags of each product", enumSchema("tags")},
+	"includeProducts": {"include", "Embed the first " + strconv.Itoa(includedProductsLimit) + " products of the tag and their total count, or only count them",
+		enumSchema("products", "usage")},
+	"includeUsage": {"include", "Add the number of products with each tag", enumSchema("usage")},
+}
+
+// apiSchemas are the components of the document, generated from the types
+// the handlers decode and encode.
+var apiSchemas = map[string]interface{}{
+	"Product":         product{},
+	"ProductWithTags": productWithTags{},
+	"TagWithProducts": tagWithProducts{},
+	"ProductInput":    productInput{},
+	"Tag":             tag{},
+	"TagInput":        tagInput{},
+	"Breadcrumb":      breadcrumb{},
+	"TagAlias":        tagAlias{},
+	"TagAliasInput":   tagAliasInput{},
+	"TagMerge":        tagMerge{},
+	"TagSuggestion":   tagSuggestion{},
+	"TagWithUsage":    tagWithUsage{},
+	"RelatedProduct":  relatedProduct{},
+	"TagCleanup":      tagCleanup{},
+	"Facet":           facet{},
+	"FacetValue":      facetValue{},
+	"Assignment":      productToTagAssignment{},
+	"TagOrder":        tagOrder{},
+	"ProductOrder":    productOrder{},
+	"TagIDs": struct {
+		TagIDs []int `json:"tagIDs"`
+	}{},
+	"ProductSelection":         productSelection{},
+	"AssignmentDiff":           assignmentDiff{},
+	"BulkOperation":            bulkOperation{},
+	"BulkResult":               bulkResult{},
+	"BulkResponse":             bulkResponse{},
+	"ProductImport":            productImport{},
+	"ImportError":              importError{},
+	"IngestSummary":            ingestSummary{},
+	"AuditEntry":               auditEntry{},
+	"CatalogEvent":             catalogEvent{},
+	"WebhookSubscription":      webhookSubscription{},
+	"WebhookSubscriptionInput": webhookSubscriptionInput{},
+	"WebhookDelivery":          webhookDelivery{},
+	"PatchOperation":           patchOperation{},
+	"GraphQLRequest":           graphqlRequest{},
+	"GraphQLResponse":          graphql.Response{},
+	"Result": struct {
+		Result string `json:"result"`
+	}{},
+	"Error": struct {
+		Error string `json:"error"`
+	}{},
+}
+
+var (
+	openAPIOnce     sync.Once
+	openAPIDocument map[string]interface{}
+)
+
+// openAPI returns the OpenAPI 3.1 document of the service.
+func openAPI() map[string]interface{} {
+	openAPIOnce.Do(func() {
+		openAPIDocument = buildOpenAPI()
+	})
+
+	return openAPIDocument
+}
+
+func buildOpenAPI() map[string]interface{} {
+	names := map[reflect.Type]string{}
+	for name, v := range apiSchemas {
+		names[reflect.TypeOf(v)] = name
+	}
+
+	schemas := map[string]interface{}{}
+	for name, v := range apiSchemas {
+		schemas[name] = structSchema(reflect.TypeOf(v), names)
+	}
+
+	paths := map[string]interface{}{}
+	for _, op := range apiOperations {
+		item, _ := paths[op.path].(map[string]interface{})
+		if item == nil {
+			item = map[string]interface{}{}
+			paths[op.path] = item
+		}
+		item[strings.ToLower(op.method)] = op.document()
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":       "Product catalog",
+			"version":     "1.0.0",
+			"description": "Products, tags and the assignments between them. Responses are JSON unless another format is asked for with the Accept header or the format parameter.",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+var pathParameterPattern = regexp.MustCompile(`\{([^}:]+)[^}]*\}`)
+
+func (op apiOperation) document() map[string]interface{} {
+	parameters := []interface{}{}
+	for _, match := range pathParameterPattern.FindAllStringSubmatch(op.path, -1) {
+		parameters = append(parameters, map[string]interface{}{
+			"name": match[1], "in": "path", "required": true, "schema": integerSchema(),
+		})
+	}
+	for _, key := range op.query {
+		p := apiParameters[key]
+		parameters = append(parameters, map[string]interface{}{
+			"name": p.name, "in": "query", "description": p.description, "schema": p.schema,
+		})
+	}
+	if op.method != "GET" {
+		parameters = append(parameters,
+			map[string]interface{}{"name": "X-Actor", "in": "header", "description": "Who makes the change, as recorded in the audit log", "schema": stringSchema()},
+			map[string]interface{}{"name": "X-Request-ID", "in": "header", "description": "Correlates the change with the request", "schema": stringSchema()},
+		)
+	}
+	if op.path == "/events" {
+		parameters = append(parameters, map[string]interface{}{
+			"name": "Last-Event-ID", "in": "header", "description": "Replay the events after this one", "schema": stringSchema(),
+		})
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	doc := map[string]interface{}{
+		"operationId": op.id,
+		"summary":     op.summary,
+		"tags":        []string{op.group},
+		"parameters":  parameters,
+		"responses": map[string]interface{}{
+			strconv.Itoa(status): map[string]interface{}{
+				"description": http.StatusText(status),
+				"content":     op.responseContent(),
+			},
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content":     mediaContent(schemaRef("Error"), negotiatedMedia()...),
+			},
+		},
+	}
+
+	if op.body != "" || op.bodyMedia != "" {
+		doc["requestBody"] = map[string]interface{}{"required": true, "content": op.bodyContent()}
+	}
+
+	return doc
+}
+
+func (op apiOperation) responseContent() map[string]interface{} {
+	content := map[string]interface{}{}
+	if op.response != "" {
+		content = mediaContent(schemaRef(op.response), negotiatedMedia()...)
+	}
+
+	switch op.responseMedia {
+	case "":
+	case ndjsonMediaType:
+		// the list streamed a row per line
+		content[ndjsonMediaType] = map[string]interface{}{"schema": schemaRef(strings.TrimPrefix(op.response, "[]"))}
+	case "application/json":
+		content[op.responseMedia] = map[string]interface{}{"schema": map[string]interface{}{"type": "object"}}
+	default:
+		content[op.responseMedia] = map[string]interface{}{"schema": stringSchema()}
+	}
+
+	return content
+}
+
+func (op apiOperation) bodyContent() map[string]interface{} {
+	switch op.bodyMedia {
+	case patchMedia:
+		return map[string]interface{}{
+			mergePatchMediaType: map[string]interface{}{"schema": schemaRef(op.body)},
+			jsonPatchMediaType:  map[string]interface{}{"schema": schemaRef("[]PatchOperation")},
+		}
+	case ndjsonMediaType:
+		return map[string]interface{}{ndjsonMediaType: map[string]interface{}{"schema": schemaRef(op.body)}}
+	case "text/csv":
+		return map[string]interface{}{"text/csv": map[string]interface{}{"schema": stringSchema()}}
+	}
+
+	return mediaContent(schemaRef(op.body), "application/json", "application/xml", "application/msgpack")
+}
+
+func negotiatedMedia() []string {
+	media := []string{}
+	for _, e := range responseEncoders {
+		media = append(media, e.mediaType)
+	}
+
+	return media
+}
+
+func mediaContent(schema map[string]interface{}, media ...string) map[string]interface{} {
+	content := map[string]interface{}{}
+	for _, m := range media {
+		content[m] = map[string]interface{}{"schema": schema}
+	}
+
+	return content
+}
+
+func schemaRef(name string) map[string]interface{} {
+	if alternatives := strings.Split(name, "|"); len(alternatives) > 1 {
+		oneOf := []interface{}{}
+		for _, alternative := range alternatives {
+			oneOf = append(oneOf, schemaRef(alternative))
+		}
+		return map[string]interface{}{"oneOf": oneOf}
+	}
+	if item := strings.TrimPrefix(name, "[]"); item != name {
+		return map[string]interface{}{"type": "array", "items": schemaRef(item)}
+	}
+
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// typeSchema describes how encoding/json writes values of type t. Types
+// that are components are referenced.
+func typeSchema(t reflect.Type, names map[reflect.Type]string) map[string]interface{} {
+	if name, ok := names[t]; ok {
+		return schemaRef(name)
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), names)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return integerSchema()
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return stringSchema()
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), names)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), names)}
+	case reflect.Struct:
+		return structSchema(t, names)
+	}
+
+	// interface{} holds anything
+	return map[string]interface{}{}
+}
+
+// structSchema describes the exported fields of a struct under their json
+// names. Fields are required unless they are omitted when empty; input
+// types name their required fields with missingFields.
+func structSchema(t reflect.Type, names map[reflect.Type]string) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				addFields(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+
+			name, options, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+
+			properties[name] = typeSchema(f.Type, names)
+			if options != "omitempty" && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+
+	if in, ok := reflect.Zero(t).Interface().(interface{ missingFields() []string }); ok {
+		required = in.missingFields()
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+func (a *App) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, openAPI())
+}
+
+// swaggerUI holds the assets of swagger-ui-dist 5.18.2 and the script
+// starting it, served below docsAssetsPath. The docs page loads nothing from
+// elsewhere and has no inline script, so it works offline and under a strict
+// Content-Security-Policy.
+//
+//go:embed swagger-ui
+var swaggerUI embed.FS
+
+const docsAssetsPath = "/docs/swagger-ui/"
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Product catalog API</title>
+  <link rel="stylesheet" href="` + docsAssetsPath + `swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="` + docsAssetsPath + `swagger-ui-bundle.js"></script>
+  <script src="` + docsAssetsPath + `docs.js"></script>
+</body>
+</html>
+`
+
+// getDocs serves Swagger UI for the document at /openapi.json.
+func (a *App) getDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(docsPage))
+}
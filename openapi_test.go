@@ -0,0 +1,133 @@
+// openapi_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	app := App{Router: mux.NewRouter()}
+	app.initializeRoutes()
+
+	registered := map[string]bool{}
+	app.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			registered[method+" "+pathParameterPattern.ReplaceAllString(path, "{$1}")] = true
+		}
+		return nil
+	})
+
+	documented := map[string]bool{}
+	ids := map[string]bool{}
+	for _, op := range apiOperations {
+		key := op.method + " " + op.path
+		if documented[key] {
+			t.Errorf("%s is documented twice", key)
+		}
+		if ids[op.id] {
+			t.Errorf("Operation ID %s is used twice", op.id)
+		}
+		documented[key], ids[op.id] = true, true
+
+		if !registered[key] {
+			t.Errorf("%s is documented but not registered", key)
+		}
+		for _, q := range op.query {
+			if _, ok := apiParameters[q]; !ok {
+				t.Errorf("%s uses the unknown parameter %s", key, q)
+			}
+		}
+	}
+
+	for key := range registered {
+		if !documented[key] {
+			t.Errorf("%s is not documented in apiOperations", key)
+		}
+	}
+}
+
+func TestOpenAPIReferencesResolve(t *testing.T) {
+	data, err := json.Marshal(openAPI())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	json.Unmarshal(data, &doc)
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				name := strings.TrimPrefix(ref, "#/components/schemas/")
+				if _, ok := schemas[name]; !ok {
+					t.Errorf("%s does not resolve", ref)
+				}
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(doc)
+
+	product := schemas["ProductInput"].(map[string]interface{})
+	if required, _ := json.Marshal(product["required"]); string(required) != `["name","price"]` {
+		t.Errorf("Expected name and price to be required. Got %s", required)
+	}
+	if _, ok := schemas["Product"].(map[string]interface{})["properties"].(map[string]interface{})["deletedAt"]; !ok {
+		t.Errorf("Expected the product schema to have deletedAt")
+	}
+}
+
+func TestGetOpenAPI(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var doc map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &doc)
+	if doc["openapi"] != "3.1.0" {
+		t.Errorf("Expected an OpenAPI 3.1 document. Got %v", doc["openapi"])
+	}
+}
+
+func TestDocsAreServedLocally(t *testing.T) {
+	app := App{Router: mux.NewRouter()}
+	app.initializeRoutes()
+
+	req, _ := http.NewRequest("GET", "/docs", nil)
+	rr := httptest.NewRecorder()
+	app.Router.ServeHTTP(rr, req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	if page := rr.Body.String(); strings.Contains(page, "://") || !strings.Contains(page, docsAssetsPath+"docs.js") {
+		t.Errorf("Expected the docs page to load its assets from the service. Got %s", page)
+	}
+
+	for _, asset := range []string{"swagger-ui.css", "swagger-ui-bundle.js", "docs.js"} {
+		req, _ := http.NewRequest("GET", docsAssetsPath+asset, nil)
+		rr := httptest.NewRecorder()
+		app.Router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.Len() == 0 {
+			t.Errorf("Expected %s to be served. Got %d", asset, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+// order.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Assignments carry two positions: position_in_product orders the tags of a
+// product, so its primary tag can come first, and position_in_tag orders
+// the products of a tag, for curated landing pages. New assignments have no
+// position and come last, in the order they were made, until the list is
+// reordered. A reorder is recorded as an update of the order, entity
+// tag_order for the tags of a product and product_order for the products of
+// a tag, with the owner's ID and the member IDs before and after.
+
+// assignmentOrdering describes one of the two orders of assignments: the
+// members of an owner, such as the tags of a product.
+type assignmentOrdering struct {
+	ownerTable, ownerColumn, memberColumn, positionColumn string
+	// entity is the entity a reorder is recorded as
+	entity string
+	// members names the members in errors
+	members string
+	// wrap turns member IDs into the recorded value
+	wrap func(ids []int) interface{}
+}
+
+var tagsOfProductOrdering = assignmentOrdering{
+	ownerTable: "products", ownerColumn: "productID", memberColumn: "tagID", positionColumn: "position_in_product",
+	entity: "tag_order", members: "Tags of the product",
+	wrap: func(ids []int) interface{} { return tagOrder{TagIDs: ids} },
+}
+
+var productsOfTagOrdering = assignmentOrdering{
+	ownerTable: "tag", ownerColumn: "tagID", memberColumn: "productID", positionColumn: "position_in_tag",
+	entity: "product_order", members: "Products of the tag",
+	wrap: func(ids []int) interface{} { return productOrder{ProductIDs: ids} },
+}
+
+// tagOrder lists the tags of a product in order.
+type tagOrder struct {
+	TagIDs []int `json:"tagIDs"`
+}
+
+func (in tagOrder) missingFields() []string {
+	if in.TagIDs == nil {
+		return []string{"tagIDs"}
+	}
+	return []string{}
+}
+
+// productOrder lists the products of a tag in order.
+type productOrder struct {
+	ProductIDs []int `json:"productIDs"`
+}
+
+func (in productOrder) missingFields() []string {
+	if in.ProductIDs == nil {
+		return []string{"productIDs"}
+	}
+	return []string{}
+}
+
+// lockOwner locks the owner of the list, so that reorders of the same list
+// happen one after the other. It returns sql.ErrNoRows if the owner is not
+// active.
+func (o assignmentOrdering) lockOwner(tx *sql.Tx, ownerID int) error {
+	return tx.QueryRow("SELECT id FROM "+o.ownerTable+" WHERE id=$1 AND deleted_at IS NULL FOR UPDATE", ownerID).Scan(&ownerID)
+}
+
+// getOrder returns the members of the owner in order, each once.
+func (o assignmentOrdering) getOrder(db dbtx, ownerID int) ([]int, error) {
+	rows, err := db.Query("SELECT "+o.memberColumn+" FROM productToTagAssignment WHERE "+o.ownerColumn+"=$1 AND deleted_at IS NULL ORDER BY "+o.positionColumn+" NULLS LAST, id", ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	seen := map[int]bool{}
+	order := []int{}
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if !seen[id] {
+			seen[id] = true
+			order = append(order, id)
+		}
+	}
+
+	return order, rows.Err()
+}
+
+// saveOrder numbers the assignments of the owner after order and records
+// the reordering if anything moved.
+func (o assignmentOrdering) saveOrder(tx *sql.Tx, cs *changeSet, ownerID int, current, order []int) error {
+	_, err := tx.Exec(`UPDATE productToTagAssignment pta SET `+o.positionColumn+` = o.n
+		FROM unnest($2::integer[]) WITH ORDINALITY AS o(member, n)
+		WHERE pta.`+o.ownerColumn+` = $1 AND pta.`+o.memberColumn+` = o.member AND pta.deleted_at IS NULL`,
+		ownerID, pq.Array(order))
+	if err != nil {
+		return err
+	}
+
+	for i := range order {
+		if order[i] != current[i] {
+			cs.record(o.entity, ownerID, "updated", o.wrap(current), o.wrap(order))
+			break
+		}
+	}
+	return nil
+}
+
+// moveID returns ids with id taken out and put right before or after anchor.
+func moveID(ids []int, id, anchor int, after bool) []int {
+	moved := make([]int, 0, len(ids))
+	for _, x := range ids {
+		if x == id {
+			continue
+		}
+		if x == anchor && !after {
+			moved = append(moved, id)
+		}
+		moved = append(moved, x)
+		if x == anchor && after {
+			moved = append(moved, id)
+		}
+	}
+
+	return moved
+}
+
+// putFirst returns ids with first, in its order, ahead of the others, which
+// keep theirs.
+func putFirst(ids, first []int) []int {
+	put := map[int]bool{}
+	for _, id := range first {
+		put[id] = true
+	}
+
+	order := append(make([]int, 0, len(ids)), first...)
+	for _, id := range ids {
+		if !put[id] {
+			order = append(order, id)
+		}
+	}
+
+	return order
+}
+
+// moveAssignmentTx moves member id of the owner before or after member
+// anchor and returns the new order.
+func moveAssignmentTx(tx *sql.Tx, cs *changeSet, o assignmentOrdering, ownerID, id, anchor int, after bool) ([]int, error) {
+	if id == anchor {
+		return nil, validationError("An item cannot be moved next to itself")
+	}
+
+	if err := o.lockOwner(tx, ownerID); err != nil {
+		return nil, err
+	}
+	current, err := o.getOrder(tx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if missing := missingFrom(current, []int{id, anchor}); len(missing) > 0 {
+		return nil, missingIDsError(o.members, missing)
+	}
+
+	order := moveID(current, id, anchor, after)
+	return order, o.saveOrder(tx, cs, ownerID, current, order)
+}
+
+// reorderAssignmentsTx puts the members in first ahead of the other members
+// of the owner and returns the new order. Giving all of them sets the whole
+// order.
+func reorderAssignmentsTx(tx *sql.Tx, cs *changeSet, o assignmentOrdering, ownerID int, first []int) ([]int, error) {
+	seen := map[int]bool{}
+	for _, id := range first {
+		if seen[id] {
+			return nil, validationError("ID " + strconv.Itoa(id) + " is given more than once")
+		}
+		seen[id] = true
+	}
+
+	if err := o.lockOwner(tx, ownerID); err != nil {
+		return nil, err
+	}
+	current, err := o.getOrder(tx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if missing := missingFrom(current, first); len(missing) > 0 {
+		return nil, missingIDsError(o.members, missing)
+	}
+
+	order := putFirst(current, first)
+	return order, o.saveOrder(tx, cs, ownerID, current, order)
+}
+
+// missingFrom returns the ids that are not in list.
+func missingFrom(list, ids []int) []int {
+	in := map[int]bool{}
+	for _, id := range list {
+		in[id] = true
+	}
+
+	missing := []int{}
+	for _, id := range ids {
+		if !in[id] {
+			missing = append(missing, id)
+		}
+	}
+
+	return missing
+}
+
+// parseMove reads ?before= or ?after=, exactly one of which names the item
+// to move the other one next to.
+func parseMove(r *http.Request) (anchor int, after bool, err error) {
+	before, afterValue := r.FormValue("before"), r.FormValue("after")
+	if (before == "") == (afterValue == "") {
+		return 0, false, errors.New("Either before or after is required")
+	}
+
+	value := before
+	if afterValue != "" {
+		value, after = afterValue, true
+	}
+	if anchor, err = strconv.Atoi(value); err != nil {
+		return 0, false, errors.New("Invalid ID " + strconv.Quote(value))
+	}
+
+	return anchor, after, nil
+}
+
+// moveTagOfProduct moves a tag of a product before or after another one of
+// its tags.
+func (a *App) moveTagOfProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	productID, err := strconv.Atoi(vars["productID"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	tagID, err := strconv.Atoi(vars["tagID"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+
+	anchor, after, err := parseMove(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var order []int
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		var err error
+		order, err = moveAssignmentTx(tx, cs, tagsOfProductOrdering, productID, tagID, anchor, after)
+		return err
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Product not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tagOrder{TagIDs: order})
+}
+
+// reorderTagsOfProduct puts the given tags of a product first, in the given
+// order.
+func (a *App) reorderTagsOfProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	productID, err := strconv.Atoi(vars["productID"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var in tagOrder
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&in); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if missing := in.missingFields(); len(missing) > 0 {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: "+strings.Join(missing, ", "))
+		return
+	}
+
+	var order []int
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		var err error
+		order, err = reorderAssignmentsTx(tx, cs, tagsOfProductOrdering, productID, in.TagIDs)
+		return err
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Product not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tagOrder{TagIDs: order})
+}
+
+// moveProductInTag moves a product of a tag before or after another one of
+// its products.
+func (a *App) moveProductInTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tagID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+	productID, err := strconv.Atoi(vars["productID"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	anchor, after, err := parseMove(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var order []int
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		var err error
+		order, err = moveAssignmentTx(tx, cs, productsOfTagOrdering, tagID, productID, anchor, after)
+		return err
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Tag not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, productOrder{ProductIDs: order})
+}
+
+// reorderProductsOfTag puts the given products of a tag first, in the given
+// order.
+func (a *App) reorderProductsOfTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tagID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+
+	var in productOrder
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&in); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if missing := in.missingFields(); len(missing) > 0 {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: "+strings.Join(missing, ", "))
+		return
+	}
+
+	var order []int
+	err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+		var err error
+		order, err = reorderAssignmentsTx(tx, cs, productsOfTagOrdering, tagID, in.ProductIDs)
+		return err
+	})
+	if err != nil {
+		respondWithMutationError(w, err, "Tag not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, productOrder{ProductIDs: order})
+}
@@ -0,0 +1,170 @@
+// order_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOrderTagsOfProduct(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addTags(4)
+	for _, tagID := range []int{1, 2, 3, 4} {
+		addTagAssignment(1, tagID)
+	}
+
+	req, _ := http.NewRequest("PUT", "/product/1/tags/order", bytes.NewBufferString(`{"tagIDs":[3,1]}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var order tagOrder
+	json.Unmarshal(response.Body.Bytes(), &order)
+	if !reflect.DeepEqual(order.TagIDs, []int{3, 1, 2, 4}) {
+		t.Errorf("Expected tags 3 and 1 first. Got %v", order.TagIDs)
+	}
+
+	req, _ = http.NewRequest("POST", "/product/1/tag/4/move?before=1", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	if names := tagNamesOfProduct(t, "1"); !reflect.DeepEqual(names, []string{"Tag 2", "Tag 3", "Tag 0", "Tag 1"}) {
+		t.Errorf("Expected the tags of the product in their new order. Got %v", names)
+	}
+
+	// a new tag goes last
+	addTags(1)
+	req, _ = http.NewRequest("POST", "/product/1/tag/5", nil)
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	if names := tagNamesOfProduct(t, "1"); len(names) != 5 || names[4] != "Tag 0" {
+		t.Errorf("Expected the new tag last. Got %v", names)
+	}
+
+	for url, code := range map[string]int{
+		"/product/1/tag/4/move":                  http.StatusBadRequest,
+		"/product/1/tag/4/move?before=1&after=2": http.StatusBadRequest,
+		"/product/1/tag/4/move?after=4":          http.StatusUnprocessableEntity,
+		"/product/1/tag/4/move?after=9":          http.StatusNotFound,
+		"/product/9/tag/4/move?after=1":          http.StatusNotFound,
+	} {
+		req, _ := http.NewRequest("POST", url, nil)
+		if response := executeRequest(req); response.Code != code {
+			t.Errorf("Expected %d for %s. Got %d", code, url, response.Code)
+		}
+	}
+
+	for body, code := range map[string]int{
+		`{}`:               http.StatusBadRequest,
+		`{"tagIDs":[2,2]}`: http.StatusUnprocessableEntity,
+		`{"tagIDs":[9]}`:   http.StatusNotFound,
+	} {
+		req, _ := http.NewRequest("PUT", "/product/1/tags/order", bytes.NewBufferString(body))
+		if response := executeRequest(req); response.Code != code {
+			t.Errorf("Expected %d for %s. Got %d", code, body, response.Code)
+		}
+	}
+}
+
+func TestOrderProductsOfTag(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addTags(1)
+	for _, productID := range []int{1, 2, 3} {
+		addTagAssignment(productID, 1)
+	}
+
+	req, _ := http.NewRequest("POST", "/tag/1/product/1/move?after=3", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var order productOrder
+	json.Unmarshal(response.Body.Bytes(), &order)
+	if !reflect.DeepEqual(order.ProductIDs, []int{2, 3, 1}) {
+		t.Errorf("Expected product 1 last. Got %v", order.ProductIDs)
+	}
+
+	req, _ = http.NewRequest("PUT", "/tag/1/products/order", bytes.NewBufferString(`{"productIDs":[3]}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	products, _ := getProductsWithTagAssigned(a.DB, 1, 0, 10, false)
+	if len(products) != 3 || products[0].ID != 3 || products[1].ID != 2 || products[2].ID != 1 {
+		t.Errorf("Expected the products of the tag in their new order. Got %v", products)
+	}
+
+	// reorders are changes of the order, not of the tag
+	entries, _ := getAuditLog(a.DB, auditFilter{Entity: "product_order"}, 0, 10)
+	if len(entries) != 2 || entries[0].EntityID != 1 || entries[0].Action != "updated" {
+		t.Fatalf("Expected both reorders to be recorded as updates of the order of tag 1. Got %+v", entries)
+	}
+	var after productOrder
+	json.Unmarshal(entries[0].After, &after)
+	if !reflect.DeepEqual(after.ProductIDs, []int{3, 2, 1}) {
+		t.Errorf("Expected the new order to be recorded. Got %s", entries[0].After)
+	}
+
+	req, _ = http.NewRequest("PUT", "/tag/9/products/order", bytes.NewBufferString(`{"productIDs":[]}`))
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+func TestProductsOfTagKeepItsOrder(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addTags(1)
+	for _, productID := range []int{1, 2, 3} {
+		addTagAssignment(productID, 1)
+	}
+
+	req, _ := http.NewRequest("PUT", "/tag/1/products/order", bytes.NewBufferString(`{"productIDs":[3,1]}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	embedded, _ := withProducts(a.DB, tag{ID: 1})
+	if len(embedded.Products) != 3 || embedded.Products[0].ID != 3 || embedded.Products[1].ID != 1 {
+		t.Errorf("Expected the included products in the order of the tag. Got %v", embedded.Products)
+	}
+
+	query := `query($after: String) { tag(id: 1) { products(first: 2, after: $after) {
+		edges { node { id } } pageInfo { hasNextPage endCursor } } } }`
+	result := executeGraphQL(t, query, map[string]interface{}{"after": nil})
+	data, _ := json.Marshal(result.Data)
+	expected := `{"tag":{"products":{"edges":[{"node":{"id":"3"}},{"node":{"id":"1"}}],` +
+		`"pageInfo":{"endCursor":"` + encodeCursor(2) + `","hasNextPage":true}}}}`
+	if string(data) != expected {
+		t.Errorf("Expected %s. Got %s", expected, data)
+	}
+
+	result = executeGraphQL(t, query, map[string]interface{}{"after": encodeCursor(2)})
+	data, _ = json.Marshal(result.Data)
+	if !strings.Contains(string(data), `"edges":[{"node":{"id":"2"}}]`) {
+		t.Errorf("Expected product 2 on the second page. Got %s", data)
+	}
+}
+
+func TestMoveID(t *testing.T) {
+	for _, tc := range []struct {
+		id, anchor int
+		after      bool
+		want       []int
+	}{
+		{4, 1, false, []int{4, 1, 2, 3}},
+		{1, 4, true, []int{2, 3, 4, 1}},
+		{1, 3, false, []int{2, 1, 3, 4}},
+		{3, 1, true, []int{1, 3, 2, 4}},
+	} {
+		if got := moveID([]int{1, 2, 3, 4}, tc.id, tc.anchor, tc.after); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Expected moving %d next to %d to give %v. Got %v", tc.id, tc.anchor, tc.want, got)
+		}
+	}
+}
+
+func TestPutFirst(t *testing.T) {
+	if got := putFirst([]int{1, 2, 3, 4}, []int{4, 2}); !reflect.DeepEqual(got, []int{4, 2, 1, 3}) {
+		t.Errorf("Expected 4 and 2 ahead of the others. Got %v", got)
+	}
+	if got := putFirst([]int{1, 2}, []int{}); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("Expected the order to stay. Got %v", got)
+	}
+}
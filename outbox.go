@@ -0,0 +1,359 @@
+// outbox.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outboxLockID is the advisory lock serialising writes to the outbox. Holding
+// it until commit makes sequence numbers become visible in order, so a relay
+// that has seen seq n will never later find a committed event below n.
+const outboxLockID = 7305
+
+// catalogEvent is the public form of a change, as written to the outbox and
+// posted to webhook subscribers. Seq orders all events of the catalog.
+type catalogEvent struct {
+	Seq        int64       `json:"seq,omitempty"`
+	Type       string      `json:"type"`
+	OccurredAt time.Time   `json:"occurredAt"`
+	Actor      string      `json:"actor"`
+	RequestID  string      `json:"requestID"`
+	Entity     string      `json:"entity"`
+	EntityID   int         `json:"entityID"`
+	Before     interface{} `json:"before,omitempty"`
+	After      interface{} `json:"after,omitempty"`
+}
+
+func newCatalogEvents(ctx context.Context, changes []change) []catalogEvent {
+	now := time.Now().UTC()
+
+	events := []catalogEvent{}
+	for _, c := range changes {
+		eventType := c.eventType()
+		if eventType == "" {
+			continue
+		}
+
+		events = append(events, catalogEvent{
+			Type:       eventType,
+			OccurredAt: now,
+			Actor:      contextString(ctx, actorKey),
+			RequestID:  contextString(ctx, requestIDKey),
+			Entity:     c.Entity,
+			EntityID:   c.EntityID,
+			Before:     c.Before,
+			After:      c.After,
+		})
+	}
+
+	return events
+}
+
+// writeOutbox assigns the next sequence numbers to events and stores them in
+// the outbox, inside the transaction that made the changes.
+func writeOutbox(tx *sql.Tx, events []catalogEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", outboxLockID); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT nextval(pg_get_serial_sequence('outbox', 'seq')) FROM generate_series(1, $1) ORDER BY 1", len(events))
+	if err != nil {
+		return err
+	}
+	for i := 0; rows.Next(); i++ {
+		if err := rows.Scan(&events[i].Seq); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	records, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO outbox(seq, event_type, entity, entity_id, payload)
+		SELECT (e->>'seq')::bigint, e->>'type', e->>'entity', (e->>'entityID')::integer, e
+		FROM jsonb_array_elements($1::jsonb) AS e`, string(records))
+
+	return err
+}
+
+// getOutboxEvents returns up to count events following seq after, in order.
+func getOutboxEvents(db dbtx, after int64, count int) ([]catalogEvent, error) {
+	rows, err := db.Query("SELECT payload FROM outbox WHERE seq > $1 ORDER BY seq LIMIT $2", after, count)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	events := []catalogEvent{}
+
+	for rows.Next() {
+		var payload []byte
+		var e catalogEvent
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// eventSink is where the outbox relay publishes events to. Publish receives
+// events in sequence order and must only return nil once all of them are
+// stored downstream; on error the whole batch is offered again later, so
+// consumers should skip sequence numbers they have already seen.
+type eventSink interface {
+	// Name identifies the sink's position in the stream across restarts.
+	Name() string
+	Publish(ctx context.Context, events []catalogEvent) error
+}
+
+// messageBroker is the minimal interface a message broker client has to
+// implement to receive catalog events through brokerSink.
+type messageBroker interface {
+	Send(ctx context.Context, topic, key string, value []byte) error
+}
+
+// ndjsonSink writes one JSON document per line, e.g. to stdout or a file.
+type ndjsonSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+func (s *ndjsonSink) Name() string {
+	return s.name
+}
+
+func (s *ndjsonSink) Publish(ctx context.Context, events []catalogEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	encoder := json.NewEncoder(s.w)
+	for _, e := range events {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	if f, ok := s.w.(*os.File); ok {
+		return f.Sync()
+	}
+
+	return nil
+}
+
+// httpSink posts each batch as an NDJSON body to a URL.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) Name() string {
+	return s.url
+}
+
+func (s *httpSink) Publish(ctx context.Context, events []catalogEvent) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, e := range events {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("X-Outbox-First-Seq", strconv.FormatInt(events[0].Seq, 10))
+	req.Header.Set("X-Outbox-Last-Seq", strconv.FormatInt(events[len(events)-1].Seq, 10))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("sink answered %s", res.Status)
+	}
+
+	return nil
+}
+
+// brokerSink sends every event as a message keyed by "<entity>:<id>", so a
+// partitioned broker keeps the events of one entity in order.
+type brokerSink struct {
+	name   string
+	broker messageBroker
+	topic  string
+}
+
+func (s *brokerSink) Name() string {
+	return s.name
+}
+
+func (s *brokerSink) Publish(ctx context.Context, events []catalogEvent) error {
+	for _, e := range events {
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		if err := s.broker.Send(ctx, s.topic, e.Entity+":"+strconv.Itoa(e.EntityID), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newEventSink builds the sink described by spec: "stdout", "file:<path>"
+// or an http(s) URL. Brokers are plugged in through brokerSink in code.
+func newEventSink(spec string) (eventSink, error) {
+	switch {
+	case spec == "stdout":
+		return &ndjsonSink{name: spec, w: os.Stdout}, nil
+	case strings.HasPrefix(spec, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(spec, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &ndjsonSink{name: spec, w: f}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpSink{url: spec, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	default:
+		return nil, errors.New("unknown event sink " + spec)
+	}
+}
+
+// outboxRelay moves events from the outbox to a sink. The position of each
+// sink is kept in outbox_cursor and advanced in the same transaction that
+// locks it, so only one relay per sink publishes at a time.
+type outboxRelay struct {
+	db        *sql.DB
+	sink      eventSink
+	batchSize int
+}
+
+// relayOnce publishes the next batch and returns its size.
+func (r *outboxRelay) relayOnce(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO outbox_cursor(sink) VALUES($1) ON CONFLICT DO NOTHING", r.sink.Name()); err != nil {
+		return 0, err
+	}
+
+	var lastSeq int64
+	if err := tx.QueryRow("SELECT last_seq FROM outbox_cursor WHERE sink=$1 FOR UPDATE", r.sink.Name()).Scan(&lastSeq); err != nil {
+		return 0, err
+	}
+
+	events, err := getOutboxEvents(tx, lastSeq, r.batchSize)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	if err := r.sink.Publish(ctx, events); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE outbox_cursor SET last_seq=$1, updated_at=now() WHERE sink=$2",
+		events[len(events)-1].Seq, r.sink.Name()); err != nil {
+		return 0, err
+	}
+
+	return len(events), tx.Commit()
+}
+
+// StartOutboxRelay publishes outbox events to sink whenever a mutation wrote
+// some, and at least once every interval.
+func (a *App) StartOutboxRelay(sink eventSink, interval time.Duration) {
+	r := &outboxRelay{db: a.DB, sink: sink, batchSize: 500}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-a.outboxWake:
+			}
+
+			for {
+				n, err := r.relayOnce(context.Background())
+				if err != nil {
+					log.Printf("relaying outbox events to %s: %v", sink.Name(), err)
+				}
+				if err != nil || n == 0 {
+					break
+				}
+			}
+		}
+	}()
+}
+
+func (a *App) wakeOutboxRelay() {
+	select {
+	case a.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// getOutbox lets consumers read the event stream from any position, e.g. to
+// rebuild their state from seq 0.
+func (a *App) getOutbox(w http.ResponseWriter, r *http.Request) {
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	after, _ := strconv.ParseInt(r.FormValue("after"), 10, 64)
+
+	if count > 1000 || count < 1 {
+		count = 100
+	}
+	if after < 0 {
+		after = 0
+	}
+
+	events, err := getOutboxEvents(a.DB, after, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,140 @@
+// outbox_test.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type memorySink struct {
+	events []catalogEvent
+	err    error
+}
+
+func (s *memorySink) Name() string {
+	return "memory"
+}
+
+func (s *memorySink) Publish(ctx context.Context, events []catalogEvent) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+type memoryBroker struct {
+	keys []string
+}
+
+func (b *memoryBroker) Send(ctx context.Context, topic, key string, value []byte) error {
+	b.keys = append(b.keys, topic+"/"+key)
+	return nil
+}
+
+func TestOutboxIsWrittenWithMutations(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer([]byte(`{"name":"streamed", "price": 1}`)))
+	executeRequest(req)
+	req, _ = http.NewRequest("POST", "/tag", bytes.NewBuffer([]byte(`{"name":"streamed"}`)))
+	executeRequest(req)
+	req, _ = http.NewRequest("POST", "/product/1/tag/1", nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("GET", "/outbox?after=1", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var events []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &events)
+
+	if len(events) != 2 {
+		t.Fatalf("Expected the 2 events following seq 1. Got %s", response.Body.String())
+	}
+	if events[0]["seq"] != 2.0 || events[0]["type"] != "tag.created" {
+		t.Errorf("Expected tag.created as seq 2. Got %v", events[0])
+	}
+	if events[1]["seq"] != 3.0 || events[1]["type"] != "product.tagged" {
+		t.Errorf("Expected product.tagged as seq 3. Got %v", events[1])
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	clearTable()
+	addTags(1)
+
+	for _, name := range []string{"first", "second"} {
+		req, _ := http.NewRequest("PUT", "/tag/1", bytes.NewBuffer([]byte(`{"name":"`+name+`"}`)))
+		executeRequest(req)
+	}
+
+	failing := &outboxRelay{db: a.DB, sink: &memorySink{err: errors.New("down")}, batchSize: 10}
+	if _, err := failing.relayOnce(context.Background()); err == nil {
+		t.Fatalf("Expected the failing sink to report an error")
+	}
+
+	sink := &memorySink{}
+	relay := &outboxRelay{db: a.DB, sink: sink, batchSize: 1}
+
+	for i := 0; i < 3; i++ {
+		if _, err := relay.relayOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(sink.events) != 2 || sink.events[0].Seq != 1 || sink.events[1].Seq != 2 {
+		t.Errorf("Expected seq 1 and 2 to be published exactly once, in order. Got %v", sink.events)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var lines []catalogEvent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var e catalogEvent
+			json.Unmarshal(scanner.Bytes(), &e)
+			lines = append(lines, e)
+		}
+		if r.Header.Get("X-Outbox-Last-Seq") != "8" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer receiver.Close()
+
+	sink, err := newEventSink(receiver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []catalogEvent{{Seq: 7, Type: "tag.created"}, {Seq: 8, Type: "tag.deleted"}}
+	if err := sink.Publish(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lines) != 2 || lines[1].Type != "tag.deleted" {
+		t.Errorf("Expected both events as NDJSON lines. Got %v", lines)
+	}
+}
+
+func TestBrokerSink(t *testing.T) {
+	broker := &memoryBroker{}
+	sink := &brokerSink{name: "broker", broker: broker, topic: "catalog"}
+
+	events := []catalogEvent{{Seq: 1, Entity: "product", EntityID: 4}, {Seq: 2, Entity: "tag", EntityID: 2}}
+	if err := sink.Publish(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(broker.keys) != 2 || broker.keys[0] != "catalog/product:4" || broker.keys[1] != "catalog/tag:2" {
+		t.Errorf("Expected messages keyed by entity. Got %v", broker.keys)
+	}
+}
@@ -0,0 +1,377 @@
+// patch.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	mergePatchMediaType = "application/merge-patch+json"
+	jsonPatchMediaType  = "application/json-patch+json"
+)
+
+var (
+	// errInvalidPatch is returned when the patch document itself is malformed.
+	errInvalidPatch = errors.New("invalid patch document")
+	// errPatchTestFailed is returned when a JSON Patch "test" operation does not match.
+	errPatchTestFailed = errors.New("patch test operation failed")
+)
+
+// patchFuncs maps the supported PATCH media types to the function applying them.
+var patchFuncs = map[string]func(doc, patch []byte) ([]byte, error){
+	mergePatchMediaType: applyMergePatch,
+	jsonPatchMediaType:  applyJSONPatch,
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7386) to doc.
+func applyMergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decodeJSONValue(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := decodeJSONValue(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidPatch, err)
+	}
+
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+
+	return t
+}
+
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies a JSON Patch (RFC 6902) to doc. Either every
+// operation succeeds or an error is returned and doc is left untouched.
+func applyJSONPatch(doc, patch []byte) ([]byte, error) {
+	var ops []patchOperation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidPatch, err)
+	}
+
+	target, err := decodeJSONValue(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		if target, err = op.apply(target); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+
+	return json.Marshal(target)
+}
+
+func (op patchOperation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		value, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		value, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, _, err = removeValue(doc, path); err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Path == op.From {
+			return doc, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("%w: cannot move a value into one of its children", errInvalidPatch)
+		}
+		doc, value, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = deepCopy(value); err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "test":
+		expected, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		actual, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(actual, expected) {
+			return nil, errPatchTestFailed
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown operation %q", errInvalidPatch, op.Op)
+	}
+}
+
+func (op patchOperation) value() (interface{}, error) {
+	if op.Value == nil {
+		return nil, fmt.Errorf("%w: missing value", errInvalidPatch)
+	}
+
+	return decodeJSONValue(op.Value)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q must start with '/'", errInvalidPatch, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path member %q does not exist", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("path member %q does not exist", token)
+		}
+	}
+
+	return doc, nil
+}
+
+// updateIn walks down to the container addressed by all but the last path
+// token and replaces it with the result of fn. Arrays may be reallocated by
+// fn, which is why every level is written back on the way up.
+func updateIn(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	child, err := getValue(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+
+	child, err = updateIn(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(node)-1)
+		node[i] = child
+	}
+
+	return doc, nil
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateIn(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			if token == "-" {
+				return append(node, value), nil
+			}
+			i, err := arrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("cannot add member %q to a scalar value", token)
+		}
+	})
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: cannot remove the whole document", errInvalidPatch)
+	}
+
+	var removed interface{}
+	doc, err := updateIn(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path member %q does not exist", token)
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[i]
+			return append(node[:i], node[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("path member %q does not exist", token)
+		}
+	})
+
+	return doc, removed, err
+}
+
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+
+	return i, nil
+}
+
+// decodeJSONValue decodes data into the generic representation used by the
+// patch functions. Numbers are kept as json.Number to avoid precision loss.
+func decodeJSONValue(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func deepCopy(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeJSONValue(data)
+}
+
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, errX := x.Float64()
+		fy, errY := y.Float64()
+		return errX == nil && errY == nil && fx == fy
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,102 @@
+// patch_test.go
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApplyMergePatch(t *testing.T) {
+	doc := []byte(`{"id":1,"name":"shoe","price":10,"meta":{"a":1,"b":2}}`)
+
+	tests := []struct {
+		patch    string
+		expected string
+	}{
+		{`{"price":5}`, `{"id":1,"name":"shoe","price":5,"meta":{"a":1,"b":2}}`},
+		{`{"name":null}`, `{"id":1,"price":10,"meta":{"a":1,"b":2}}`},
+		{`{"meta":{"b":null,"c":3}}`, `{"id":1,"name":"shoe","price":10,"meta":{"a":1,"c":3}}`},
+	}
+
+	for _, test := range tests {
+		patched, err := applyMergePatch(doc, []byte(test.patch))
+		if err != nil {
+			t.Fatalf("Expected patch %s to apply. Got %v", test.patch, err)
+		}
+		checkSameJSON(t, test.expected, patched)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	doc := []byte(`{"name":"shoe","price":10,"list":[1,2,3]}`)
+
+	tests := []struct {
+		patch    string
+		expected string
+	}{
+		{`[{"op":"replace","path":"/price","value":5}]`, `{"name":"shoe","price":5,"list":[1,2,3]}`},
+		{`[{"op":"add","path":"/list/1","value":9}]`, `{"name":"shoe","price":10,"list":[1,9,2,3]}`},
+		{`[{"op":"add","path":"/list/-","value":4}]`, `{"name":"shoe","price":10,"list":[1,2,3,4]}`},
+		{`[{"op":"remove","path":"/list/0"}]`, `{"name":"shoe","price":10,"list":[2,3]}`},
+		{`[{"op":"move","from":"/name","path":"/title"}]`, `{"title":"shoe","price":10,"list":[1,2,3]}`},
+		{`[{"op":"copy","from":"/price","path":"/list/0"}]`, `{"name":"shoe","price":10,"list":[10,1,2,3]}`},
+		{`[{"op":"test","path":"/price","value":10.0},{"op":"remove","path":"/name"}]`, `{"price":10,"list":[1,2,3]}`},
+	}
+
+	for _, test := range tests {
+		patched, err := applyJSONPatch(doc, []byte(test.patch))
+		if err != nil {
+			t.Fatalf("Expected patch %s to apply. Got %v", test.patch, err)
+		}
+		checkSameJSON(t, test.expected, patched)
+	}
+}
+
+func TestApplyJSONPatchErrors(t *testing.T) {
+	doc := []byte(`{"name":"shoe","price":10}`)
+
+	if _, err := applyJSONPatch(doc, []byte(`{"op":"add"}`)); !errors.Is(err, errInvalidPatch) {
+		t.Errorf("Expected a non-array patch to be invalid. Got %v", err)
+	}
+
+	if _, err := applyJSONPatch(doc, []byte(`[{"op":"frobnicate","path":"/name"}]`)); !errors.Is(err, errInvalidPatch) {
+		t.Errorf("Expected an unknown operation to be invalid. Got %v", err)
+	}
+
+	if _, err := applyJSONPatch(doc, []byte(`[{"op":"test","path":"/price","value":11}]`)); !errors.Is(err, errPatchTestFailed) {
+		t.Errorf("Expected the test operation to fail. Got %v", err)
+	}
+
+	if _, err := applyJSONPatch(doc, []byte(`[{"op":"remove","path":"/missing"}]`)); err == nil {
+		t.Errorf("Expected removing a missing member to fail")
+	}
+}
+
+func TestPatchDocumentKeepsRequiredFields(t *testing.T) {
+	current := product{ID: 1, Name: "shoe", Price: 10}
+
+	for patch, apply := range map[string]func(doc, patch []byte) ([]byte, error){
+		`{"price":null}`:                    applyMergePatch,
+		`[{"op":"remove","path":"/price"}]`: applyJSONPatch,
+	} {
+		var p product
+		var invalid validationError
+		if err := patchDocument(apply, current, []byte(patch), &p, &productInput{}); !errors.As(err, &invalid) {
+			t.Errorf("Expected %s to be rejected. Got %v %v", patch, p, err)
+		}
+	}
+
+	var p product
+	if err := patchDocument(applyMergePatch, current, []byte(`{"price":0}`), &p, &productInput{}); err != nil || p.Price != 0 {
+		t.Errorf("Expected an explicit zero price to be kept. Got %v %v", p, err)
+	}
+}
+
+func checkSameJSON(t *testing.T, expected string, actual []byte) {
+	e, _ := decodeJSONValue([]byte(expected))
+	a, _ := decodeJSONValue(actual)
+	if !jsonEqual(e, a) {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+}
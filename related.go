@@ -0,0 +1,149 @@
+// related.go
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// relatedRank orders related products, see ?rank=.
+type relatedRank string
+
+const (
+	// rankBySharedTags puts the products sharing the most tags first
+	rankBySharedTags relatedRank = "shared"
+	// rankByJaccard puts the products whose tags are most alike first: the
+	// shared tags divided by the tags either product has, so a product
+	// with a hundred tags does not come first for sharing a few of them
+	rankByJaccard relatedRank = "jaccard"
+)
+
+func parseRelatedRank(value string) (relatedRank, error) {
+	switch r := relatedRank(value); r {
+	case "":
+		return rankBySharedTags, nil
+	case rankBySharedTags, rankByJaccard:
+		return r, nil
+	default:
+		return "", errors.New("rank must be one of shared or jaccard")
+	}
+}
+
+func (r relatedRank) orderBy() string {
+	if r == rankByJaccard {
+		return "similarity DESC, shared DESC, products.id"
+	}
+
+	return "shared DESC, similarity DESC, products.id"
+}
+
+// relatedProduct is a product sharing tags with another one.
+type relatedProduct struct {
+	product
+	SharedTags int `json:"sharedTags"`
+	// Similarity is the Jaccard index of the tags of both products
+	Similarity float64 `json:"similarity"`
+}
+
+// getRelatedProducts returns a page of the active products sharing at least
+// minShared tags with product id, which is left out. Only the assignments of
+// the tags of the product are read, through the (tagID, productID) index, and
+// the tag counts the similarity needs only for the products found that way,
+// so the cost grows with how common its tags are rather than with the size
+// of the catalog.
+func getRelatedProducts(db dbtx, id, minShared int, rank relatedRank, start, count int) ([]relatedProduct, error) {
+	rows, err := db.Query(`WITH own AS (
+			SELECT DISTINCT tagID FROM productToTagAssignment WHERE productID=$1 AND deleted_at IS NULL
+		), shared AS (
+			SELECT pta.productID, COUNT(DISTINCT pta.tagID) AS shared
+			FROM own JOIN productToTagAssignment pta ON pta.tagID = own.tagID AND pta.deleted_at IS NULL
+			WHERE pta.productID <> $1
+			GROUP BY pta.productID
+			HAVING COUNT(DISTINCT pta.tagID) >= $2
+		), sizes AS (
+			SELECT pta.productID, COUNT(DISTINCT pta.tagID) AS size
+			FROM shared JOIN productToTagAssignment pta ON pta.productID = shared.productID AND pta.deleted_at IS NULL
+			GROUP BY pta.productID
+		)
+		SELECT products.id, products.name, products.price, shared.shared,
+			shared.shared::float8 / (sizes.size + (SELECT COUNT(*) FROM own) - shared.shared) AS similarity
+		FROM shared
+		JOIN sizes ON sizes.productID = shared.productID
+		JOIN products ON products.id = shared.productID AND products.deleted_at IS NULL
+		ORDER BY `+rank.orderBy()+` LIMIT $3 OFFSET $4`,
+		id, minShared, count, start)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	related := []relatedProduct{}
+
+	for rows.Next() {
+		var p relatedProduct
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.SharedTags, &p.Similarity); err != nil {
+			return nil, err
+		}
+		related = append(related, p)
+	}
+
+	return related, rows.Err()
+}
+
+func (a *App) getRelatedProducts(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	if count > 10 || count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	rank, err := parseRelatedRank(r.FormValue("rank"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	minShared := 1
+	if value := r.FormValue("minShared"); value != "" {
+		if minShared, err = strconv.Atoi(value); err != nil || minShared < 1 {
+			respondWithError(w, http.StatusBadRequest, "minShared must be a positive number")
+			return
+		}
+	}
+
+	p := product{ID: id}
+	if err := p.getProduct(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	related, err := getRelatedProducts(a.DB, id, minShared, rank, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, related)
+}
@@ -0,0 +1,82 @@
+// related_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestRelatedProducts(t *testing.T) {
+	clearTable()
+	addProducts(4)
+	addTags(4)
+	// product 1 has tags 1 to 3, product 2 shares two of them out of four,
+	// product 3 shares one of one and product 4 none
+	for _, tagID := range []int{1, 2, 3} {
+		addTagAssignment(1, tagID)
+	}
+	for _, tagID := range []int{1, 2, 4} {
+		addTagAssignment(2, tagID)
+	}
+	addTagAssignment(3, 3)
+	addTagAssignment(4, 4)
+
+	req, _ := http.NewRequest("GET", "/product/1/related", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var related []relatedProduct
+	json.Unmarshal(response.Body.Bytes(), &related)
+	if len(related) != 2 || related[0].ID != 2 || related[0].SharedTags != 2 || related[1].ID != 3 {
+		t.Fatalf("Expected products 2 and 3 by shared tags. Got %s", response.Body.String())
+	}
+	if related[0].Similarity != 0.5 {
+		t.Errorf("Expected product 2 to share 2 of 4 tags. Got %v", related[0].Similarity)
+	}
+
+	req, _ = http.NewRequest("GET", "/product/3/related?rank=jaccard", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &related)
+	if len(related) != 1 || related[0].ID != 1 {
+		t.Errorf("Expected only product 1. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/product/1/related?minShared=2", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &related)
+	if len(related) != 1 || related[0].ID != 2 {
+		t.Errorf("Expected only product 2 to share two tags. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/product/1/related?start=1&count=1", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &related)
+	if len(related) != 1 || related[0].ID != 3 {
+		t.Errorf("Expected the second page to hold product 3. Got %s", response.Body.String())
+	}
+
+	for url, code := range map[string]int{
+		"/product/9/related":             http.StatusNotFound,
+		"/product/1/related?rank=random": http.StatusBadRequest,
+		"/product/1/related?minShared=0": http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if response := executeRequest(req); response.Code != code {
+			t.Errorf("Expected %d for %s. Got %d", code, url, response.Code)
+		}
+	}
+}
+
+func TestParseRelatedRank(t *testing.T) {
+	if rank, err := parseRelatedRank(""); err != nil || rank != rankBySharedTags {
+		t.Errorf("Expected shared tags by default. Got %q %v", rank, err)
+	}
+	if rank, _ := parseRelatedRank("jaccard"); rank.orderBy() != "similarity DESC, shared DESC, products.id" {
+		t.Errorf("Expected the most similar products first. Got %s", rank.orderBy())
+	}
+	if _, err := parseRelatedRank("random"); err == nil {
+		t.Errorf("Expected an unknown rank to be rejected")
+	}
+}
@@ -0,0 +1,333 @@
+// rules.go
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Smart tags are tags whose products are selected by a rule instead of
+// being assigned by hand. A rule is a product filter expression, see
+// filter.go, such as
+//
+//	price < 10
+//	tag = "running" and price < 50
+//
+// The assignments of smart tags are stored like any other, so they show up
+// in every list of tags and products. They are brought up to date in the
+// transaction of every change to products, assignments or tags, as far as
+// the change can affect them, and by a periodic job. Rules only see the tags
+// assigned by hand, so no rule depends on another one and evaluating them
+// once in any order is enough.
+
+// maxRuleLength caps the length of rules, which are evaluated often.
+const maxRuleLength = 1000
+
+// checkRule makes sure the rule of t, if it has one, is a valid filter
+// expression.
+func (t *tag) checkRule() error {
+	if t.Rule == "" {
+		return nil
+	}
+	if len(t.Rule) > maxRuleLength {
+		return validationError("Rule must not be longer than " + strconv.Itoa(maxRuleLength) + " characters")
+	}
+
+	if _, err := parseProductFilter(t.Rule); err != nil {
+		return validationError("Invalid rule: " + err.Error())
+	}
+
+	return nil
+}
+
+// smartTagError rejects assigning or removing smart tags by hand.
+func smartTagError(id int) error {
+	return validationError("Tag " + strconv.Itoa(id) + " is a smart tag, its products are selected by its rule")
+}
+
+// handAssignedTagsOnly makes the tag conditions of expr ignore smart tags.
+func handAssignedTagsOnly(expr filterExpr) filterExpr {
+	switch e := expr.(type) {
+	case filterAnd:
+		return filterAnd{handAssignedTagsOnly(e.left), handAssignedTagsOnly(e.right)}
+	case filterOr:
+		return filterOr{handAssignedTagsOnly(e.left), handAssignedTagsOnly(e.right)}
+	case filterNot:
+		return filterNot{handAssignedTagsOnly(e.expr)}
+	case filterComparison:
+		e.handAssigned = true
+		return e
+	default:
+		return expr
+	}
+}
+
+// checkHandAssigned rejects changing the assignments of tag id by hand if
+// it is a smart tag. A tag that does not exist passes, so the caller can
+// report it the way it does otherwise.
+func checkHandAssigned(db dbtx, id int) error {
+	t := tag{ID: id}
+	switch err := t.getTag(db); {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	case t.Rule != "":
+		return smartTagError(id)
+	default:
+		return nil
+	}
+}
+
+// getSmartTags returns the active smart tags.
+func getSmartTags(db dbtx) ([]tag, error) {
+	rows, err := db.Query("SELECT id, name, parent_id, key, value, rule FROM tag WHERE rule <> '' AND deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tags := []tag{}
+
+	for rows.Next() {
+		var t tag
+		if err := rows.Scan(&t.ID, &t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+
+	return tags, rows.Err()
+}
+
+// applyTagRule assigns smart tag t to the active products matching its rule
+// and removes it from the others. Only the products in productIDs are
+// looked at, or all of them if productIDs is nil.
+func applyTagRule(tx *sql.Tx, cs *changeSet, t tag, productIDs []int) error {
+	rule, err := parseProductFilter(t.Rule)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{t.ID}
+	productScope, assignmentScope := "", ""
+	if productIDs != nil {
+		args = append(args, pq.Array(productIDs))
+		productScope = " AND products.id = ANY($2)"
+		assignmentScope = " AND pta.productID = ANY($2)"
+	}
+	condition := handAssignedTagsOnly(rule).sql(&args)
+
+	rows, err := tx.Query(`INSERT INTO productToTagAssignment(productID, tagID)
+		SELECT products.id, $1 FROM products
+		WHERE products.deleted_at IS NULL`+productScope+` AND `+condition+`
+		AND NOT EXISTS (SELECT 1 FROM productToTagAssignment pta
+			WHERE pta.productID = products.id AND pta.tagID = $1 AND pta.deleted_at IS NULL)
+		ORDER BY products.id
+		RETURNING id, productID, tagID`, args...)
+	if err != nil {
+		return err
+	}
+	added, err := scanAssignments(rows)
+	if err != nil {
+		return err
+	}
+
+	rows, err = tx.Query(`DELETE FROM productToTagAssignment pta
+		WHERE pta.tagID = $1 AND pta.deleted_at IS NULL`+assignmentScope+`
+		AND NOT EXISTS (SELECT 1 FROM products
+			WHERE products.id = pta.productID AND products.deleted_at IS NULL AND `+condition+`)
+		RETURNING id, productID, tagID`, args...)
+	if err != nil {
+		return err
+	}
+	removed, err := scanAssignments(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, pta := range added {
+		cs.record("assignment", pta.ID, "created", nil, pta)
+	}
+	for _, pta := range removed {
+		cs.record("assignment", pta.ID, "deleted", pta, nil)
+	}
+	return nil
+}
+
+// applyTagRules applies every rule to all products.
+func applyTagRules(tx *sql.Tx, cs *changeSet) error {
+	smart, err := getSmartTags(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range smart {
+		if err := applyTagRule(tx, cs, t, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ruleScope tells which smart tags may be out of date after the changes of
+// a transaction.
+type ruleScope struct {
+	// productIDs are the products that changed or whose tags changed; every
+	// rule is applied to them
+	productIDs []int
+	// tagNames and facetKeys hold the lower-cased names, aliases and facet
+	// keys of the tags that changed; the rules mentioning one of them are
+	// applied to all products
+	tagNames, facetKeys map[string]bool
+	// ruleIDs are the smart tags whose rule is new or changed, which are
+	// applied to all products as well
+	ruleIDs map[int]bool
+}
+
+// newRuleScope works out the scope of changes. Reorders are left out, since
+// they do not change what any rule selects, and so are changes made outside
+// the service, which StartTagRuleJob catches up with.
+func newRuleScope(changes []change) ruleScope {
+	s := ruleScope{tagNames: map[string]bool{}, facetKeys: map[string]bool{}, ruleIDs: map[int]bool{}}
+
+	for _, c := range changes {
+		switch c.Entity {
+		case "product":
+			s.productIDs = append(s.productIDs, c.EntityID)
+		case "assignment":
+			for _, v := range []interface{}{c.Before, c.After} {
+				if pta, ok := v.(productToTagAssignment); ok {
+					s.productIDs = append(s.productIDs, pta.ProductID)
+				}
+			}
+		case "tag":
+			before, _ := c.Before.(tag)
+			after, hasAfter := c.After.(tag)
+			for _, t := range []tag{before, after} {
+				if t.Name != "" {
+					s.tagNames[strings.ToLower(t.Name)] = true
+				}
+				if t.Key != "" {
+					s.facetKeys[strings.ToLower(t.Key)] = true
+				}
+			}
+			if hasAfter && after.Rule != "" && after.Rule != before.Rule {
+				s.ruleIDs[after.ID] = true
+			}
+		case "alias":
+			for _, v := range []interface{}{c.Before, c.After} {
+				if ta, ok := v.(tagAlias); ok {
+					s.tagNames[strings.ToLower(ta.Alias)] = true
+				}
+			}
+		}
+	}
+
+	s.productIDs = uniqueIDs(s.productIDs)
+	return s
+}
+
+// coversAll tells whether the rule of smart tag t has to be applied to all
+// products.
+func (s ruleScope) coversAll(t tag) bool {
+	if s.ruleIDs[t.ID] {
+		return true
+	}
+	if len(s.tagNames) == 0 && len(s.facetKeys) == 0 {
+		return false
+	}
+
+	rule, err := parseProductFilter(t.Rule)
+	return err == nil && s.mentionedIn(rule)
+}
+
+// mentionedIn tells whether expr has a condition on one of the changed tag
+// names or facet keys.
+func (s ruleScope) mentionedIn(expr filterExpr) bool {
+	switch e := expr.(type) {
+	case filterAnd:
+		return s.mentionedIn(e.left) || s.mentionedIn(e.right)
+	case filterOr:
+		return s.mentionedIn(e.left) || s.mentionedIn(e.right)
+	case filterNot:
+		return s.mentionedIn(e.expr)
+	case filterComparison:
+		if e.field == "tag" {
+			name, _ := e.value.(string)
+			return s.tagNames[strings.ToLower(name)]
+		}
+		return s.facetKeys[strings.TrimPrefix(e.field, facetParamPrefix)]
+	default:
+		return false
+	}
+}
+
+// updateSmartTags brings the smart tags up to date with the changes recorded
+// so far in cs. The assignments it makes and removes are recorded as well.
+func updateSmartTags(tx *sql.Tx, cs *changeSet) error {
+	s := newRuleScope(cs.changes)
+	if len(s.productIDs) == 0 && len(s.tagNames) == 0 && len(s.facetKeys) == 0 && len(s.ruleIDs) == 0 {
+		return nil
+	}
+
+	smart, err := getSmartTags(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range smart {
+		switch {
+		case s.coversAll(t):
+			err = applyTagRule(tx, cs, t, nil)
+		case len(s.productIDs) > 0:
+			err = applyTagRule(tx, cs, t, s.productIDs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getSmartTagIDs returns the IDs of the active smart tags.
+func getSmartTagIDs(db dbtx) (map[int]bool, error) {
+	smart, err := getSmartTags(db)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[int]bool{}
+	for _, t := range smart {
+		ids[t.ID] = true
+	}
+
+	return ids, nil
+}
+
+// StartTagRuleJob applies all rules to all products once every interval,
+// catching up with changes made outside the service.
+func (a *App) StartTagRuleJob(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := a.inTx(systemContext(), func(tx *sql.Tx, cs *changeSet) error {
+				return applyTagRules(tx, cs)
+			})
+			if err != nil {
+				log.Printf("applying tag rules: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,136 @@
+// rules_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func tagNamesOfProduct(t *testing.T, productID string) []string {
+	req, _ := http.NewRequest("GET", "/product/"+productID+"/tags", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var tags []tag
+	json.Unmarshal(response.Body.Bytes(), &tags)
+	names := []string{}
+	for _, tg := range tags {
+		names = append(names, tg.Name)
+	}
+
+	return names
+}
+
+func TestSmartTags(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addTags(1)
+	addTagAssignment(1, 1)
+	addTagAssignment(3, 1)
+
+	for _, body := range []string{
+		`{"name":"budget","rule":"price < 25"}`,
+		`{"name":"tagged-budget","rule":"tag = 'Tag 0' and price < 25"}`,
+	} {
+		req, _ := http.NewRequest("POST", "/tag", bytes.NewBufferString(body))
+		checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	}
+
+	products, _ := getProductsWithTagAssigned(a.DB, 2, 0, 10, false)
+	if len(products) != 2 || products[0].ID != 1 || products[1].ID != 2 {
+		t.Errorf("Expected the products below 25 to be budget. Got %v", products)
+	}
+	products, _ = getProductsWithTagAssigned(a.DB, 3, 0, 10, false)
+	if len(products) != 1 || products[0].ID != 1 {
+		t.Errorf("Expected only product 1 to be tagged-budget. Got %v", products)
+	}
+
+	// a cheaper product moves into both smart tags
+	req, _ := http.NewRequest("PUT", "/product/3", bytes.NewBufferString(`{"name":"Product 2","price":15}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	if names := tagNamesOfProduct(t, "3"); len(names) != 3 {
+		t.Errorf("Expected product 3 to have Tag 0 and both smart tags. Got %v", names)
+	}
+
+	// replacing the tags by hand leaves the smart tags to their rules
+	req, _ = http.NewRequest("PUT", "/product/1/tags", bytes.NewBufferString(`{"tagIDs":[]}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	if names := tagNamesOfProduct(t, "1"); len(names) != 1 || names[0] != "budget" {
+		t.Errorf("Expected product 1 to stay budget only. Got %v", names)
+	}
+
+	for _, method := range []string{"POST", "DELETE"} {
+		req, _ := http.NewRequest(method, "/product/2/tag/2", nil)
+		if response := executeRequest(req); response.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected %s of a smart tag to be rejected. Got %d", method, response.Code)
+		}
+	}
+
+	// a rule changed through the tag API applies right away
+	req, _ = http.NewRequest("PATCH", "/tag/2", bytes.NewBufferString(`{"rule":"price >= 20"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	products, _ = getProductsWithTagAssigned(a.DB, 2, 0, 10, false)
+	if len(products) != 1 || products[0].ID != 2 {
+		t.Errorf("Expected only product 2 to be budget now. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("POST", "/tag", bytes.NewBufferString(`{"name":"broken","rule":"price <"}`))
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+}
+
+func TestHandAssignedTagsOnly(t *testing.T) {
+	expr, _ := parseProductFilter(`price < 50 and not tag = "running"`)
+
+	args := []interface{}{}
+	if sql := expr.sql(&args); strings.Contains(sql, "ftag.rule") {
+		t.Errorf("Expected filters to see smart tags. Got %s", sql)
+	}
+	args = []interface{}{}
+	if sql := handAssignedTagsOnly(expr).sql(&args); !strings.Contains(sql, "ftag.rule = ''") {
+		t.Errorf("Expected rules to only see tags assigned by hand. Got %s", sql)
+	}
+}
+
+func TestRuleScope(t *testing.T) {
+	s := newRuleScope([]change{
+		{Entity: "product", EntityID: 3},
+		{Entity: "assignment", EntityID: 7, Before: productToTagAssignment{ID: 7, ProductID: 1, TagID: 2}},
+		{Entity: "webhook", EntityID: 1},
+	})
+	if len(s.productIDs) != 2 || s.productIDs[0] != 1 || s.productIDs[1] != 3 {
+		t.Errorf("Expected products 1 and 3. Got %v", s.productIDs)
+	}
+
+	s = newRuleScope([]change{
+		{Entity: "tag", EntityID: 1, Action: "updated", Before: tag{ID: 1, Name: "Running"}, After: tag{ID: 1, Name: "Jogging"}},
+		{Entity: "alias", EntityID: 1, Action: "created", After: tagAlias{ID: 1, Alias: "Trail", TagID: 1}},
+		{Entity: "tag", EntityID: 2, Action: "updated", Before: tag{ID: 2, Name: "red", Key: "color", Value: "red"}, After: tag{ID: 2, Name: "red", Key: "color", Value: "Red"}},
+	})
+	for rule, want := range map[string]bool{
+		`tag = "running" and price < 50`: true,
+		`not tag = "JOGGING"`:            true,
+		`tag = "trail" or id = 1`:        true,
+		`tag.color = "blue"`:             true,
+		`tag = "hiking"`:                 false,
+		`price < 10`:                     false,
+	} {
+		if got := s.coversAll(tag{ID: 5, Rule: rule}); got != want {
+			t.Errorf("Expected %q to be applied to all products: %v. Got %v", rule, want, got)
+		}
+	}
+
+	s = newRuleScope([]change{{Entity: "tag", EntityID: 5, Action: "updated", Before: tag{ID: 5, Name: "cheap", Rule: "price < 10"}, After: tag{ID: 5, Name: "cheap", Rule: "price < 20"}}})
+	if !s.coversAll(tag{ID: 5, Rule: "price < 20"}) || s.coversAll(tag{ID: 6, Rule: "price < 30"}) {
+		t.Errorf("Expected only the changed rule to be applied to all products")
+	}
+
+	s = newRuleScope([]change{{Entity: "product_order", EntityID: 1, Action: "updated", Before: productOrder{ProductIDs: []int{1, 2}}, After: productOrder{ProductIDs: []int{2, 1}}}})
+	if len(s.productIDs) != 0 || len(s.tagNames) != 0 || s.coversAll(tag{ID: 1, Rule: `tag = "x"`}) {
+		t.Errorf("Expected reordering the products of a tag to affect none. Got %v", s)
+	}
+}
@@ -0,0 +1,77 @@
+// suggest.go
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxSuggestions caps the page size of tag suggestions.
+const maxSuggestions = 25
+
+// tagSuggestion is a tag matching what the user typed so far, with the
+// number of products that have it.
+type tagSuggestion struct {
+	tag
+	Usage int `json:"usage"`
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// suggestTags returns up to count active tags whose name or one of whose
+// aliases starts with prefix, ignoring case and accents. The most used tags
+// come first. The trigram indexes on tag_search_key serve the prefix match.
+func suggestTags(db dbtx, prefix string, count int) ([]tagSuggestion, error) {
+	rows, err := db.Query(`WITH matches AS (
+			SELECT id FROM tag WHERE deleted_at IS NULL AND tag_search_key(name) LIKE tag_search_key($1) || '%'
+			UNION
+			SELECT tag_id FROM tag_alias WHERE tag_search_key(alias) LIKE tag_search_key($1) || '%'
+		)
+		SELECT tag.id, tag.name, tag.parent_id, tag.key, tag.value, tag.rule, COUNT(pta.id) AS usage
+		FROM matches JOIN tag ON tag.id = matches.id AND tag.deleted_at IS NULL
+		LEFT JOIN productToTagAssignment pta ON pta.tagID = tag.id AND pta.deleted_at IS NULL
+		GROUP BY tag.id
+		ORDER BY usage DESC, tag.name, tag.id LIMIT $2`,
+		likeEscaper.Replace(prefix), count)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	suggestions := []tagSuggestion{}
+
+	for rows.Next() {
+		var s tagSuggestion
+		if err := rows.Scan(&s.ID, &s.Name, &s.ParentID, &s.Key, &s.Value, &s.Rule, &s.Usage); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, s)
+	}
+
+	return suggestions, rows.Err()
+}
+
+func (a *App) suggestTags(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimSpace(r.FormValue("prefix"))
+	if prefix == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: prefix")
+		return
+	}
+
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	if count > maxSuggestions || count < 1 {
+		count = 10
+	}
+
+	suggestions, err := suggestTags(a.DB, prefix, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, suggestions)
+}
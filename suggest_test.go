@@ -0,0 +1,66 @@
+// suggest_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestSuggestTags(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	for _, name := range []string{"Running", "Rüstung", "Rugby", "Tennis"} {
+		tg := tag{Name: name}
+		tg.createTag(a.DB)
+	}
+	addTagAssignment(1, 3)
+	addTagAssignment(2, 3)
+	addTagAssignment(1, 2)
+	a.DB.Exec("INSERT INTO tag_alias(alias, tag_id) VALUES('Rucksack', 4)")
+
+	req, _ := http.NewRequest("GET", "/tags/suggest?prefix=RU", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var suggestions []tagSuggestion
+	json.Unmarshal(response.Body.Bytes(), &suggestions)
+
+	expected := []string{"Rugby", "Rüstung", "Running", "Tennis"}
+	if len(suggestions) != len(expected) {
+		t.Fatalf("Expected %v. Got %s", expected, response.Body.String())
+	}
+	for i, name := range expected {
+		if suggestions[i].Name != name {
+			t.Errorf("Expected %s at %d. Got %s", name, i, suggestions[i].Name)
+		}
+	}
+	if suggestions[0].Usage != 2 {
+		t.Errorf("Expected Rugby to be used twice. Got %d", suggestions[0].Usage)
+	}
+
+	req, _ = http.NewRequest("GET", "/tags/suggest?prefix="+url.QueryEscape("rüs")+"&count=1", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &suggestions)
+	if len(suggestions) != 1 || suggestions[0].Name != "Rüstung" {
+		t.Errorf("Expected Rüstung. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/tags/suggest?prefix=%25", nil)
+	response = executeRequest(req)
+	if body := response.Body.String(); body != "[]" {
+		t.Errorf("Expected %% to match literally. Got %s", body)
+	}
+
+	req, _ = http.NewRequest("GET", "/tags/suggest", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestLikeEscaper(t *testing.T) {
+	if escaped := likeEscaper.Replace(`50%_off\`); escaped != `50\%\_off\\` {
+		t.Errorf("Expected the wildcards to be escaped. Got %s", escaped)
+	}
+}
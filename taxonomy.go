@@ -0,0 +1,214 @@
+// taxonomy.go
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// tagTreeLockID is the advisory lock serialising changes of tag parents.
+// Without it two transactions could each pass the cycle check, one moving A
+// below B and the other B below A.
+const tagTreeLockID = 7306
+
+// breadcrumbSeparator joins the tag names of a breadcrumb path.
+const breadcrumbSeparator = " > "
+
+// breadcrumb is the path from the top-level tag down to a tag.
+type breadcrumb struct {
+	Tags []tag  `json:"tags"`
+	Path string `json:"path"`
+}
+
+// checkParent makes sure t can be placed below t.ParentID: the parent must be
+// an active tag and neither t itself nor one of its descendants.
+func (t *tag) checkParent(tx *sql.Tx) error {
+	if t.ParentID == nil {
+		return nil
+	}
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", tagTreeLockID); err != nil {
+		return err
+	}
+
+	// walk up from the new parent; finding t on the way means a cycle
+	var cycle sql.NullBool
+	err := tx.QueryRow(`WITH RECURSIVE ancestors(id, parent_id) AS (
+			SELECT id, parent_id FROM tag WHERE id=$1 AND deleted_at IS NULL
+			UNION
+			SELECT tag.id, tag.parent_id FROM tag JOIN ancestors ON tag.id = ancestors.parent_id
+		)
+		SELECT bool_or(id = $2) FROM ancestors`, *t.ParentID, t.ID).Scan(&cycle)
+	if err != nil {
+		return err
+	}
+
+	if !cycle.Valid {
+		return validationError("Parent tag " + strconv.Itoa(*t.ParentID) + " not found")
+	}
+	if cycle.Bool {
+		return validationError("A tag cannot be placed below itself or one of its descendants")
+	}
+
+	return nil
+}
+
+// getTagPath returns the active tags from the top of the hierarchy down to
+// the tag id, which comes last. A trashed ancestor ends the path. It returns
+// sql.ErrNoRows if the tag does not exist.
+func getTagPath(db dbtx, id int) ([]tag, error) {
+	rows, err := db.Query(`WITH RECURSIVE ancestors(id, name, parent_id, key, value, rule, depth) AS (
+			SELECT id, name, parent_id, key, value, rule, 0 FROM tag WHERE id=$1 AND deleted_at IS NULL
+			UNION ALL
+			SELECT tag.id, tag.name, tag.parent_id, tag.key, tag.value, tag.rule, depth + 1 FROM tag JOIN ancestors ON tag.id = ancestors.parent_id
+			WHERE tag.deleted_at IS NULL
+		)
+		SELECT id, name, parent_id, key, value, rule FROM ancestors ORDER BY depth DESC`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	path := []tag{}
+
+	for rows.Next() {
+		var t tag
+		if err := rows.Scan(&t.ID, &t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule); err != nil {
+			return nil, err
+		}
+		path = append(path, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(path) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return path, nil
+}
+
+// getTagChildren returns a page of the active tags directly below the tag,
+// ordered by ID.
+func getTagChildren(db dbtx, id, start, count int) ([]tag, error) {
+	rows, err := db.Query(
+		"SELECT id, name, parent_id, key, value, rule FROM tag WHERE parent_id=$1 AND deleted_at IS NULL ORDER BY id LIMIT $2 OFFSET $3",
+		id, count, start)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	children := []tag{}
+
+	for rows.Next() {
+		var t tag
+		if err := rows.Scan(&t.ID, &t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule); err != nil {
+			return nil, err
+		}
+		children = append(children, t)
+	}
+
+	return children, rows.Err()
+}
+
+func newBreadcrumb(path []tag) breadcrumb {
+	names := make([]string, len(path))
+	for i, t := range path {
+		names[i] = t.Name
+	}
+
+	return breadcrumb{Tags: path, Path: strings.Join(names, breadcrumbSeparator)}
+}
+
+func (a *App) getTagChildren(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	if count > 10 || count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	t := tag{ID: id}
+	if err := t.getTag(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Tag not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	children, err := getTagChildren(a.DB, id, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, children)
+}
+
+// getTagAncestors responds with the tags above the tag, the top-level one
+// first.
+func (a *App) getTagAncestors(w http.ResponseWriter, r *http.Request) {
+	path, ok := a.readTagPath(w, r)
+	if !ok {
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, path[:len(path)-1])
+}
+
+// getTagBreadcrumb responds with the path down to the tag, including it, and
+// its names joined like "Clothing > Shoes > Running".
+func (a *App) getTagBreadcrumb(w http.ResponseWriter, r *http.Request) {
+	path, ok := a.readTagPath(w, r)
+	if !ok {
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newBreadcrumb(path))
+}
+
+// readTagPath loads the path down to the tag of the request, or responds with
+// an error and returns false.
+func (a *App) readTagPath(w http.ResponseWriter, r *http.Request) ([]tag, bool) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return nil, false
+	}
+
+	path, err := getTagPath(a.DB, id)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Tag not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return nil, false
+	}
+
+	return path, true
+}
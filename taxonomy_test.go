@@ -0,0 +1,156 @@
+// taxonomy_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// addTagTree creates Clothing > Shoes > Running and Clothing > Shirts.
+func addTagTree(t *testing.T) {
+	for _, body := range []string{
+		`{"name":"Clothing"}`,
+		`{"name":"Shoes","parentId":1}`,
+		`{"name":"Running","parentId":2}`,
+		`{"name":"Shirts","parentId":1}`,
+	} {
+		req, _ := http.NewRequest("POST", "/tag", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+	}
+}
+
+func TestTagHierarchy(t *testing.T) {
+	clearTable()
+	addTagTree(t)
+
+	req, _ := http.NewRequest("GET", "/tag/1/children", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var children []tag
+	json.Unmarshal(response.Body.Bytes(), &children)
+	if len(children) != 2 || children[0].Name != "Shoes" || children[1].Name != "Shirts" {
+		t.Errorf("Expected Shoes and Shirts below Clothing. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/tag/3/ancestors", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var ancestors []tag
+	json.Unmarshal(response.Body.Bytes(), &ancestors)
+	if len(ancestors) != 2 || ancestors[0].Name != "Clothing" || ancestors[1].Name != "Shoes" {
+		t.Errorf("Expected Clothing and Shoes above Running. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/tag/3/breadcrumb", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var b breadcrumb
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Path != "Clothing > Shoes > Running" || len(b.Tags) != 3 {
+		t.Errorf("Expected the breadcrumb down to Running. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/tag/1/ancestors", nil)
+	response = executeRequest(req)
+	if body := response.Body.String(); body != "[]" {
+		t.Errorf("Expected no ancestors of a top-level tag. Got %s", body)
+	}
+
+	req, _ = http.NewRequest("GET", "/tag/9/breadcrumb", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestTagHierarchyRejectsCycles(t *testing.T) {
+	clearTable()
+	addTagTree(t)
+
+	for _, body := range []string{
+		`{"name":"Clothing","parentId":1}`,
+		`{"name":"Clothing","parentId":3}`,
+		`{"name":"Clothing","parentId":9}`,
+	} {
+		req, _ := http.NewRequest("PUT", "/tag/1", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	}
+
+	req, _ := http.NewRequest("PATCH", "/tag/2", bytes.NewBufferString(`{"parentId":3}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	// moving Running below Shirts is fine, and so is making Shoes top-level
+	req, _ = http.NewRequest("PATCH", "/tag/3", bytes.NewBufferString(`{"parentId":4}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/tag/2", bytes.NewBufferString(`{"name":"Shoes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	path, _ := getTagPath(a.DB, 3)
+	if newBreadcrumb(path).Path != "Clothing > Shirts > Running" {
+		t.Errorf("Expected Running below Shirts. Got %v", path)
+	}
+	path, _ = getTagPath(a.DB, 2)
+	if len(path) != 1 {
+		t.Errorf("Expected Shoes to be top-level. Got %v", path)
+	}
+}
+
+func TestGetProductsWithTagDescendants(t *testing.T) {
+	clearTable()
+	addTagTree(t)
+	addProducts(4)
+	addTagAssignment(1, 1)
+	addTagAssignment(2, 3)
+	addTagAssignment(2, 2)
+	addTagAssignment(3, 4)
+
+	req, _ := http.NewRequest("GET", "/tag/2/products?descendants=true", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var products []product
+	json.Unmarshal(response.Body.Bytes(), &products)
+	if len(products) != 1 || products[0].ID != 2 {
+		t.Errorf("Expected product 2 once below Shoes. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/tag/1/products?descendants=true", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &products)
+	if len(products) != 3 || products[0].ID != 1 || products[2].ID != 3 {
+		t.Errorf("Expected products 1 to 3 below Clothing. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/tag/1/products", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &products)
+	if len(products) != 1 {
+		t.Errorf("Expected only product 1 without descendants. Got %s", response.Body.String())
+	}
+}
+
+func TestNewBreadcrumb(t *testing.T) {
+	b := newBreadcrumb([]tag{{ID: 1, Name: "Clothing"}, {ID: 2, Name: "Shoes"}})
+	if b.Path != "Clothing > Shoes" || len(b.Tags) != 2 {
+		t.Errorf("Expected Clothing > Shoes. Got %+v", b)
+	}
+
+	if b := newBreadcrumb([]tag{}); b.Path != "" {
+		t.Errorf("Expected an empty path. Got %q", b.Path)
+	}
+}
@@ -0,0 +1,211 @@
+// usage.go
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultCleanupAge is how old unused tags must be before the cleanup
+// removes them, unless the request says otherwise. Younger tags were
+// probably created for products that are about to be tagged.
+const defaultCleanupAge = 30 * 24 * time.Hour
+
+// tagSort orders tag lists, see ?sort=.
+type tagSort string
+
+const (
+	sortTagsByID        tagSort = "id"
+	sortTagsByUsage     tagSort = "usage"
+	sortTagsByUsageDesc tagSort = "-usage"
+)
+
+func parseTagSort(value string) (tagSort, error) {
+	switch s := tagSort(value); s {
+	case "":
+		return sortTagsByID, nil
+	case sortTagsByID, sortTagsByUsage, sortTagsByUsageDesc:
+		return s, nil
+	default:
+		return "", errors.New("sort must be one of id, usage or -usage")
+	}
+}
+
+// orderBy returns the ORDER BY clause of the sort. Ties are broken by ID, so
+// pages do not overlap.
+func (s tagSort) orderBy() string {
+	switch s {
+	case sortTagsByUsage:
+		return "usage, tag.id"
+	case sortTagsByUsageDesc:
+		return "usage DESC, tag.id"
+	default:
+		return "tag.id"
+	}
+}
+
+// tagWithUsage is a tag with the number of active products that have it,
+// see ?include=usage.
+type tagWithUsage struct {
+	tag
+	Usage int `json:"usage"`
+}
+
+// tagCleanup reports the unused tags a cleanup moved to the trash, or would
+// have moved there in a dry run.
+type tagCleanup struct {
+	DryRun    bool   `json:"dryRun"`
+	OlderThan string `json:"olderThan"`
+	Tags      []tag  `json:"tags"`
+}
+
+// getTagsWithUsage returns a page of tags with their usage. With unused only
+// the tags no active product has are returned.
+func getTagsWithUsage(db dbtx, start, count int, deleted deletedFilter, sort tagSort, unused bool) ([]tagWithUsage, error) {
+	having := ""
+	if unused {
+		having = " HAVING COUNT(pta.id) = 0"
+	}
+
+	rows, err := db.Query(`SELECT tag.id, tag.name, tag.parent_id, tag.key, tag.value, tag.rule, tag.deleted_at, COUNT(pta.id) AS usage
+		FROM tag LEFT JOIN productToTagAssignment pta ON pta.tagID = tag.id AND pta.deleted_at IS NULL
+		WHERE `+deleted.condition("tag")+`
+		GROUP BY tag.id`+having+`
+		ORDER BY `+sort.orderBy()+` LIMIT $1 OFFSET $2`,
+		count, start)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tags := []tagWithUsage{}
+
+	for rows.Next() {
+		var t tagWithUsage
+		if err := rows.Scan(&t.ID, &t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule, &t.DeletedAt, &t.Usage); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+
+	return tags, rows.Err()
+}
+
+// getTagUsage counts the active products that have the tag.
+func getTagUsage(db dbtx, id int) (int, error) {
+	var usage int
+	err := db.QueryRow("SELECT COUNT(*) FROM productToTagAssignment WHERE tagID=$1 AND deleted_at IS NULL", id).Scan(&usage)
+
+	return usage, err
+}
+
+// getOrphanTags returns the active tags created before the given time that
+// have never been assigned or whose assignments were all purged. Tags whose
+// products are in the trash are kept, since restoring a product restores its
+// assignments, and so are tags with active children, which group other tags,
+// and smart tags, whose rules may just not match any product yet. In a
+// transaction the tags are locked until it ends.
+func getOrphanTags(db dbtx, before time.Time, lock bool) ([]tag, error) {
+	forUpdate := ""
+	if lock {
+		forUpdate = " FOR UPDATE"
+	}
+
+	rows, err := db.Query(`SELECT id, name, parent_id, key, value, rule FROM tag
+		WHERE deleted_at IS NULL AND created_at < $1 AND rule = ''
+		AND NOT EXISTS (SELECT 1 FROM productToTagAssignment pta WHERE pta.tagID = tag.id)
+		AND NOT EXISTS (SELECT 1 FROM tag child WHERE child.parent_id = tag.id AND child.deleted_at IS NULL)
+		ORDER BY id`+forUpdate, before)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tags := []tag{}
+
+	for rows.Next() {
+		var t tag
+		if err := rows.Scan(&t.ID, &t.Name, &t.ParentID, &t.Key, &t.Value, &t.Rule); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+
+	return tags, rows.Err()
+}
+
+// cleanupTagsTx moves the orphan tags created before the given time to the
+// trash, from where the purge job removes them for good.
+func cleanupTagsTx(tx *sql.Tx, cs *changeSet, before time.Time) ([]tag, error) {
+	orphans, err := getOrphanTags(tx, before, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range orphans {
+		if err := deleteTagTx(tx, cs, t.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return orphans, nil
+}
+
+// cleanupTags moves the tags nobody uses to the trash. ?olderThan= is the
+// minimum age of the tags, such as 720h; with ?dryRun=true the tags are only
+// listed.
+func (a *App) cleanupTags(w http.ResponseWriter, r *http.Request) {
+	age := defaultCleanupAge
+	if value := r.FormValue("olderThan"); value != "" {
+		var err error
+		if age, err = time.ParseDuration(value); err != nil || age < 0 {
+			respondWithError(w, http.StatusBadRequest, "olderThan must be a duration such as 720h")
+			return
+		}
+	}
+	dryRun, _ := strconv.ParseBool(r.FormValue("dryRun"))
+
+	cleanup := tagCleanup{DryRun: dryRun, OlderThan: age.String()}
+	before := time.Now().Add(-age)
+
+	var err error
+	if dryRun {
+		cleanup.Tags, err = getOrphanTags(a.DB, before, false)
+	} else {
+		err = a.inTx(r.Context(), func(tx *sql.Tx, cs *changeSet) error {
+			tags, err := cleanupTagsTx(tx, cs, before)
+			cleanup.Tags = tags
+			return err
+		})
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cleanup)
+}
+
+// tagListOptions reads the parameters of GET /tags that need the usage of
+// the tags: ?include=usage, ?sort= and ?unused=.
+func tagListOptions(r *http.Request) (include map[string]bool, sort tagSort, unused bool, err error) {
+	if include, err = parseInclude(r, "usage"); err != nil {
+		return nil, "", false, err
+	}
+	if sort, err = parseTagSort(r.FormValue("sort")); err != nil {
+		return nil, "", false, err
+	}
+	if value := r.FormValue("unused"); value != "" {
+		if unused, err = strconv.ParseBool(value); err != nil {
+			return nil, "", false, errors.New("unused must be true or false")
+		}
+	}
+
+	return include, sort, unused, nil
+}
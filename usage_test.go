@@ -0,0 +1,136 @@
+// usage_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestListTagsByUsage(t *testing.T) {
+	clearTable()
+	addTags(3)
+	addProducts(2)
+	addTagAssignment(1, 2)
+	addTagAssignment(2, 2)
+	addTagAssignment(1, 1)
+
+	req, _ := http.NewRequest("GET", "/tags?sort=-usage&include=usage", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var tags []tagWithUsage
+	json.Unmarshal(response.Body.Bytes(), &tags)
+	if len(tags) != 3 || tags[0].ID != 2 || tags[0].Usage != 2 || tags[2].ID != 3 || tags[2].Usage != 0 {
+		t.Errorf("Expected the tags by usage, the most used first. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/tags?unused=true", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var unused []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &unused)
+	if len(unused) != 1 || unused[0]["id"] != 3.0 {
+		t.Errorf("Expected only Tag 2 to be unused. Got %s", response.Body.String())
+	}
+	if _, ok := unused[0]["usage"]; ok {
+		t.Errorf("Expected no usage without include=usage. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/tag/2?include=usage", nil)
+	response = executeRequest(req)
+	var single tagWithUsage
+	json.Unmarshal(response.Body.Bytes(), &single)
+	if single.Usage != 2 {
+		t.Errorf("Expected Tag 1 to be used twice. Got %s", response.Body.String())
+	}
+
+	for _, url := range []string{"/tags?sort=name", "/tags?unused=maybe", "/tags?sort=usage&format=ndjson", "/tag/2?include=products,usage"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if response := executeRequest(req); response.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s. Got %d", url, response.Code)
+		}
+	}
+}
+
+func TestCleanupTags(t *testing.T) {
+	clearTable()
+	addTags(4)
+	addProducts(2)
+	addTagAssignment(1, 1)
+	addTagAssignment(2, 2)
+	// Tag 2 sits below Tag 3, which therefore stays
+	a.DB.Exec("UPDATE tag SET parent_id=4 WHERE id=3")
+	// the assignment of Tag 1 is in the trash with its product
+	req, _ := http.NewRequest("DELETE", "/product/2", nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("POST", "/tags/cleanup?olderThan=0s&dryRun=true", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var cleanup tagCleanup
+	json.Unmarshal(response.Body.Bytes(), &cleanup)
+	if !cleanup.DryRun || len(cleanup.Tags) != 1 || cleanup.Tags[0].ID != 3 {
+		t.Fatalf("Expected Tag 2 to be listed. Got %s", response.Body.String())
+	}
+	if tg := (tag{ID: 3}); tg.getTag(a.DB) != nil {
+		t.Errorf("Expected the dry run to keep Tag 2")
+	}
+
+	req, _ = http.NewRequest("POST", "/tags/cleanup?olderThan=1h", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &cleanup)
+	if len(cleanup.Tags) != 0 {
+		t.Errorf("Expected new tags to be spared. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/tags/cleanup?olderThan=0s", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &cleanup)
+	if cleanup.DryRun || len(cleanup.Tags) != 1 {
+		t.Errorf("Expected Tag 2 to be removed. Got %s", response.Body.String())
+	}
+	if tg := (tag{ID: 3}); tg.getTag(a.DB) == nil {
+		t.Errorf("Expected Tag 2 to be in the trash")
+	}
+
+	req, _ = http.NewRequest("POST", "/tags/cleanup?olderThan=a+while", nil)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+}
+
+func TestCleanupSparesSmartTags(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	// no product is cheap enough yet, so the smart tag has no assignments
+	req, _ := http.NewRequest("POST", "/tag", bytes.NewBufferString(`{"name":"cheap","rule":"price < 5"}`))
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("POST", "/tags/cleanup?olderThan=0s", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var cleanup tagCleanup
+	json.Unmarshal(response.Body.Bytes(), &cleanup)
+	if len(cleanup.Tags) != 0 {
+		t.Errorf("Expected the smart tag to be kept. Got %s", response.Body.String())
+	}
+	if tg := (tag{ID: 1}); tg.getTag(a.DB) != nil {
+		t.Errorf("Expected the smart tag to stay active")
+	}
+}
+
+func TestParseTagSort(t *testing.T) {
+	if sort, err := parseTagSort(""); err != nil || sort.orderBy() != "tag.id" {
+		t.Errorf("Expected tags by ID by default. Got %q %v", sort, err)
+	}
+	if sort, err := parseTagSort("-usage"); err != nil || sort.orderBy() != "usage DESC, tag.id" {
+		t.Errorf("Expected the most used tags first. Got %q %v", sort, err)
+	}
+	if _, err := parseTagSort("name"); err == nil {
+		t.Errorf("Expected an unknown sort to be rejected")
+	}
+}
@@ -0,0 +1,648 @@
+// webhook.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// webhookEventTypes lists the events a subscription can filter on. A filter
+// may also use a wildcard such as "product.*".
+var webhookEventTypes = []string{
+	"product.created", "product.updated", "product.deleted", "product.restored", "product.purged",
+	"tag.created", "tag.updated", "tag.deleted", "tag.restored", "tag.purged", "tag.merged",
+	"alias.created", "alias.deleted",
+	"tag_order.updated", "product_order.updated",
+	"product.tagged", "product.untagged",
+}
+
+// eventType names the change the way webhook subscribers see it. Tag
+// assignments are reported as product.tagged and product.untagged.
+func (c change) eventType() string {
+	if c.Entity != "assignment" {
+		return c.Entity + "." + c.Action
+	}
+
+	switch c.Action {
+	case "created", "restored":
+		return "product.tagged"
+	case "deleted":
+		return "product.untagged"
+	default:
+		// purging an assignment that was already removed is not news, and
+		// moving assignments is reported by the tag.merged event
+		return ""
+	}
+}
+
+// enqueueWebhooks stores one pending delivery per event and matching
+// subscription. It runs inside the transaction of the change, so an event
+// is only ever sent for changes that were committed.
+func enqueueWebhooks(db dbtx, catalogEvents []catalogEvent) (int64, error) {
+	type pending struct {
+		EventType string       `json:"event_type"`
+		Payload   catalogEvent `json:"payload"`
+	}
+
+	events := []pending{}
+	for _, e := range catalogEvents {
+		events = append(events, pending{e.Type, e})
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	records, err := json.Marshal(events)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := db.Exec(`INSERT INTO webhook_delivery(subscription_id, event_type, payload)
+		SELECT s.id, e.event_type, e.payload
+		FROM ROWS FROM (jsonb_to_recordset($1::jsonb) AS (event_type TEXT, payload JSONB)) WITH ORDINALITY AS e(event_type, payload, n)
+		JOIN webhook_subscription s ON s.active AND (cardinality(s.event_types) = 0
+			OR e.event_type = ANY(s.event_types) OR split_part(e.event_type, '.', 1) || '.*' = ANY(s.event_types))
+		ORDER BY e.n, s.id`, string(records))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+type webhookSubscription struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes []string  `json:"eventTypes"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// webhookSubscriptionInput is the body of POST and PUT requests. The secret
+// is generated when it is left out on creation and kept on updates.
+type webhookSubscriptionInput struct {
+	URL        *string   `json:"url"`
+	Secret     *string   `json:"secret"`
+	EventTypes *[]string `json:"eventTypes"`
+	Active     *bool     `json:"active"`
+}
+
+func (in webhookSubscriptionInput) missingFields() []string {
+	missing := []string{}
+	if in.URL == nil {
+		missing = append(missing, "url")
+	}
+	if in.EventTypes == nil {
+		missing = append(missing, "eventTypes")
+	}
+	if in.Active == nil {
+		missing = append(missing, "active")
+	}
+
+	return missing
+}
+
+func (s *webhookSubscription) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return validationError("url must be an absolute http or https URL")
+	}
+
+	for _, t := range s.EventTypes {
+		if !isWebhookEventType(t) {
+			return validationError(fmt.Sprintf("Unknown event type %q", t))
+		}
+	}
+
+	return nil
+}
+
+func isWebhookEventType(t string) bool {
+	for _, known := range webhookEventTypes {
+		if t == known || t == strings.SplitN(known, ".", 2)[0]+".*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *webhookSubscription) getWebhookSubscription(db dbtx) error {
+	return db.QueryRow("SELECT url, secret, event_types, active, created_at FROM webhook_subscription WHERE id=$1",
+		s.ID).Scan(&s.URL, &s.Secret, pq.Array(&s.EventTypes), &s.Active, &s.CreatedAt)
+}
+
+func (s *webhookSubscription) createWebhookSubscription(db dbtx) error {
+	return db.QueryRow(
+		"INSERT INTO webhook_subscription(url, secret, event_types, active) VALUES($1, $2, $3, $4) RETURNING id, created_at",
+		s.URL, s.Secret, pq.Array(s.EventTypes), s.Active).Scan(&s.ID, &s.CreatedAt)
+}
+
+func (s *webhookSubscription) updateWebhookSubscription(db dbtx) error {
+	return db.QueryRow(
+		"UPDATE webhook_subscription SET url=$1, secret=$2, event_types=$3, active=$4 WHERE id=$5 RETURNING created_at",
+		s.URL, s.Secret, pq.Array(s.EventTypes), s.Active, s.ID).Scan(&s.CreatedAt)
+}
+
+func (s *webhookSubscription) deleteWebhookSubscription(db dbtx) error {
+	_, err := db.Exec("DELETE FROM webhook_subscription WHERE id=$1", s.ID)
+
+	return err
+}
+
+func getWebhookSubscriptions(db dbtx, start, count int) ([]webhookSubscription, error) {
+	rows, err := db.Query(
+		"SELECT id, url, event_types, active, created_at FROM webhook_subscription ORDER BY id LIMIT $1 OFFSET $2",
+		count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	subscriptions := []webhookSubscription{}
+
+	for rows.Next() {
+		var s webhookSubscription
+		if err := rows.Scan(&s.ID, &s.URL, pq.Array(&s.EventTypes), &s.Active, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryDead      = "dead"
+)
+
+type webhookDelivery struct {
+	ID             int64           `json:"id"`
+	SubscriptionID int             `json:"subscriptionID"`
+	EventType      string          `json:"eventType"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastError      *string         `json:"lastError,omitempty"`
+	ResponseCode   *int            `json:"responseCode,omitempty"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+}
+
+// getWebhookDeliveries lists deliveries, newest first. A subscriptionID of 0
+// and an empty status match every delivery.
+func getWebhookDeliveries(db dbtx, subscriptionID int, status string, start, count int) ([]webhookDelivery, error) {
+	rows, err := db.Query(`SELECT id, subscription_id, event_type, payload, status, attempts, last_error,
+			response_code, next_attempt_at, created_at, delivered_at
+		FROM webhook_delivery
+		WHERE ($1 = 0 OR subscription_id = $1) AND ($2 = '' OR status = $2)
+		ORDER BY id DESC LIMIT $3 OFFSET $4`,
+		subscriptionID, status, count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := []webhookDelivery{}
+
+	for rows.Next() {
+		var d webhookDelivery
+		var payload []byte
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventType, &payload, &d.Status, &d.Attempts, &d.LastError,
+			&d.ResponseCode, &d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		d.Payload = payload
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// retryWebhookDelivery puts a dead delivery back into the queue.
+func retryWebhookDelivery(db dbtx, id int64) error {
+	res, err := db.Exec(`UPDATE webhook_delivery SET status=$1, attempts=0, next_attempt_at=now()
+		WHERE id=$2 AND status=$3`, deliveryPending, id, deliveryDead)
+
+	if err != nil {
+		return err
+	}
+
+	return expectRowsAffected(res)
+}
+
+// webhookDispatcher posts pending deliveries to their subscribers. Failed
+// deliveries are retried with exponential backoff until maxAttempts is
+// reached, after which they end up in the dead-letter list.
+type webhookDispatcher struct {
+	db          *sql.DB
+	client      *http.Client
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	// lease is how long a claimed delivery is hidden from other workers.
+	lease time.Duration
+}
+
+func newWebhookDispatcher(db *sql.DB) *webhookDispatcher {
+	return &webhookDispatcher{
+		db:          db,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: 8,
+		baseDelay:   10 * time.Second,
+		maxDelay:    time.Hour,
+		lease:       time.Minute,
+	}
+}
+
+func (d *webhookDispatcher) backoff(attempts int) time.Duration {
+	delay := d.baseDelay
+	for i := 1; i < attempts && delay < d.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.maxDelay {
+		delay = d.maxDelay
+	}
+
+	return delay
+}
+
+type claimedDelivery struct {
+	id        int64
+	eventType string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// deliverDue sends up to batchSize deliveries that are due and returns how
+// many it attempted.
+func (d *webhookDispatcher) deliverDue(batchSize int) (int, error) {
+	rows, err := d.db.Query(`WITH due AS (
+			SELECT id FROM webhook_delivery WHERE status=$1 AND next_attempt_at <= now()
+			ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED
+		)
+		UPDATE webhook_delivery wd SET next_attempt_at = now() + $3::double precision * interval '1 second'
+		FROM due, webhook_subscription s
+		WHERE wd.id = due.id AND s.id = wd.subscription_id
+		RETURNING wd.id, wd.event_type, wd.payload, wd.attempts, s.url, s.secret`,
+		deliveryPending, batchSize, d.lease.Seconds())
+
+	if err != nil {
+		return 0, err
+	}
+
+	claimed := []claimedDelivery{}
+	for rows.Next() {
+		var c claimedDelivery
+		if err := rows.Scan(&c.id, &c.eventType, &c.payload, &c.attempts, &c.url, &c.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		claimed = append(claimed, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, c := range claimed {
+		code, err := d.send(c)
+		if err := d.recordAttempt(c, code, err); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(claimed), nil
+}
+
+// send posts the delivery. The body is signed with HMAC-SHA256 over
+// "<timestamp>.<body>" using the subscription secret; receivers should
+// recompute it from the X-Webhook-Timestamp header and the raw body.
+func (d *webhookDispatcher) send(c claimedDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(c.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cicd-microservices-webhooks")
+	req.Header.Set("X-Webhook-Event", c.eventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(c.id, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(c.secret, timestamp, c.payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("subscriber answered %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *webhookDispatcher) recordAttempt(c claimedDelivery, code int, sendErr error) error {
+	var responseCode *int
+	if code != 0 {
+		responseCode = &code
+	}
+
+	attempts := c.attempts + 1
+	if sendErr == nil {
+		_, err := d.db.Exec(`UPDATE webhook_delivery SET status=$1, attempts=$2, response_code=$3, last_error=NULL,
+			delivered_at=now() WHERE id=$4`, deliverySucceeded, attempts, responseCode, c.id)
+		return err
+	}
+
+	status := deliveryPending
+	if attempts >= d.maxAttempts {
+		status = deliveryDead
+	}
+
+	_, err := d.db.Exec(`UPDATE webhook_delivery SET status=$1, attempts=$2, response_code=$3, last_error=$4,
+		next_attempt_at = now() + $5::double precision * interval '1 second' WHERE id=$6`,
+		status, attempts, responseCode, sendErr.Error(), d.backoff(attempts).Seconds(), c.id)
+	return err
+}
+
+// StartWebhookWorker delivers pending webhooks whenever a mutation enqueued
+// some, and at least once every interval to pick up retries.
+func (a *App) StartWebhookWorker(interval time.Duration) {
+	d := newWebhookDispatcher(a.DB)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-a.webhookWake:
+			}
+
+			for {
+				n, err := d.deliverDue(50)
+				if err != nil {
+					log.Printf("delivering webhooks: %v", err)
+				}
+				if err != nil || n == 0 {
+					break
+				}
+			}
+		}
+	}()
+}
+
+// wakeWebhookWorker tells the worker that new deliveries are pending
+// without ever blocking the request that enqueued them.
+func (a *App) wakeWebhookWorker() {
+	select {
+	case a.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+########
+Handlers
+########
+*/
+
+func (a *App) getWebhookSubscriptions(w http.ResponseWriter, r *http.Request) {
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	if count > 10 || count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	subscriptions, err := getWebhookSubscriptions(a.DB, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, subscriptions)
+}
+
+func (a *App) getWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	s := webhookSubscription{ID: id}
+	if err := s.getWebhookSubscription(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Webhook not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	// the secret is only ever shown when the subscription is created
+	s.Secret = ""
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+func (a *App) createWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	var in webhookSubscriptionInput
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&in); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if in.Active == nil {
+		active := true
+		in.Active = &active
+	}
+	if in.EventTypes == nil {
+		in.EventTypes = &[]string{}
+	}
+	if missing := in.missingFields(); len(missing) > 0 {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: "+strings.Join(missing, ", "))
+		return
+	}
+
+	s := webhookSubscription{URL: *in.URL, EventTypes: *in.EventTypes, Active: *in.Active, Secret: newRequestID()}
+	if in.Secret != nil && *in.Secret != "" {
+		s.Secret = *in.Secret
+	}
+	if err := s.validate(); err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if err := s.createWebhookSubscription(a.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, s)
+}
+
+func (a *App) updateWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	var in webhookSubscriptionInput
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&in); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if missing := in.missingFields(); len(missing) > 0 {
+		respondWithError(w, http.StatusBadRequest, "Missing required fields: "+strings.Join(missing, ", "))
+		return
+	}
+
+	s := webhookSubscription{ID: id}
+	if err := s.getWebhookSubscription(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Webhook not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	s.URL, s.EventTypes, s.Active = *in.URL, *in.EventTypes, *in.Active
+	if in.Secret != nil && *in.Secret != "" {
+		s.Secret = *in.Secret
+	}
+	if err := s.validate(); err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if err := s.updateWebhookSubscription(a.DB); err != nil {
+		respondWithMutationError(w, err, "Webhook not found")
+		return
+	}
+
+	s.Secret = ""
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+func (a *App) deleteWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	s := webhookSubscription{ID: id}
+	if err := s.deleteWebhookSubscription(a.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	a.respondWithDeliveries(w, r, id, r.FormValue("status"))
+}
+
+func (a *App) getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	a.respondWithDeliveries(w, r, 0, deliveryDead)
+}
+
+func (a *App) respondWithDeliveries(w http.ResponseWriter, r *http.Request, subscriptionID int, status string) {
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	if count > 100 || count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	deliveries, err := getWebhookDeliveries(a.DB, subscriptionID, status, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
+
+func (a *App) retryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid delivery ID")
+		return
+	}
+
+	if err := retryWebhookDelivery(a.DB, id); err != nil {
+		respondWithMutationError(w, err, "Dead delivery not found")
+		return
+	}
+
+	a.wakeWebhookWorker()
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
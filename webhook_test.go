@@ -0,0 +1,144 @@
+// webhook_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func addWebhookSubscription(t *testing.T, url, eventTypes string) map[string]interface{} {
+	var jsonStr = []byte(`{"url":"` + url + `", "secret":"s3cret", "eventTypes":` + eventTypes + `}`)
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	return m
+}
+
+func TestCreateWebhookSubscription(t *testing.T) {
+	clearTable()
+
+	m := addWebhookSubscription(t, "http://example.com/hook", `["product.created","tag.*"]`)
+	if m["secret"] != "s3cret" || m["active"] != true {
+		t.Errorf("Expected an active subscription with its secret. Got %v", m)
+	}
+
+	req, _ := http.NewRequest("GET", "/webhook/1", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if _, ok := m["secret"]; ok {
+		t.Errorf("Expected the secret to be hidden. Got %v", m)
+	}
+
+	req, _ = http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"url":"http://example.com", "eventTypes":["order.created"]}`)))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	clearTable()
+
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	addWebhookSubscription(t, receiver.URL, `["product.created"]`)
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer([]byte(`{"name":"hooked", "price": 1}`)))
+	executeRequest(req)
+	req, _ = http.NewRequest("POST", "/tag", bytes.NewBuffer([]byte(`{"name":"not subscribed"}`)))
+	executeRequest(req)
+
+	n, err := newWebhookDispatcher(a.DB).deliverDue(10)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected exactly one delivery. Got %d, %v", n, err)
+	}
+
+	r, body := <-received, <-bodies
+	if r.Header.Get("X-Webhook-Event") != "product.created" {
+		t.Errorf("Expected a product.created event. Got %s", r.Header.Get("X-Webhook-Event"))
+	}
+
+	signature := "sha256=" + signWebhook("s3cret", r.Header.Get("X-Webhook-Timestamp"), body)
+	if r.Header.Get("X-Webhook-Signature") != signature {
+		t.Errorf("Expected signature %s. Got %s", signature, r.Header.Get("X-Webhook-Signature"))
+	}
+
+	req, _ = http.NewRequest("GET", "/webhook/1/deliveries", nil)
+	response := executeRequest(req)
+
+	var deliveries []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &deliveries)
+	if len(deliveries) != 1 || deliveries[0]["status"] != "succeeded" {
+		t.Errorf("Expected one succeeded delivery. Got %s", response.Body.String())
+	}
+}
+
+func TestWebhookRetriesAndDeadLetters(t *testing.T) {
+	clearTable()
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	addWebhookSubscription(t, receiver.URL, `[]`)
+
+	req, _ := http.NewRequest("POST", "/tag", bytes.NewBuffer([]byte(`{"name":"failing"}`)))
+	executeRequest(req)
+
+	d := newWebhookDispatcher(a.DB)
+	d.maxAttempts = 2
+	d.baseDelay = 0
+
+	for i := 0; i < 2; i++ {
+		if _, err := d.deliverDue(10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/webhooks/deadletters", nil)
+	response := executeRequest(req)
+
+	var deliveries []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &deliveries)
+	if len(deliveries) != 1 || deliveries[0]["attempts"] != 2.0 || deliveries[0]["responseCode"] != 503.0 {
+		t.Fatalf("Expected one dead delivery after 2 attempts. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/webhook/delivery/1/retry", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/webhooks/deadletters", nil)
+	response = executeRequest(req)
+	if body := response.Body.String(); body != "[]" {
+		t.Errorf("Expected the retried delivery to leave the dead-letter list. Got %s", body)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := webhookDispatcher{baseDelay: 10 * time.Second, maxDelay: time.Minute}
+
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, e := range expected {
+		if got := d.backoff(i + 1); got != e {
+			t.Errorf("Expected the delay after %d attempts to be %s. Got %s", i+1, e, got)
+		}
+	}
+}